@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AbuseReport struct {
+	ID         int64
+	LinkID     int64
+	Alias      string
+	Reason     string
+	ReporterIP string
+	CreatedAt  time.Time
+}
+
+type ModerationStore interface {
+	SearchLinks(ctx context.Context, query string, limit int) ([]Link, error)
+	GetLinkByID(ctx context.Context, id int64) (*Link, error)
+	SetLinkDisabled(ctx context.Context, id int64, disabled bool) error
+	DeleteLink(ctx context.Context, id int64) error
+	CreateAbuseReport(ctx context.Context, alias, reason, reporterIP string) error
+	ListAbuseReports(ctx context.Context, linkID int64, limit int) ([]AbuseReport, error)
+}
+
+// RequireAdmin restricts the admin area to users with the admin role.
+func (app *Application) RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := currentUser(c)
+		if user == nil {
+			return loginRequired(c)
+		}
+		if user.Role != RoleAdmin {
+			return echo.NewHTTPError(http.StatusForbidden, "admin access required")
+		}
+		return next(c)
+	}
+}
+
+func (app *Application) AdminIndex(c echo.Context) error {
+	ctx := c.Request().Context()
+	query := strings.TrimSpace(c.QueryParam("q"))
+
+	links, err := app.Moderation.SearchLinks(ctx, query, 50)
+	if err != nil {
+		return err
+	}
+	reports, err := app.Moderation.ListAbuseReports(ctx, 0, 20)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "admin.html", app.pageData(c, map[string]any{
+		"query":   query,
+		"links":   links,
+		"reports": reports,
+	}))
+}
+
+func (app *Application) AdminLink(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+
+	link, err := app.Moderation.GetLinkByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+		}
+		return err
+	}
+	reports, err := app.Moderation.ListAbuseReports(ctx, id, 50)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "admin_link.html", app.pageData(c, map[string]any{
+		"link":        link,
+		"cachePolicy": link.CachePolicy(app.permanentRedirectMaxAge()),
+		"reports":     reports,
+		"baseURL":     app.BaseURL,
+	}))
+}
+
+func (app *Application) AdminDisableLink(c echo.Context) error {
+	return app.moderateLink(c, "disable")
+}
+
+func (app *Application) AdminEnableLink(c echo.Context) error {
+	return app.moderateLink(c, "enable")
+}
+
+func (app *Application) AdminDeleteLink(c echo.Context) error {
+	return app.moderateLink(c, "delete")
+}
+
+func (app *Application) moderateLink(c echo.Context, action string) error {
+	ctx := c.Request().Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+
+	switch action {
+	case "disable":
+		err = app.Moderation.SetLinkDisabled(ctx, id, true)
+	case "enable":
+		err = app.Moderation.SetLinkDisabled(ctx, id, false)
+	case "delete":
+		err = app.Moderation.DeleteLink(ctx, id)
+	}
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+		}
+		return err
+	}
+	app.Logger.Info("admin moderated link", "action", action, "link_id", id, "admin", currentUser(c).Email)
+
+	if action == "delete" {
+		return c.Redirect(http.StatusSeeOther, "/admin")
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/admin/links/%d", id))
+}
+
+// ReportAbuse lets anyone flag a short link for review by an admin.
+func (app *Application) ReportAbuse(c echo.Context) error {
+	var request struct {
+		Reason string `json:"reason" validate:"required,max=1000"`
+	}
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	if err := c.Validate(request); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	}
+
+	err := app.Moderation.CreateAbuseReport(c.Request().Context(), c.Param("alias"), request.Reason, c.RealIP())
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+		}
+		return err
+	}
+	return c.NoContent(http.StatusAccepted)
+}
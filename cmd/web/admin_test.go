@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memoryModerationStore struct {
+	mu      sync.Mutex
+	links   []Link
+	reports []AbuseReport
+}
+
+func (s *memoryModerationStore) find(id int64) int {
+	for i, l := range s.links {
+		if l.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryModerationStore) SearchLinks(_ context.Context, query string, limit int) ([]Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var links []Link
+	for _, l := range s.links {
+		if query == "" || l.Alias == query || strings.Contains(strings.ToLower(l.OriginalURL), strings.ToLower(query)) {
+			links = append(links, l)
+		}
+	}
+	return links[:min(len(links), limit)], nil
+}
+
+func (s *memoryModerationStore) GetLinkByID(_ context.Context, id int64) (*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return nil, ErrRecordNotFound
+	}
+	link := s.links[i]
+	return &link, nil
+}
+
+func (s *memoryModerationStore) SetLinkDisabled(_ context.Context, id int64, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return ErrRecordNotFound
+	}
+	s.links[i].DisabledAt = time.Time{}
+	if disabled {
+		s.links[i].DisabledAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memoryModerationStore) DeleteLink(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(id)
+	if i < 0 {
+		return ErrRecordNotFound
+	}
+	s.links = append(s.links[:i], s.links[i+1:]...)
+	return nil
+}
+
+func (s *memoryModerationStore) CreateAbuseReport(_ context.Context, alias, reason, reporterIP string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.links {
+		if l.Alias == alias {
+			s.reports = append(s.reports, AbuseReport{
+				ID:         int64(len(s.reports) + 1),
+				LinkID:     l.ID,
+				Alias:      alias,
+				Reason:     reason,
+				ReporterIP: reporterIP,
+				CreatedAt:  time.Now(),
+			})
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (s *memoryModerationStore) ListAbuseReports(_ context.Context, linkID int64, limit int) ([]AbuseReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []AbuseReport
+	for _, r := range s.reports {
+		if linkID == 0 || r.LinkID == linkID {
+			reports = append(reports, r)
+		}
+	}
+	return reports[:min(len(reports), limit)], nil
+}
+
+func newAdminTestServer(t *testing.T) (*httptest.Server, *memoryUserStore, *memoryModerationStore) {
+	t.Helper()
+	users := newMemoryUserStore()
+	moderation := &memoryModerationStore{links: []Link{
+		{ID: 1, Alias: "phishing123", OriginalURL: "https://bad.example.com/login", Clicks: 42, CreatedAt: time.Now()},
+		{ID: 2, Alias: "harmless123", OriginalURL: "https://example.com/docs", Owner: "user:7", CreatedAt: time.Now()},
+	}}
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			listLinksFn: func(context.Context, string, int) ([]Link, error) { return nil, nil },
+		},
+		Users:      users,
+		Moderation: moderation,
+	}
+	server := httptest.NewTLSServer(app.Router())
+	app.BaseURL = server.URL
+	t.Cleanup(server.Close)
+	return server, users, moderation
+}
+
+func registerBrowser(t *testing.T, baseURL, email string) *http.Client {
+	t.Helper()
+	client := newBrowser(t)
+	resp := submitForm(t, client, baseURL, "/register", "/register", url.Values{
+		"email":    {email},
+		"password": {"long enough"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	return client
+}
+
+func TestAdminRequiresAdminRole(t *testing.T) {
+	server, users, _ := newAdminTestServer(t)
+
+	status, _ := getPage(t, newBrowser(t), server.URL+"/admin")
+	require.Equal(t, http.StatusSeeOther, status)
+
+	user := registerBrowser(t, server.URL, "user@example.com")
+	status, body := getPage(t, user, server.URL+"/admin")
+	require.Equal(t, http.StatusForbidden, status)
+	require.NotContains(t, body, "phishing123")
+
+	status, _ = getPage(t, user, server.URL+"/admin/links/1")
+	require.Equal(t, http.StatusForbidden, status)
+
+	status, body = getPage(t, user, server.URL+"/")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, `href="/admin"`)
+
+	users.users[0].Role = RoleAdmin
+	status, body = getPage(t, user, server.URL+"/")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `href="/admin"`)
+}
+
+func TestAdminModeratesLinks(t *testing.T) {
+	server, users, moderation := newAdminTestServer(t)
+	admin := registerBrowser(t, server.URL, "admin@example.com")
+	users.users[0].Role = RoleAdmin
+
+	resp, err := newClient().Post(server.URL+"/api/links/phishing123/report", "application/json",
+		strings.NewReader(`{"reason": "credential phishing"}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp, err = newClient().Post(server.URL+"/api/links/unknown/report", "application/json",
+		strings.NewReader(`{"reason": "spam"}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	status, body := getPage(t, admin, server.URL+"/admin")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `href="/admin"`)
+	require.Contains(t, body, "harmless123")
+	require.Contains(t, body, "credential phishing")
+
+	status, body = getPage(t, admin, server.URL+"/admin?q=bad.example")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "phishing123")
+	require.NotContains(t, body, "harmless123")
+
+	status, body = getPage(t, admin, server.URL+"/admin/links/1")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `id="clicks" class="col-span-2">42<`)
+	require.Contains(t, body, "credential phishing")
+
+	resp = submitForm(t, admin, server.URL, "/admin/links/1", "/admin/links/1/disable", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/admin/links/1", resp.Header.Get("Location"))
+	require.False(t, moderation.links[0].DisabledAt.IsZero())
+
+	resp = submitForm(t, admin, server.URL, "/admin/links/1", "/admin/links/1/enable", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.True(t, moderation.links[0].DisabledAt.IsZero())
+
+	resp = submitForm(t, admin, server.URL, "/admin/links/2", "/admin/links/2/delete", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/admin", resp.Header.Get("Location"))
+	status, _ = getPage(t, admin, server.URL+"/admin/links/2")
+	require.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,52 @@
+package main
+
+// aliasWords are short, common and easy to spell words used by
+// WordAliasGenerator.
+var aliasWords = []string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby", "back",
+	"ball", "band", "bank", "base", "bath", "bear", "beat", "bell", "belt",
+	"best", "bird", "blue", "boat", "body", "bold", "bone", "book", "boot",
+	"born", "boss", "both", "bowl", "bulk", "burn", "bush", "busy", "cake",
+	"calm", "camp", "card", "care", "cart", "case", "cash", "cast", "cave",
+	"cell", "chef", "chip", "city", "clay", "club", "coal", "coat", "code",
+	"cold", "cook", "cool", "copy", "core", "corn", "cost", "crew", "crop",
+	"cube", "cure", "dark", "data", "dawn", "deal", "deep", "deer", "desk",
+	"dial", "diet", "disk", "dive", "dock", "door", "dose", "dove", "down",
+	"draw", "drum", "duck", "dune", "dust", "duty", "each", "earn", "east",
+	"easy", "echo", "edge", "epic", "even", "exit", "face", "fact", "fair",
+	"fame", "farm", "fast", "fern", "file", "film", "fine", "fire", "firm",
+	"fish", "five", "flag", "flat", "flow", "folk", "food", "foot", "fork",
+	"form", "fort", "four", "free", "frog", "fuel", "full", "fund", "gain",
+	"game", "gate", "gear", "gift", "girl", "glad", "glow", "goal", "gold",
+	"golf", "good", "gram", "gray", "grid", "grow", "gulf", "half", "hall",
+	"hand", "hard", "harp", "hawk", "heat", "herb", "hero", "high", "hill",
+	"hint", "hive", "hold", "home", "hood", "hook", "hope", "horn", "host",
+	"hour", "huge", "hunt", "idea", "inch", "iron", "item", "jade", "jazz",
+	"join", "joke", "jump", "jury", "keen", "keep", "kind", "king", "kite",
+	"knot", "lake", "lamp", "land", "lane", "last", "lava", "lawn", "leaf",
+	"lean", "left", "lens", "lily", "line", "lion", "list", "live", "load",
+	"loan", "lock", "loft", "long", "loop", "lord", "love", "luck", "lush",
+	"mail", "main", "make", "malt", "many", "mark", "mask", "mast", "meal",
+	"mild", "milk", "mill", "mind", "mint", "mist", "mode", "moon", "moss",
+	"most", "move", "much", "mule", "nest", "news", "next", "nice", "nine",
+	"node", "noon", "nose", "note", "oak", "oath", "odd", "open", "oval",
+	"oven", "pace", "pack", "page", "palm", "park", "path", "peak", "pear",
+	"pine", "pink", "pipe", "plan", "play", "plum", "poem", "poet", "pond",
+	"pony", "pool", "port", "pure", "quiz", "race", "rain", "rank", "rare",
+	"reed", "reef", "rest", "rice", "rich", "ring", "road", "rock", "roof",
+	"room", "rope", "rose", "ruby", "rule", "safe", "sage", "sail", "salt",
+	"sand", "seal", "seed", "ship", "shoe", "shop", "silk", "sing", "site",
+	"size", "slow", "snow", "soft", "soil", "song", "soup", "star", "stem",
+	"step", "sure", "swan", "tail", "tale", "tall", "team", "tent", "tide",
+	"tile", "time", "tiny", "tone", "tree", "true", "tune", "unit", "vast",
+	"vine", "wave", "wide", "wild", "wind", "wing", "wise", "wolf", "wood",
+	"wool", "yard", "year", "zinc", "zone",
+}
+
+var aliasWordSet = func() map[string]struct{} {
+	set := make(map[string]struct{}, len(aliasWords))
+	for _, w := range aliasWords {
+		set[w] = struct{}{}
+	}
+	return set
+}()
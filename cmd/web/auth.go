@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookieName = "session"
+
+type UserStore interface {
+	CreateUser(ctx context.Context, email, passwordHash string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	UpsertOIDCUser(ctx context.Context, identity *OIDCIdentity) (*User, error)
+	CreateSession(ctx context.Context, tokenHash string, userID int64, expiresAt time.Time) error
+	GetSessionUser(ctx context.Context, tokenHash string) (*User, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+}
+
+func userOwner(id int64) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+func currentUser(c echo.Context) *User {
+	user, _ := c.Get("user").(*User)
+	return user
+}
+
+// LoadSession resolves the session cookie to a user. Requests without a valid
+// session simply stay anonymous.
+func (app *Application) LoadSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if app.Users == nil {
+			return next(c)
+		}
+		cookie, err := c.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" {
+			return next(c)
+		}
+
+		user, err := app.Users.GetSessionUser(c.Request().Context(), hashToken(cookie.Value))
+		if err != nil {
+			if !errors.Is(err, ErrRecordNotFound) {
+				return err
+			}
+			app.clearSessionCookie(c)
+			return next(c)
+		}
+
+		c.Set("user", user)
+		c.Set("owner", userOwner(user.ID))
+		return next(c)
+	}
+}
+
+// CSRF protects the server-rendered forms. The token is sent back in a hidden
+// "_csrf" form field.
+func (app *Application) CSRF() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "form:_csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSecure:   app.secureCookies(),
+		CookieSameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (app *Application) LoginForm(c echo.Context) error {
+	return c.Render(http.StatusOK, "login.html", app.pageData(c, nil))
+}
+
+func (app *Application) RegisterForm(c echo.Context) error {
+	return c.Render(http.StatusOK, "register.html", app.pageData(c, nil))
+}
+
+type credentials struct {
+	Email    string `form:"email" validate:"required,email,max=254"`
+	Password string `form:"password" validate:"required,min=8,max=72"`
+}
+
+func (app *Application) Register(c echo.Context) error {
+	var form credentials
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	form.Email = strings.ToLower(strings.TrimSpace(form.Email))
+
+	if err := c.Validate(form); err != nil {
+		return c.Render(http.StatusUnprocessableEntity, "register.html", app.pageData(c, map[string]any{
+			"error": err.Error(),
+			"email": form.Email,
+		}))
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	user, err := app.Users.CreateUser(c.Request().Context(), form.Email, string(hash))
+	if err != nil {
+		if errors.Is(err, ErrDuplicateEmail) {
+			return c.Render(http.StatusUnprocessableEntity, "register.html", app.pageData(c, map[string]any{
+				"error": "an account with this email already exists",
+				"email": form.Email,
+			}))
+		}
+		return err
+	}
+
+	if err := app.startSession(c, user); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func (app *Application) Login(c echo.Context) error {
+	var form credentials
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	form.Email = strings.ToLower(strings.TrimSpace(form.Email))
+
+	invalid := func() error {
+		return c.Render(http.StatusUnauthorized, "login.html", app.pageData(c, map[string]any{
+			"error": "invalid email or password",
+			"email": form.Email,
+		}))
+	}
+
+	user, err := app.Users.GetUserByEmail(c.Request().Context(), form.Email)
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			// Spend the same time as a real check so that response times do
+			// not reveal which accounts exist.
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(form.Password))
+			return invalid()
+		}
+		return err
+	}
+	if user.PasswordHash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(form.Password))
+		return invalid()
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(form.Password)); err != nil {
+		return invalid()
+	}
+
+	if err := app.startSession(c, user); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func (app *Application) Logout(c echo.Context) error {
+	if cookie, err := c.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		if err := app.Users.DeleteSession(c.Request().Context(), hashToken(cookie.Value)); err != nil {
+			return err
+		}
+	}
+	app.clearSessionCookie(c)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func (app *Application) startSession(c echo.Context, user *User) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := app.SessionTTL
+	if ttl == 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	expiresAt := time.Now().Add(ttl)
+	if err := app.Users.CreateSession(c.Request().Context(), hashToken(token), user.ID, expiresAt); err != nil {
+		return err
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   app.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (app *Application) clearSessionCookie(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   app.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (app *Application) secureCookies() bool {
+	return strings.HasPrefix(app.BaseURL, "https://")
+}
+
+// pageData returns the values every server-rendered page needs, merged with
+// the page specific ones.
+func (app *Application) pageData(c echo.Context, data map[string]any) map[string]any {
+	page := map[string]any{
+		"version": version,
+		"user":    currentUser(c),
+		"csrf":    c.Get(middleware.DefaultCSRFConfig.ContextKey),
+		"oidc":    app.OIDC != nil,
+	}
+	for k, v := range data {
+		page[k] = v
+	}
+	return page
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("read random: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the form in which secret tokens are stored, so that a
+// database leak does not leak usable sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
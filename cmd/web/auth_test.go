@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memoryUserStore struct {
+	mu         sync.Mutex
+	users      []*User
+	sessions   map[string]int64
+	identities map[string]int64
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{sessions: map[string]int64{}, identities: map[string]int64{}}
+}
+
+func (s *memoryUserStore) CreateUser(_ context.Context, email, passwordHash string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return nil, ErrDuplicateEmail
+		}
+	}
+	user := &User{ID: int64(len(s.users) + 1), Email: email, PasswordHash: passwordHash, Role: RoleUser, CreatedAt: time.Now()}
+	s.users = append(s.users, user)
+	return user, nil
+}
+
+func (s *memoryUserStore) GetUserByEmail(_ context.Context, email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryUserStore) UpsertOIDCUser(_ context.Context, identity *OIDCIdentity) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := identity.Issuer + " " + identity.Subject
+	if id, ok := s.identities[key]; ok {
+		user := s.users[id-1]
+		user.Email = identity.Email
+		user.Role = identity.Role
+		return user, nil
+	}
+	for _, u := range s.users {
+		if u.Email == identity.Email {
+			return nil, ErrDuplicateEmail
+		}
+	}
+	user := &User{ID: int64(len(s.users) + 1), Email: identity.Email, Role: identity.Role, CreatedAt: time.Now()}
+	s.users = append(s.users, user)
+	s.identities[key] = user.ID
+	return user, nil
+}
+
+func (s *memoryUserStore) CreateSession(_ context.Context, tokenHash string, userID int64, _ time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[tokenHash] = userID
+	return nil
+}
+
+func (s *memoryUserStore) GetSessionUser(_ context.Context, tokenHash string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.sessions[tokenHash]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return s.users[id-1], nil
+}
+
+func (s *memoryUserStore) DeleteSession(_ context.Context, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+var csrfInputPattern = regexp.MustCompile(`name="_csrf" value="([^"]+)"`)
+
+// newBrowser returns a client that keeps cookies and does not follow
+// redirects, like newClient does for the API tests.
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := newClient()
+	client.Jar = jar
+	return client
+}
+
+func getPage(t *testing.T, client *http.Client, u string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(u)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// submitForm loads the page at path to obtain a CSRF token and posts the
+// form values to action.
+func submitForm(t *testing.T, client *http.Client, baseURL, path, action string, values url.Values) *http.Response {
+	t.Helper()
+	_, body := getPage(t, client, baseURL+path)
+	m := csrfInputPattern.FindStringSubmatch(body)
+	require.NotNil(t, m, "csrf token not found on %s", path)
+	values.Set("_csrf", m[1])
+
+	resp, err := client.PostForm(baseURL+action, values)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, resp.Body.Close()) })
+	return resp
+}
+
+func newAuthTestServer(t *testing.T, links []Link) (*httptest.Server, *memoryUserStore) {
+	t.Helper()
+	users := newMemoryUserStore()
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Users:  users,
+		Repo: &mockRepo{
+			listLinksFn: func(_ context.Context, owner string, _ int) ([]Link, error) {
+				require.Equal(t, "user:1", owner)
+				return links, nil
+			},
+		},
+	}
+	server := httptest.NewTLSServer(app.Router())
+	app.BaseURL = server.URL
+	t.Cleanup(server.Close)
+	return server, users
+}
+
+func TestRegisterLoginLogout(t *testing.T) {
+	server, users := newAuthTestServer(t, []Link{{Alias: "abcdefghijk", OriginalURL: "https://example.com/mine"}})
+	client := newBrowser(t)
+
+	resp := submitForm(t, client, server.URL, "/register", "/register", url.Values{
+		"email":    {"User@Example.com"},
+		"password": {"correct horse"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Len(t, users.sessions, 1)
+	require.Equal(t, "user@example.com", users.users[0].Email)
+	require.NotEqual(t, "correct horse", users.users[0].PasswordHash)
+
+	var sessionCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			sessionCookie = c
+		}
+	}
+	require.NotNil(t, sessionCookie)
+	require.True(t, sessionCookie.HttpOnly)
+	require.True(t, sessionCookie.Secure)
+	require.Equal(t, http.SameSiteLaxMode, sessionCookie.SameSite)
+
+	status, body := getPage(t, client, server.URL+"/")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "user@example.com")
+	require.Contains(t, body, "https://example.com/mine")
+
+	resp = submitForm(t, client, server.URL, "/", "/logout", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Empty(t, users.sessions)
+
+	_, body = getPage(t, client, server.URL+"/")
+	require.NotContains(t, body, "user@example.com")
+
+	resp = submitForm(t, client, server.URL, "/login", "/login", url.Values{
+		"email":    {"user@example.com"},
+		"password": {"wrong password"},
+	})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = submitForm(t, client, server.URL, "/login", "/login", url.Values{
+		"email":    {"user@example.com"},
+		"password": {"correct horse"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Len(t, users.sessions, 1)
+}
+
+func TestRegisterValidation(t *testing.T) {
+	server, _ := newAuthTestServer(t, nil)
+	client := newBrowser(t)
+
+	resp := submitForm(t, client, server.URL, "/register", "/register", url.Values{
+		"email":    {"user@example.com"},
+		"password": {"short"},
+	})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = submitForm(t, client, server.URL, "/register", "/register", url.Values{
+		"email":    {"user@example.com"},
+		"password": {"long enough"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = submitForm(t, client, server.URL, "/register", "/register", url.Values{
+		"email":    {"user@example.com"},
+		"password": {"long enough"},
+	})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestLoginRequiresCSRFToken(t *testing.T) {
+	server, _ := newAuthTestServer(t, nil)
+	client := newBrowser(t)
+
+	resp, err := client.PostForm(server.URL+"/login", url.Values{
+		"email":    {"user@example.com"},
+		"password": {"long enough"},
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+type CanonicalizeOptions struct {
+	// StripTrackingParams makes URLs that only differ by tracking parameters
+	// share a link. It is off by default because the link keeps redirecting
+	// to the URL as it was first submitted, so the parameters of later
+	// submissions are lost.
+	StripTrackingParams bool
+	// TrackingParams lists the query parameters removed when
+	// StripTrackingParams is set. A trailing "*" matches by prefix.
+	TrackingParams []string
+}
+
+func DefaultCanonicalizeOptions() CanonicalizeOptions {
+	return CanonicalizeOptions{
+		TrackingParams: []string{
+			"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+			"mc_cid", "mc_eid", "igshid", "yclid", "_hsenc", "_hsmi",
+		},
+	}
+}
+
+// Canonicalize returns the form of rawURL that is used to detect duplicate
+// links. It lowercases the scheme and host, drops default ports, normalizes
+// percent-encoding and dot segments in the path and sorts the query
+// parameters. The fragment is kept as is.
+func Canonicalize(rawURL string, opts CanonicalizeOptions) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("parse url: %w", err)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	p := removeDotSegments(normalizePercentEncoding(u.EscapedPath()))
+	if p == "" {
+		p = "/"
+	}
+	decoded, err := url.PathUnescape(p)
+	if err != nil {
+		return "", fmt.Errorf("unescape path: %w", err)
+	}
+	u.Path = decoded
+	u.RawPath = p
+
+	u.RawQuery = canonicalQuery(u.RawQuery, opts)
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+func canonicalQuery(rawQuery string, opts CanonicalizeOptions) string {
+	var params []string
+	for param := range strings.SplitSeq(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		if opts.StripTrackingParams && isTrackingParam(queryKey(param), opts.TrackingParams) {
+			continue
+		}
+		params = append(params, normalizePercentEncoding(param))
+	}
+	slices.SortStableFunc(params, func(a, b string) int {
+		return strings.Compare(queryKey(a), queryKey(b))
+	})
+	return strings.Join(params, "&")
+}
+
+func queryKey(param string) string {
+	key, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		return unescaped
+	}
+	return key
+}
+
+func isTrackingParam(key string, trackingParams []string) bool {
+	key = strings.ToLower(key)
+	for _, p := range trackingParams {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePercentEncoding decodes percent-encoded unreserved characters and
+// uppercases the hex digits of all other escapes (RFC 3986, section 6.2.2).
+func normalizePercentEncoding(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+// removeDotSegments resolves "." and ".." path segments (RFC 3986, section
+// 5.2.4). Unlike path.Clean it keeps empty segments and trailing slashes.
+func removeDotSegments(p string) string {
+	var out []string
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isUnreserved(c byte) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"lowercase scheme and host", "HTTPS://Example.COM/Path", "https://example.com/Path"},
+		{"empty path", "https://example.com", "https://example.com/"},
+		{"default https port", "https://example.com:443/a", "https://example.com/a"},
+		{"default http port", "http://example.com:80/a", "http://example.com/a"},
+		{"non-default port", "https://example.com:8443/a", "https://example.com:8443/a"},
+		{"dot segments", "https://example.com/a/./b/../c/", "https://example.com/a/c/"},
+		{"keeps double slashes", "https://example.com/a//b", "https://example.com/a//b"},
+		{"unreserved escapes", "https://example.com/%7Euser/%2fx", "https://example.com/~user/%2Fx"},
+		{"sorted query", "https://example.com/?b=2&a=1&b=1", "https://example.com/?a=1&b=2&b=1"},
+		{"tracking params", "https://example.com/?utm_source=x&id=1", "https://example.com/?id=1&utm_source=x"},
+		{"empty query", "https://example.com/?", "https://example.com/"},
+		{"fragment", "https://example.com/#Section", "https://example.com/#Section"},
+		{"ipv6 host", "http://[::1]:80/", "http://[::1]/"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Canonicalize(tc.url, DefaultCanonicalizeOptions())
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCanonicalizeStripsTrackingParams(t *testing.T) {
+	opts := DefaultCanonicalizeOptions()
+	opts.StripTrackingParams = true
+	for u, want := range map[string]string{
+		"https://example.com/?utm_source=x&id=1&fbclid=y": "https://example.com/?id=1",
+		"https://example.com/?utm_source=x":               "https://example.com/",
+	} {
+		got, err := Canonicalize(u, opts)
+		require.NoError(t, err)
+		require.Equal(t, want, got, u)
+	}
+}
+
+func TestCanonicalizeSameDestination(t *testing.T) {
+	opts := DefaultCanonicalizeOptions()
+	opts.StripTrackingParams = true
+	urls := []string{
+		"HTTPS://Example.com/",
+		"https://example.com",
+		"https://example.com/?utm_source=x",
+		"https://example.com:443/./",
+	}
+	for _, u := range urls {
+		got, err := Canonicalize(u, opts)
+		require.NoError(t, err)
+		require.Equal(t, "https://example.com/", got, u)
+	}
+}
+
+func TestCanonicalizeInvalidURL(t *testing.T) {
+	_, err := Canonicalize("http://[::1", DefaultCanonicalizeOptions())
+	require.Error(t, err)
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const commandUsage = `  migrate up|down|redo|status
+  links create [-owner OWNER] [-alias ALIAS] [-redirect-status CODE] [-cache-control POLICY] URL
+  links get ALIAS
+  links delete ALIAS
+  links import [-owner OWNER] [-dry-run] FILE|-
+  links export [FILE]
+  keys create -user EMAIL -name NAME [-scope SCOPES] [-workspace ID] [-expires DURATION]
+  keys list -user EMAIL
+  keys revoke -user EMAIL ID
+  users set-role EMAIL admin|user
+  purge-expired
+`
+
+// CLI runs the operator subcommands. They share the global flags with the
+// server, so -dsn and the alias options apply to them as well.
+type CLI struct {
+	App  *Application
+	Repo *Repo
+	Out  io.Writer
+}
+
+type commandFunc func(cli *CLI, ctx context.Context, args []string) error
+
+// commands maps command and subcommand names to their implementation. Commands
+// without subcommands are stored under "".
+var commands = map[string]map[string]commandFunc{
+	"migrate": {
+		"up":     migrateCommand("up"),
+		"down":   migrateCommand("down"),
+		"redo":   migrateCommand("redo"),
+		"status": migrateCommand("status"),
+	},
+	"links": {
+		"create": (*CLI).linksCreate,
+		"get":    (*CLI).linksGet,
+		"delete": (*CLI).linksDelete,
+		"import": (*CLI).linksImport,
+		"export": (*CLI).linksExport,
+	},
+	"keys": {
+		"create": (*CLI).keysCreate,
+		"list":   (*CLI).keysList,
+		"revoke": (*CLI).keysRevoke,
+	},
+	"users": {
+		"set-role": (*CLI).usersSetRole,
+	},
+	"purge-expired": {
+		"": (*CLI).purgeExpired,
+	},
+}
+
+// lookupCommand resolves the command named by args and returns it with its
+// remaining arguments. It is called before connecting to the database so
+// that typos fail fast.
+func lookupCommand(args []string) (commandFunc, []string, error) {
+	subcommands, ok := commands[args[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", args[0])
+	}
+	if run, ok := subcommands[""]; ok {
+		return run, args[1:], nil
+	}
+	if len(args) > 1 {
+		if run, ok := subcommands[args[1]]; ok {
+			return run, args[2:], nil
+		}
+	}
+	names := slices.Sorted(maps.Keys(subcommands))
+	return nil, nil, fmt.Errorf("usage: %s %s", args[0], strings.Join(names, "|"))
+}
+
+func (cli *CLI) Run(ctx context.Context, args []string) error {
+	run, rest, err := lookupCommand(args)
+	if err != nil {
+		return err
+	}
+	return run(cli, ctx, rest)
+}
+
+func migrateCommand(command string) commandFunc {
+	return func(cli *CLI, _ context.Context, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("usage: migrate %s", command)
+		}
+		return RunMigrations(cli.Repo.DB, command)
+	}
+}
+
+func (cli *CLI) linksCreate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("links create", flag.ContinueOnError)
+	owner := fs.String("owner", "", "Owner of the link, such as user:42 (default anonymous)")
+	alias := fs.String("alias", "", "Alias to use instead of a generated one")
+	redirectStatus := fs.Int("redirect-status", DefaultRedirectStatus, "Status code of the redirect (301, 302, 303, 307 or 308)")
+	cacheControl := fs.String("cache-control", "", "Cache-Control header sent with the redirect")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: links create [-owner OWNER] [-alias ALIAS] [-redirect-status CODE] [-cache-control POLICY] URL")
+	}
+	link := &Link{
+		Owner:          *owner,
+		OriginalURL:    fs.Arg(0),
+		Alias:          *alias,
+		RedirectStatus: *redirectStatus,
+		CacheControl:   *cacheControl,
+	}
+	if err := validateLinkSettings(link); err != nil {
+		return err
+	}
+	if err := cli.checkOwner(ctx, link.Owner); err != nil {
+		return err
+	}
+
+	got, err := cli.App.createLink(ctx, link)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(cli.Out, "%s/r/%s\n", cli.App.BaseURL, got)
+	return err
+}
+
+func (cli *CLI) linksGet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: links get ALIAS")
+	}
+	link, err := cli.Repo.GetLinkByAlias(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	status := "active"
+	if !link.DisabledAt.IsZero() {
+		status = "disabled since " + link.DisabledAt.Format(time.RFC3339)
+	}
+	w := tabwriter.NewWriter(cli.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Alias:\t%s\n", link.Alias)
+	fmt.Fprintf(w, "Short URL:\t%s/r/%s\n", cli.App.BaseURL, link.Alias)
+	fmt.Fprintf(w, "Destination:\t%s\n", link.OriginalURL)
+	fmt.Fprintf(w, "Owner:\t%s\n", link.Owner)
+	fmt.Fprintf(w, "Clicks:\t%d\n", link.Clicks)
+	if link.MaxClicks > 0 {
+		fmt.Fprintf(w, "Click limit:\t%d\n", link.MaxClicks)
+	}
+	for _, v := range link.Variants {
+		fmt.Fprintf(w, "Variant %s:\t%s (weight %d, %d clicks)\n", v.Name, v.URL, v.Weight, link.VariantClicks[v.Name])
+	}
+	fmt.Fprintf(w, "Redirect status:\t%d\n", link.RedirectStatus)
+	fmt.Fprintf(w, "Cache-Control:\t%s\n", link.CachePolicy(cli.App.permanentRedirectMaxAge()))
+	fmt.Fprintf(w, "Status:\t%s\n", status)
+	if link.Broken() {
+		fmt.Fprintf(w, "Destination broken since:\t%s (last status %d)\n", link.Health.BrokenSince.Format(time.RFC3339), link.Health.Status)
+	}
+	if link.FallbackURL != "" {
+		fmt.Fprintf(w, "Fallback:\t%s\n", link.FallbackURL)
+	}
+	fmt.Fprintf(w, "Created:\t%s\n", link.CreatedAt.Format(time.RFC3339))
+	return w.Flush()
+}
+
+func (cli *CLI) linksDelete(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: links delete ALIAS")
+	}
+	link, err := cli.Repo.GetLinkByAlias(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return cli.Repo.DeleteLink(ctx, link.ID)
+}
+
+// exportColumns are the columns written by links export: every column of a
+// link but its ID, plus the clicks of its variants. links import reads back
+// the settings; clicks, metadata and health start over.
+var exportColumns = []string{
+	"alias", "original_url", "canonical_url", "owner", "redirect_status", "cache_control",
+	"passthrough", "query_conflict", "template", "rules", "variants", "ios_url", "android_url",
+	"active_from", "active_until", "before_active", "expired_url", "max_clicks", "one_time",
+	"preview_title", "preview_description", "preview_image", "fallback_url",
+	"clicks", "variant_clicks", "meta_title", "meta_description", "meta_favicon", "meta_canonical_url", "meta_fetched_at",
+	"health_status", "health_failures", "health_checked_at", "broken_since", "disabled_at", "created_at",
+}
+
+// validateLinkSettings checks the settings of a link given on the command
+// line or in an import file, which do not go through the API validation.
+func validateLinkSettings(link *Link) error {
+	if link.Alias != "" && !plausibleAlias(link.Alias) {
+		return fmt.Errorf("invalid alias %q", link.Alias)
+	}
+	if !validDestination(link.OriginalURL) {
+		return fmt.Errorf("original_url %w", ErrInvalidURL)
+	}
+	if !validRedirectStatus(link.RedirectStatus) {
+		return fmt.Errorf("invalid redirect status %d", link.RedirectStatus)
+	}
+	if !validCacheControl(link.CacheControl) {
+		return ErrInvalidCacheControl
+	}
+	if !slices.Contains([]string{"", QueryOverride, QueryKeep, QueryAppend}, link.QueryConflict) {
+		return fmt.Errorf("invalid query conflict %q", link.QueryConflict)
+	}
+	if link.Template && !validTemplate(link.OriginalURL) {
+		return ErrNoPlaceholders
+	}
+	if err := validateRules(link.Rules); err != nil {
+		return err
+	}
+	if err := validateVariants(link.Variants); err != nil {
+		return err
+	}
+	if !validAppURL(link.IOSURL) || !validAppURL(link.AndroidURL) {
+		return ErrInvalidAppURL
+	}
+	if !link.ActiveFrom.IsZero() && !link.ActiveUntil.IsZero() && !link.ActiveUntil.After(link.ActiveFrom) {
+		return ErrInvalidActiveWindow
+	}
+	if !slices.Contains([]string{"", BeforeActiveNotFound, BeforeActiveComingSoon}, link.BeforeActive) {
+		return fmt.Errorf("invalid before_active %q", link.BeforeActive)
+	}
+	for name, u := range map[string]string{"expired_url": link.ExpiredURL, "fallback_url": link.FallbackURL, "preview_image": link.Preview.Image} {
+		if u != "" && !validDestination(u) {
+			return fmt.Errorf("%s %w", name, ErrInvalidURL)
+		}
+	}
+	if link.MaxClicks < 0 {
+		return ErrInvalidMaxClicks
+	}
+	if link.OneTime && link.MaxClicks != 1 {
+		return ErrInvalidOneTime
+	}
+	return nil
+}
+
+// checkOwner returns an error unless owner is anonymous or names an existing
+// user or workspace.
+func (cli *CLI) checkOwner(ctx context.Context, owner string) error {
+	exists, err := cli.Repo.OwnerExists(ctx, owner)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("owner %q does not exist", owner)
+	}
+	return nil
+}
+
+// importRow is a link read from an import file, with the line it was read
+// from.
+type importRow struct {
+	line     int
+	link     *Link
+	disabled bool
+}
+
+// linksImport reads links from a CSV file with a header row, such as one
+// written by links export. Only the original_url column is required; rows
+// without an alias get a generated one. Every row is checked before anything
+// is imported, and nothing is when a row is invalid. Rows that still fail to
+// be stored are reported once the others are imported.
+func (cli *CLI) linksImport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("links import", flag.ContinueOnError)
+	owner := fs.String("owner", "", "Owner of links whose row has no owner")
+	dryRun := fs.Bool("dry-run", false, "Check the file and report invalid rows without importing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: links import [-owner OWNER] [-dry-run] FILE|-")
+	}
+	if err := cli.checkOwner(ctx, *owner); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		in = f
+	}
+
+	r := csv.NewReader(in)
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	if !slices.Contains(header, "original_url") {
+		return errors.New("missing original_url column")
+	}
+	r.FieldsPerRecord = len(header)
+
+	var rows []importRow
+	var failures []string
+	owners := map[string]error{*owner: nil}
+	aliases := map[string]int{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		row, err := cli.parseImportRow(ctx, header, record, *owner, owners)
+		if err == nil && row.link.Alias != "" {
+			if first, ok := aliases[row.link.Alias]; ok {
+				err = fmt.Errorf("alias %q is already used on line %d", row.link.Alias, first)
+			} else {
+				aliases[row.link.Alias] = line
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		row.line = line
+		rows = append(rows, row)
+	}
+
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Fprintln(cli.Out, failure)
+		}
+		return fmt.Errorf("%d of %d rows are invalid, nothing was imported", len(failures), len(failures)+len(rows))
+	}
+	if *dryRun {
+		_, err = fmt.Fprintf(cli.Out, "%d links would be imported\n", len(rows))
+		return err
+	}
+
+	imported := 0
+	for _, row := range rows {
+		if err := cli.importLink(ctx, row); err != nil {
+			failures = append(failures, fmt.Sprintf("line %d: %v", row.line, err))
+			continue
+		}
+		imported++
+	}
+	for _, failure := range failures {
+		fmt.Fprintln(cli.Out, failure)
+	}
+	fmt.Fprintf(cli.Out, "imported %d links\n", imported)
+	if len(failures) > 0 {
+		return fmt.Errorf("%d rows failed to import", len(failures))
+	}
+	return nil
+}
+
+// parseImportRow reads the link in record and checks it the way the API
+// would. owners caches the result of checking the owners already seen.
+func (cli *CLI) parseImportRow(ctx context.Context, header, record []string, defaultOwner string, owners map[string]error) (importRow, error) {
+	var err error
+	field := func(name string) string {
+		if i := slices.Index(header, name); i >= 0 {
+			return record[i]
+		}
+		return ""
+	}
+	integer := func(name string, fallback int) int {
+		s := field(name)
+		if s == "" || err != nil {
+			return fallback
+		}
+		n, parseErr := strconv.Atoi(s)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid %s %q", name, s)
+		}
+		return n
+	}
+	boolean := func(name string) bool {
+		s := field(name)
+		if s == "" || err != nil {
+			return false
+		}
+		b, parseErr := strconv.ParseBool(s)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid %s %q", name, s)
+		}
+		return b
+	}
+	timestamp := func(name string) time.Time {
+		s := field(name)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		t, parseErr := time.Parse(time.RFC3339Nano, s)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid %s %q", name, s)
+		}
+		return t
+	}
+	list := func(name string, v any) {
+		s := field(name)
+		if s == "" || err != nil {
+			return
+		}
+		if jsonErr := json.Unmarshal([]byte(s), v); jsonErr != nil {
+			err = fmt.Errorf("invalid %s: %w", name, jsonErr)
+		}
+	}
+
+	link := &Link{
+		Owner:          cmp.Or(field("owner"), defaultOwner),
+		OriginalURL:    field("original_url"),
+		Alias:          field("alias"),
+		RedirectStatus: integer("redirect_status", DefaultRedirectStatus),
+		CacheControl:   field("cache_control"),
+		Passthrough:    boolean("passthrough"),
+		QueryConflict:  field("query_conflict"),
+		Template:       boolean("template"),
+		IOSURL:         field("ios_url"),
+		AndroidURL:     field("android_url"),
+		ActiveFrom:     timestamp("active_from"),
+		ActiveUntil:    timestamp("active_until"),
+		BeforeActive:   field("before_active"),
+		ExpiredURL:     field("expired_url"),
+		MaxClicks:      integer("max_clicks", 0),
+		OneTime:        boolean("one_time"),
+		Preview: LinkPreview{
+			Title:       field("preview_title"),
+			Description: field("preview_description"),
+			Image:       field("preview_image"),
+		},
+		FallbackURL: field("fallback_url"),
+	}
+	list("rules", &link.Rules)
+	list("variants", &link.Variants)
+	disabled := !timestamp("disabled_at").IsZero()
+	if err != nil {
+		return importRow{}, err
+	}
+	if err := validateLinkSettings(link); err != nil {
+		return importRow{}, err
+	}
+
+	ownerErr, ok := owners[link.Owner]
+	if !ok {
+		ownerErr = cli.checkOwner(ctx, link.Owner)
+		owners[link.Owner] = ownerErr
+	}
+	if ownerErr != nil {
+		return importRow{}, ownerErr
+	}
+
+	if link.Alias != "" {
+		existing, err := cli.Repo.GetLinkByAlias(ctx, link.Alias)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return importRow{}, err
+		}
+		if existing != nil && (existing.Owner != link.Owner || existing.OriginalURL != link.OriginalURL) {
+			return importRow{}, fmt.Errorf("alias %q is taken by another link", link.Alias)
+		}
+	}
+	return importRow{link: link, disabled: disabled}, nil
+}
+
+// importLink stores the link of row, disabling it again if it was disabled
+// when it was exported.
+func (cli *CLI) importLink(ctx context.Context, row importRow) error {
+	alias, err := cli.App.createLink(ctx, row.link)
+	if err != nil || !row.disabled {
+		return err
+	}
+	link, err := cli.Repo.GetLinkByAlias(ctx, alias)
+	if err != nil {
+		return err
+	}
+	return cli.Repo.SetLinkDisabled(ctx, link.ID, true)
+}
+
+func (cli *CLI) linksExport(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: links export [FILE]")
+	}
+
+	out := cli.Out
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+
+	w := csv.NewWriter(out)
+	if err := w.Write(exportColumns); err != nil {
+		return err
+	}
+	err := cli.Repo.EachLink(ctx, func(link Link) error {
+		record, err := exportRecord(&link)
+		if err != nil {
+			return err
+		}
+		return w.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// exportRecord returns the fields of link in the order of exportColumns.
+func exportRecord(link *Link) ([]string, error) {
+	rules, err := encodeJSONList(link.Rules)
+	if err != nil {
+		return nil, err
+	}
+	variants, err := encodeJSONList(link.Variants)
+	if err != nil {
+		return nil, err
+	}
+	clicks := link.VariantClicks
+	if clicks == nil {
+		clicks = map[string]int64{}
+	}
+	variantClicks, err := json.Marshal(clicks)
+	if err != nil {
+		return nil, fmt.Errorf("encode variant clicks: %w", err)
+	}
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	var maxClicks, healthStatus string
+	if link.MaxClicks > 0 {
+		maxClicks = strconv.Itoa(link.MaxClicks)
+	}
+	if link.Health.Status > 0 {
+		healthStatus = strconv.Itoa(link.Health.Status)
+	}
+	return []string{
+		link.Alias,
+		link.OriginalURL,
+		link.CanonicalURL,
+		link.Owner,
+		strconv.Itoa(link.RedirectStatus),
+		link.CacheControl,
+		strconv.FormatBool(link.Passthrough),
+		link.QueryConflict,
+		strconv.FormatBool(link.Template),
+		rules,
+		variants,
+		link.IOSURL,
+		link.AndroidURL,
+		timestamp(link.ActiveFrom),
+		timestamp(link.ActiveUntil),
+		link.BeforeActive,
+		link.ExpiredURL,
+		maxClicks,
+		strconv.FormatBool(link.OneTime),
+		link.Preview.Title,
+		link.Preview.Description,
+		link.Preview.Image,
+		link.FallbackURL,
+		strconv.FormatInt(link.Clicks, 10),
+		string(variantClicks),
+		link.Metadata.Title,
+		link.Metadata.Description,
+		link.Metadata.Favicon,
+		link.Metadata.CanonicalURL,
+		timestamp(link.Metadata.FetchedAt),
+		healthStatus,
+		strconv.Itoa(link.Health.Failures),
+		timestamp(link.Health.CheckedAt),
+		timestamp(link.Health.BrokenSince),
+		timestamp(link.DisabledAt),
+		timestamp(link.CreatedAt),
+	}, nil
+}
+
+func (cli *CLI) keysCreate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	email := fs.String("user", "", "Email of the user the key acts as")
+	name := fs.String("name", "", "Name of the key")
+	scopes := fs.String("scope", ScopeLinksWrite, "Comma separated scopes ("+strings.Join(tokenScopes, ", ")+")")
+	workspace := fs.Int64("workspace", 0, "Workspace the key acts on (default the user's own links)")
+	expires := fs.Duration("expires", 0, "Lifetime of the key (default never expires)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || *name == "" || fs.NArg() != 0 {
+		return errors.New("usage: keys create -user EMAIL -name NAME [-scope SCOPES] [-workspace ID] [-expires DURATION]")
+	}
+
+	token := &APIToken{
+		WorkspaceID: *workspace,
+		Name:        *name,
+		Kind:        TokenKindKey,
+	}
+	for _, scope := range strings.Split(*scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if !slices.Contains(tokenScopes, scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+		token.Scopes = append(token.Scopes, scope)
+	}
+	token.Scopes = slices.Compact(slices.Sorted(slices.Values(token.Scopes)))
+	if *expires < 0 {
+		return errors.New("expires must not be negative")
+	}
+	if *expires > 0 {
+		token.ExpiresAt = time.Now().Add(*expires).Truncate(time.Second)
+	}
+
+	user, err := cli.Repo.GetUserByEmail(ctx, *email)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	token.UserID = user.ID
+	if token.WorkspaceID != 0 {
+		if _, err := cli.Repo.GetMembership(ctx, token.WorkspaceID, user.ID); err != nil {
+			return fmt.Errorf("get workspace membership: %w", err)
+		}
+	}
+
+	secret, secretHash, err := newAPIKeySecret()
+	if err != nil {
+		return err
+	}
+	if err := cli.Repo.CreateAPIToken(ctx, token, secretHash); err != nil {
+		return err
+	}
+	// The secret is only ever shown once.
+	_, err = fmt.Fprintln(cli.Out, secret)
+	return err
+}
+
+func (cli *CLI) keysList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+	email := fs.String("user", "", "Email of the user whose keys are listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || fs.NArg() != 0 {
+		return errors.New("usage: keys list -user EMAIL")
+	}
+
+	user, err := cli.Repo.GetUserByEmail(ctx, *email)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	tokens, err := cli.Repo.ListAPITokens(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cli.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tKIND\tSCOPES\tOWNER\tEXPIRES")
+	for _, t := range tokens {
+		expires := "never"
+		if !t.ExpiresAt.IsZero() {
+			expires = t.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Kind, strings.Join(t.Scopes, ","), t.Owner(), expires)
+	}
+	return w.Flush()
+}
+
+func (cli *CLI) keysRevoke(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("keys revoke", flag.ContinueOnError)
+	email := fs.String("user", "", "Email of the user who owns the key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	usage := errors.New("usage: keys revoke -user EMAIL ID")
+	if *email == "" || fs.NArg() != 1 {
+		return usage
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return usage
+	}
+
+	user, err := cli.Repo.GetUserByEmail(ctx, *email)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	return cli.Repo.RevokeAPIToken(ctx, user.ID, id)
+}
+
+// usersSetRole changes the role of a user, which is how the first admin is
+// made without an OIDC provider. The role of OIDC users is overwritten by
+// their next sign-in.
+func (cli *CLI) usersSetRole(ctx context.Context, args []string) error {
+	if len(args) != 2 || (args[1] != RoleAdmin && args[1] != RoleUser) {
+		return errors.New("usage: users set-role EMAIL admin|user")
+	}
+	if err := cli.Repo.SetUserRole(ctx, args[0], args[1]); err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return fmt.Errorf("no user with email %q", args[0])
+		}
+		return err
+	}
+	_, err := fmt.Fprintf(cli.Out, "%s is now %s\n", args[0], args[1])
+	return err
+}
+
+func (cli *CLI) purgeExpired(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: purge-expired")
+	}
+
+	purged, err := cli.Repo.PurgeExpired(ctx)
+	if err != nil {
+		return err
+	}
+	for _, table := range expiringTables {
+		fmt.Fprintf(cli.Out, "%s: %d\n", table, purged[table])
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cli.App.RateLimitPolicies)) {
+		store := NewPgRateLimitStore(cli.Repo.DB, name, cli.App.RateLimitPolicies[name], 0, cli.App.Logger)
+		if err := store.cleanup(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
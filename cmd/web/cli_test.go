@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupCommand(t *testing.T) {
+	_, rest, err := lookupCommand([]string{"links", "create", "-owner", "user:1", "https://example.com"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-owner", "user:1", "https://example.com"}, rest)
+
+	_, rest, err = lookupCommand([]string{"purge-expired"})
+	require.NoError(t, err)
+	require.Empty(t, rest)
+
+	_, _, err = lookupCommand([]string{"serve"})
+	require.EqualError(t, err, `unknown command "serve"`)
+
+	_, _, err = lookupCommand([]string{"migrate"})
+	require.EqualError(t, err, "usage: migrate down|redo|status|up")
+
+	_, _, err = lookupCommand([]string{"keys", "rotate"})
+	require.EqualError(t, err, "usage: keys create|list|revoke")
+
+	_, rest, err = lookupCommand([]string{"users", "set-role", "alice@example.com", "admin"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice@example.com", "admin"}, rest)
+}
+
+func TestUsersSetRoleUsage(t *testing.T) {
+	cli := &CLI{}
+	for _, args := range [][]string{
+		{"users", "set-role", "alice@example.com"},
+		{"users", "set-role", "alice@example.com", "root"},
+		{"users", "set-role", "alice@example.com", "admin", "extra"},
+	} {
+		require.EqualError(t, cli.Run(t.Context(), args), "usage: users set-role EMAIL admin|user", args)
+	}
+}
+
+func TestExportRecordMatchesColumns(t *testing.T) {
+	record, err := exportRecord(&Link{Alias: "abc", OriginalURL: "https://example.com/", RedirectStatus: DefaultRedirectStatus})
+	require.NoError(t, err)
+	require.Len(t, record, len(exportColumns))
+	require.Equal(t, "[]", record[slices.Index(exportColumns, "rules")])
+	require.Equal(t, "{}", record[slices.Index(exportColumns, "variant_clicks")])
+}
+
+func TestValidateLinkSettings(t *testing.T) {
+	valid := Link{OriginalURL: "https://example.com/", RedirectStatus: DefaultRedirectStatus}
+	require.NoError(t, validateLinkSettings(&valid))
+
+	for name, change := range map[string]func(*Link){
+		"alias":         func(l *Link) { l.Alias = "not an alias" },
+		"destination":   func(l *Link) { l.OriginalURL = "javascript:alert(1)" },
+		"status":        func(l *Link) { l.RedirectStatus = 200 },
+		"query":         func(l *Link) { l.QueryConflict = "merge" },
+		"before active": func(l *Link) { l.BeforeActive = "soon" },
+		"fallback":      func(l *Link) { l.FallbackURL = "ftp://example.com/" },
+		"one time":      func(l *Link) { l.OneTime = true },
+		"template":      func(l *Link) { l.Template = true },
+		"window": func(l *Link) {
+			l.ActiveFrom = time.Now()
+			l.ActiveUntil = l.ActiveFrom.Add(-time.Hour)
+		},
+	} {
+		link := valid
+		change(&link)
+		require.Error(t, validateLinkSettings(&link), name)
+	}
+}
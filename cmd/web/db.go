@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -12,25 +14,135 @@ import (
 )
 
 func OpenDB(dsn string) (*sql.DB, error) {
+	return ConnectDB(dsn, DBRetryConfig{}, nil)
+}
+
+// DBRetryConfig controls how long ConnectDB keeps trying to reach a database
+// that is not up yet. The zero value makes a single attempt.
+type DBRetryConfig struct {
+	// Deadline bounds the time spent on all attempts.
+	Deadline       time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// retryDelay returns the jittered wait before the next attempt. The delay
+// doubles with every attempt up to MaxBackoff and is then randomized to
+// between half and all of it, so that replicas do not retry in lockstep.
+func (cfg DBRetryConfig) retryDelay(attempt int) time.Duration {
+	backoff := cfg.InitialBackoff
+	for i := 1; i < attempt && backoff < cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, cfg.MaxBackoff)
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// ConnectDB opens the database and pings it until it answers or the retry
+// deadline passes, logging every failed attempt.
+func ConnectDB(dsn string, retry DBRetryConfig, logger *slog.Logger) (*sql.DB, error) {
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("sql open: %w", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), max(retry.Deadline, 5*time.Second))
 	defer cancel()
-	if err := db.PingContext(ctx); err != nil {
-		return nil, fmt.Errorf("ping database: %w", err)
+	for attempt := 1; ; attempt++ {
+		pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+		err = db.PingContext(pingCtx)
+		pingCancel()
+		if err == nil {
+			return db, nil
+		}
+		if retry.Deadline <= 0 {
+			break
+		}
+
+		delay := retry.retryDelay(attempt)
+		if deadline, _ := ctx.Deadline(); time.Now().Add(delay).After(deadline) {
+			break
+		}
+		logger.Warn("database is not reachable, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+		time.Sleep(delay)
 	}
-	return db, nil
+
+	_ = db.Close()
+	return nil, fmt.Errorf("ping database: %w", err)
 }
 
+// migrationLockID is the key of the Postgres advisory lock held while
+// migrations run, so that replicas starting together migrate one at a time.
+const migrationLockID int64 = 0x75726c73686f7274
+
 func Migrate(db *sql.DB) error {
+	return RunMigrations(db, "up")
+}
+
+// RunMigrations runs a goose command such as up, down, redo or status against
+// the embedded migrations while holding the migration lock.
+func RunMigrations(db *sql.DB, command string) (err error) {
+	if err := setupGoose(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Session level advisory locks belong to the connection, which is kept
+	// until the migrations are done. Waiting is fine: another replica is
+	// applying the same migrations.
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrationLockID); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		if _, unlockErr := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, migrationLockID); unlockErr != nil && err == nil {
+			err = fmt.Errorf("release migration lock: %w", unlockErr)
+		}
+	}()
+
+	if err := goose.RunContext(ctx, command, db, "."); err != nil {
+		return fmt.Errorf("goose %s: %w", command, err)
+	}
+	return nil
+}
+
+// CheckSchemaVersion returns an error unless the database schema is at the
+// version of the newest embedded migration.
+func CheckSchemaVersion(db *sql.DB) error {
+	if err := setupGoose(); err != nil {
+		return err
+	}
+	available, err := goose.CollectMigrations(".", 0, goose.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("collect migrations: %w", err)
+	}
+	last, err := available.Last()
+	if err != nil {
+		return fmt.Errorf("find latest migration: %w", err)
+	}
+	current, err := goose.GetDBVersion(db)
+	if err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+
+	switch {
+	case current < last.Version:
+		return fmt.Errorf("database schema version %d is older than %d; run the migrations first", current, last.Version)
+	case current > last.Version:
+		return fmt.Errorf("database schema version %d is newer than %d; this binary is out of date", current, last.Version)
+	}
+	return nil
+}
+
+func setupGoose() error {
 	goose.SetBaseFS(migrations.FS)
 	if err := goose.SetDialect("postgres"); err != nil {
 		return fmt.Errorf("set dialect: %w", err)
 	}
-	if err := goose.Up(db, "."); err != nil {
-		return fmt.Errorf("goose up: %w", err)
-	}
 	return nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Platforms that links can open an app on.
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+)
+
+// ErrInvalidAppURL is returned for app URLs that cannot be opened safely.
+var ErrInvalidAppURL = errors.New("app urls must be absolute and cannot use the javascript, data, vbscript or file schemes")
+
+// Platform returns the mobile platform a User-Agent header belongs to, or
+// "" for anything else.
+func Platform(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "iPod"):
+		return PlatformIOS
+	case strings.Contains(userAgent, "Android"):
+		return PlatformAndroid
+	}
+	return ""
+}
+
+// validAppURL reports whether s can be used as an app URL: a custom scheme
+// such as myapp://item/1, an Android intent:// URL or a universal link.
+func validAppURL(s string) bool {
+	if s == "" {
+		return true
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || len(s) > 500 {
+		return false
+	}
+	switch u.Scheme {
+	case "javascript", "data", "vbscript", "file":
+		return false
+	}
+	return true
+}
+
+// AppURL returns the URL that opens the link in the app for platform, or ""
+// when the link has none.
+func (l *Link) AppURL(platform string) string {
+	switch platform {
+	case PlatformIOS:
+		return l.IOSURL
+	case PlatformAndroid:
+		return l.AndroidURL
+	}
+	return ""
+}
+
+// openApp sends the client to appURL. Web URLs and Android intents, which
+// carry their own fallback, are redirected to. Browsers fail on custom
+// schemes of apps that are not installed, so for those an interstitial page
+// tries the app and then falls back to destination.
+func (app *Application) openApp(c echo.Context, status int, appURL, destination string) error {
+	u, err := url.Parse(appURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "intent" {
+		return c.Redirect(status, appURL)
+	}
+	return c.Render(http.StatusOK, "deeplink.html", map[string]any{
+		// The scheme was checked by validAppURL when the link was saved.
+		"appURL":   template.URL(appURL),
+		"fallback": destination,
+	})
+}
+
+// AppLinks configures the association files that let apps open the short
+// URLs of Domain themselves.
+type AppLinks struct {
+	// Domain restricts the files to requests for this host. Empty serves
+	// them on any host.
+	Domain string
+	// IOSAppIDs are the TEAMID.bundle.id identifiers of iOS apps.
+	IOSAppIDs []string
+	// AndroidApps maps Android package names to the SHA-256 fingerprints of
+	// their signing certificates.
+	AndroidApps map[string][]string
+}
+
+// ParseAndroidApps parses package:fingerprint,... pairs. A package can be
+// listed several times for apps signed with more than one certificate.
+func ParseAndroidApps(s string) (map[string][]string, error) {
+	apps := map[string][]string{}
+	for pair := range strings.SplitSeq(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		// Fingerprints are colon separated hex, package names have no colons.
+		name, fingerprint, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || fingerprint == "" {
+			return nil, errors.New("android apps must be package:sha256-fingerprint pairs")
+		}
+		apps[name] = append(apps[name], strings.ToUpper(fingerprint))
+	}
+	return apps, nil
+}
+
+func (app *Application) appLinksFor(c echo.Context) bool {
+	if app.AppLinks.Domain == "" {
+		return true
+	}
+	host := c.Request().Host
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	return strings.EqualFold(host, app.AppLinks.Domain)
+}
+
+// AppleAppSiteAssociation serves the file that lets iOS apps handle short
+// URLs as universal links.
+func (app *Application) AppleAppSiteAssociation(c echo.Context) error {
+	if len(app.AppLinks.IOSAppIDs) == 0 || !app.appLinksFor(c) {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"applinks": map[string]any{
+			"details": []map[string]any{{
+				"appIDs":     app.AppLinks.IOSAppIDs,
+				"components": []map[string]string{{"/": "/r/*"}},
+			}},
+		},
+	})
+}
+
+// AssetLinks serves the Digital Asset Links file that lets Android apps
+// handle short URLs as verified app links.
+func (app *Application) AssetLinks(c echo.Context) error {
+	if len(app.AppLinks.AndroidApps) == 0 || !app.appLinksFor(c) {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+	statements := []map[string]any{}
+	for name, fingerprints := range app.AppLinks.AndroidApps {
+		statements = append(statements, map[string]any{
+			"relation": []string{"delegate_permission/common.handle_all_urls"},
+			"target": map[string]any{
+				"namespace":                "android_app",
+				"package_name":             name,
+				"sha256_cert_fingerprints": fingerprints,
+			},
+		})
+	}
+	return c.JSON(http.StatusOK, statements)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	iphoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148"
+	androidUserAgent = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Mobile Safari/537.36"
+)
+
+func TestPlatform(t *testing.T) {
+	require.Equal(t, PlatformIOS, Platform(iphoneUserAgent))
+	require.Equal(t, PlatformAndroid, Platform(androidUserAgent))
+	require.Equal(t, "", Platform("Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"))
+}
+
+func TestValidAppURL(t *testing.T) {
+	for _, s := range []string{"", "myapp://item/42", "intent://item/42#Intent;scheme=myapp;package=com.example.app;end", "https://example.com/item/42"} {
+		require.True(t, validAppURL(s), s)
+	}
+	for _, s := range []string{"item/42", "javascript:alert(1)", "JavaScript:alert(1)", "data:text/html,hi", "file:///etc/passwd"} {
+		require.False(t, validAppURL(s), s)
+	}
+}
+
+func TestParseAndroidApps(t *testing.T) {
+	apps, err := ParseAndroidApps("com.example.app:14:6d:e9:83, com.example.app:aa:bb")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"com.example.app": {"14:6D:E9:83", "AA:BB"}}, apps)
+
+	_, err = ParseAndroidApps("com.example.app")
+	require.Error(t, err)
+}
+
+func TestRedirectDeepLink(t *testing.T) {
+	link := &Link{
+		OriginalURL: "https://example.com/item/42",
+		IOSURL:      "myapp://item/42",
+		AndroidURL:  "intent://item/42#Intent;scheme=myapp;package=com.example.app;end",
+	}
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				return link, nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+	client := newClient()
+
+	get := func(userAgent string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/r/abcdefghijk", nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get(iphoneUserAgent)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	require.Contains(t, body, `href="myapp://item/42"`)
+	require.Contains(t, body, `href="https://example.com/item/42"`)
+
+	resp, _ = get(androidUserAgent)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, link.AndroidURL, resp.Header.Get("Location"))
+
+	resp, _ = get("curl/8.8.0")
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, link.OriginalURL, resp.Header.Get("Location"))
+}
+
+func TestWellKnownAppLinks(t *testing.T) {
+	app := &Application{Logger: slog.New(slog.DiscardHandler)}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/.well-known/apple-app-site-association")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	app.AppLinks = AppLinks{
+		Domain:      "127.0.0.1",
+		IOSAppIDs:   []string{"ABCDE12345.com.example.app"},
+		AndroidApps: map[string][]string{"com.example.app": {"14:6D:E9:83"}},
+	}
+
+	resp, err = http.Get(server.URL + "/.well-known/apple-app-site-association")
+	require.NoError(t, err)
+	var aasa struct {
+		AppLinks struct {
+			Details []struct {
+				AppIDs []string `json:"appIDs"`
+			} `json:"details"`
+		} `json:"applinks"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&aasa))
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, []string{"ABCDE12345.com.example.app"}, aasa.AppLinks.Details[0].AppIDs)
+
+	resp, err = http.Get(server.URL + "/.well-known/assetlinks.json")
+	require.NoError(t, err)
+	var statements []struct {
+		Target struct {
+			PackageName  string   `json:"package_name"`
+			Fingerprints []string `json:"sha256_cert_fingerprints"`
+		} `json:"target"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&statements))
+	require.NoError(t, resp.Body.Close())
+	require.Len(t, statements, 1)
+	require.Equal(t, "com.example.app", statements[0].Target.PackageName)
+	require.Equal(t, []string{"14:6D:E9:83"}, statements[0].Target.Fingerprints)
+
+	app.AppLinks.Domain = "sho.rt"
+	resp, err = http.Get(server.URL + "/.well-known/assetlinks.json")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -11,8 +12,11 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/require"
@@ -49,7 +53,7 @@ func createTestDB(t *testing.T, dbName string) string {
 	return parsedURL.String()
 }
 
-func newTestApp(t *testing.T) *Application {
+func newTestDB(t *testing.T) *sql.DB {
 	t.Helper()
 	dbName := randomDBName()
 	dsn := createTestDB(t, dbName)
@@ -57,12 +61,26 @@ func newTestApp(t *testing.T) *Application {
 	require.NoError(t, err)
 	err = Migrate(db)
 	require.NoError(t, err)
+	return db
+}
+
+func newTestApp(t *testing.T) *Application {
+	t.Helper()
+	db := newTestDB(t)
 
+	repo := &Repo{
+		DB: db,
+	}
 	app := &Application{
-		Repo: &Repo{
-			DB: db,
-		},
-		Logger: slog.New(slog.DiscardHandler),
+		DB:           db,
+		Repo:         repo,
+		Idempotency:  repo,
+		Users:        repo,
+		Workspaces:   repo,
+		Tokens:       repo,
+		Moderation:   repo,
+		Canonicalize: DefaultCanonicalizeOptions(),
+		Logger:       slog.New(slog.DiscardHandler),
 	}
 
 	server := httptest.NewTLSServer(app.Router())
@@ -307,3 +325,752 @@ func TestWebIndex(t *testing.T) {
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 	require.Equal(t, "text/html; charset=UTF-8", resp.Header.Get(echo.HeaderContentType))
 }
+
+func TestAPIWithIdempotencyKey(t *testing.T) {
+	app := newTestApp(t)
+
+	client := newClient()
+
+	post := func(key, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, app.BaseURL+"/api/shorten", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(HeaderIdempotencyKey, key)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, resp.Body.Close()) })
+		return resp
+	}
+
+	resp := post("job-1", `{"url":"https://example.com/idempotent"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+	resp = post("job-1", `{"url":"https://example.com/idempotent"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	resp = post("job-1", `{"url":"https://example.com/other"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestAPIDeduplicatesCanonicalURLs(t *testing.T) {
+	app := newTestApp(t)
+
+	client := newClient()
+
+	var aliases []string
+	for _, u := range []string{"HTTPS://Example.com/", "https://example.com", "https://example.com/?utm_source=x"} {
+		resp, err := client.Post(app.BaseURL+"/api/shorten", echo.MIMEApplicationJSON, bytes.NewBufferString(fmt.Sprintf(`{"url":"%s"}`, u)))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var response struct {
+			Alias string `json:"alias"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		aliases = append(aliases, response.Alias)
+	}
+
+	require.Equal(t, aliases[0], aliases[1])
+	// Tracking parameters are only ignored with -strip-tracking-params.
+	require.NotEqual(t, aliases[0], aliases[2])
+
+	// The redirect goes to the URL as it was first submitted.
+	resp, err := client.Get(app.BaseURL + "/r/" + aliases[0])
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+	require.Equal(t, "HTTPS://Example.com/", resp.Header.Get("Location"))
+}
+
+func TestRepoInsertScopesDeduplicationToOwner(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	insert := func(owner, alias string) string {
+		got, err := repo.Insert(ctx, &Link{
+			Owner:        owner,
+			OriginalURL:  "https://example.com",
+			CanonicalURL: "https://example.com/",
+			Alias:        alias,
+		})
+		require.NoError(t, err)
+		return got
+	}
+
+	require.Equal(t, "anonymous01", insert("", "anonymous01"))
+	require.Equal(t, "anonymous01", insert("", "anonymous02"))
+	require.Equal(t, "userone0001", insert("user:1", "userone0001"))
+	require.Equal(t, "userone0001", insert("user:1", "userone0002"))
+	require.Equal(t, "usertwo0001", insert("user:2", "usertwo0001"))
+
+	// Only links that were stored get an ID.
+	created := &Link{Owner: "user:4", OriginalURL: "https://example.com", CanonicalURL: "https://example.com/", Alias: "userfour001"}
+	_, err := repo.Insert(ctx, created)
+	require.NoError(t, err)
+	require.NotZero(t, created.ID)
+	reused := &Link{Owner: "user:4", OriginalURL: "https://example.com", CanonicalURL: "https://example.com/", Alias: "userfour002"}
+	_, err = repo.Insert(ctx, reused)
+	require.NoError(t, err)
+	require.Zero(t, reused.ID)
+
+	_, err = repo.Insert(ctx, &Link{
+		Owner:        "user:3",
+		OriginalURL:  "https://example.com",
+		CanonicalURL: "https://example.com/",
+		Alias:        "anonymous01",
+	})
+	require.ErrorIs(t, err, ErrDuplicateAlias)
+}
+
+func TestRepoInsertOnlyDeduplicatesPlainLinks(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	insert := func(owner, alias string, rules []Rule) string {
+		got, err := repo.Insert(ctx, &Link{
+			Owner:        owner,
+			OriginalURL:  "https://example.com",
+			CanonicalURL: "https://example.com/",
+			Alias:        alias,
+			Rules:        rules,
+		})
+		require.NoError(t, err)
+		return got
+	}
+	toDE := []Rule{{Countries: []string{"DE"}, URL: "https://example.de/"}}
+	toFR := []Rule{{Countries: []string{"FR"}, URL: "https://example.fr/"}}
+
+	// Two anonymous callers with different rules must not share a link.
+	require.Equal(t, "anonrules01", insert("", "anonrules01", toDE))
+	require.Equal(t, "anonrules02", insert("", "anonrules02", toFR))
+	require.Equal(t, "anonrules03", insert("", "anonrules03", toDE))
+	// Nor does a plain link get one of theirs.
+	require.Equal(t, "anonplain01", insert("", "anonplain01", nil))
+	require.Equal(t, "anonplain01", insert("", "anonplain02", nil))
+
+	require.Equal(t, "userplain01", insert("user:1", "userplain01", nil))
+	_, err := repo.UpdateLink(ctx, "user:1", "userplain01", LinkUpdate{Rules: &toDE})
+	require.NoError(t, err)
+	// Updated links are not handed out again.
+	require.Equal(t, "userplain02", insert("user:1", "userplain02", nil))
+	require.Equal(t, "userplain02", insert("user:1", "userplain03", nil))
+}
+
+func TestWebUserSeesOwnLinks(t *testing.T) {
+	app := newTestApp(t)
+
+	alice := newBrowser(t)
+	resp := submitForm(t, alice, app.BaseURL, "/register", "/register", url.Values{
+		"email":    {"alice@example.com"},
+		"password": {"alice's password"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp, err := alice.Post(app.BaseURL+"/api/shorten", echo.MIMEApplicationJSON, bytes.NewBufferString(`{"url":"https://example.com/alice"}`))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, resp.Body.Close()) }()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	_, body := getPage(t, alice, app.BaseURL+"/")
+	require.Contains(t, body, "https://example.com/alice")
+
+	bob := newBrowser(t)
+	resp = submitForm(t, bob, app.BaseURL, "/register", "/register", url.Values{
+		"email":    {"bob@example.com"},
+		"password": {"bob's password"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	_, body = getPage(t, bob, app.BaseURL+"/")
+	require.NotContains(t, body, "https://example.com/alice")
+}
+
+func TestRepoWorkspaceMembers(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	admin, err := repo.CreateUser(ctx, "admin@example.com", "hash")
+	require.NoError(t, err)
+	member, err := repo.CreateUser(ctx, "member@example.com", "hash")
+	require.NoError(t, err)
+
+	workspace, err := repo.CreateWorkspace(ctx, "Growth", admin.ID)
+	require.NoError(t, err)
+
+	err = repo.CreateInvitation(ctx, &Invitation{
+		TokenHash: "invitation",
+		Workspace: *workspace,
+		Email:     member.Email,
+		Role:      WorkspaceEditor,
+		InvitedBy: admin.ID,
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	_, err = repo.AcceptInvitation(ctx, "invitation", admin)
+	require.ErrorIs(t, err, ErrInvitationMismatch)
+
+	m, err := repo.AcceptInvitation(ctx, "invitation", member)
+	require.NoError(t, err)
+	require.Equal(t, WorkspaceEditor, m.Role)
+	_, err = repo.GetInvitation(ctx, "invitation")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+
+	members, err := repo.ListMembers(ctx, workspace.ID)
+	require.NoError(t, err)
+	require.Len(t, members, 2)
+
+	memberships, err := repo.ListMemberships(ctx, member.ID)
+	require.NoError(t, err)
+	require.Len(t, memberships, 1)
+	require.Equal(t, "Growth", memberships[0].Workspace.Name)
+
+	require.ErrorIs(t, repo.RemoveMember(ctx, workspace.ID, admin.ID), ErrLastAdmin)
+	require.NoError(t, repo.RemoveMember(ctx, workspace.ID, member.ID))
+	_, err = repo.GetMembership(ctx, workspace.ID, member.ID)
+	require.ErrorIs(t, err, ErrRecordNotFound)
+}
+
+func TestRepoAPITokens(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	user, err := repo.CreateUser(ctx, "ci@example.com", "hash")
+	require.NoError(t, err)
+
+	key := &APIToken{UserID: user.ID, Name: "ci", Kind: TokenKindKey, Scopes: []string{ScopeLinksWrite}}
+	require.NoError(t, repo.CreateAPIToken(ctx, key, "secret-hash"))
+	jwt := &APIToken{UserID: user.ID, Name: "dashboard", Kind: TokenKindJWT, Scopes: []string{ScopeLinksRead, ScopeStatsRead},
+		ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, repo.CreateAPIToken(ctx, jwt, ""))
+
+	got, err := repo.GetAPITokenBySecret(ctx, "secret-hash")
+	require.NoError(t, err)
+	require.Equal(t, key.ID, got.ID)
+	require.Equal(t, []string{ScopeLinksWrite}, got.Scopes)
+	require.True(t, got.ExpiresAt.IsZero())
+
+	tokens, err := repo.ListAPITokens(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+
+	jti := fmt.Sprint(jwt.ID)
+	revoked, err := repo.IsTokenRevoked(ctx, jti)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	require.NoError(t, repo.RevokeAPIToken(ctx, user.ID, jwt.ID))
+	revoked, err = repo.IsTokenRevoked(ctx, jti)
+	require.NoError(t, err)
+	require.True(t, revoked)
+	require.ErrorIs(t, repo.RevokeAPIToken(ctx, user.ID, jwt.ID), ErrRecordNotFound)
+
+	require.NoError(t, repo.RevokeAPIToken(ctx, user.ID, key.ID))
+	_, err = repo.GetAPITokenBySecret(ctx, "secret-hash")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+}
+
+func TestRepoModeration(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	for _, alias := range []string{"moderated01", "moderated02"} {
+		_, err := repo.Insert(ctx, &Link{
+			OriginalURL:  "https://example.com/" + alias,
+			CanonicalURL: "https://example.com/" + alias,
+			Alias:        alias,
+		})
+		require.NoError(t, err)
+	}
+
+	for range 2 {
+		_, err := repo.GetLink(ctx, "moderated01")
+		require.NoError(t, err)
+	}
+
+	links, err := repo.SearchLinks(ctx, "moderated01", 10)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	require.EqualValues(t, 2, links[0].Clicks)
+	id := links[0].ID
+
+	links, err = repo.SearchLinks(ctx, "example.com/moderated", 10)
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+	links, err = repo.SearchLinks(ctx, "%", 10)
+	require.NoError(t, err)
+	require.Empty(t, links)
+
+	require.NoError(t, repo.CreateAbuseReport(ctx, "moderated01", "phishing", "192.0.2.1"))
+	require.ErrorIs(t, repo.CreateAbuseReport(ctx, "unknown", "phishing", "192.0.2.1"), ErrRecordNotFound)
+	reports, err := repo.ListAbuseReports(ctx, id, 10)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, "moderated01", reports[0].Alias)
+
+	require.NoError(t, repo.SetLinkDisabled(ctx, id, true))
+	_, err = repo.GetLink(ctx, "moderated01")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+	link, err := repo.GetLinkByID(ctx, id)
+	require.NoError(t, err)
+	require.False(t, link.DisabledAt.IsZero())
+
+	require.NoError(t, repo.SetLinkDisabled(ctx, id, false))
+	_, err = repo.GetLink(ctx, "moderated01")
+	require.NoError(t, err)
+
+	require.NoError(t, repo.DeleteLink(ctx, id))
+	_, err = repo.GetLinkByID(ctx, id)
+	require.ErrorIs(t, err, ErrRecordNotFound)
+	reports, err = repo.ListAbuseReports(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, reports)
+}
+
+func TestReadyz(t *testing.T) {
+	app := newTestApp(t)
+	client := newClient()
+
+	resp, err := client.Get(app.BaseURL + "/readyz")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCLI(t *testing.T) {
+	app := newTestApp(t)
+	repo := app.Repo.(*Repo)
+	ctx := t.Context()
+
+	run := func(args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		cli := &CLI{App: app, Repo: repo, Out: &out}
+		require.NoError(t, cli.Run(ctx, args))
+		return out.String()
+	}
+
+	out := run("links", "create", "-alias", "cli-link", "https://example.com/cli")
+	require.Equal(t, app.BaseURL+"/r/cli-link\n", out)
+	require.Contains(t, run("links", "get", "cli-link"), "https://example.com/cli")
+
+	export := filepath.Join(t.TempDir(), "links.csv")
+	run("links", "export", export)
+	run("links", "delete", "cli-link")
+	_, err := repo.GetLinkByAlias(ctx, "cli-link")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+	require.Equal(t, "imported 1 links\n", run("links", "import", export))
+	link, err := repo.GetLinkByAlias(ctx, "cli-link")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/cli", link.OriginalURL)
+
+	_, err = repo.CreateUser(ctx, "ops@example.com", "hash")
+	require.NoError(t, err)
+	secret := strings.TrimSpace(run("keys", "create", "-user", "ops@example.com", "-name", "deploy", "-scope", "links:read,links:write"))
+	require.True(t, strings.HasPrefix(secret, apiKeyPrefix))
+	token, err := repo.GetAPITokenBySecret(ctx, hashToken(secret))
+	require.NoError(t, err)
+	require.Equal(t, []string{ScopeLinksRead, ScopeLinksWrite}, token.Scopes)
+	require.Contains(t, run("keys", "list", "-user", "ops@example.com"), "deploy")
+	run("keys", "revoke", "-user", "ops@example.com", fmt.Sprint(token.ID))
+	_, err = repo.GetAPITokenBySecret(ctx, hashToken(secret))
+	require.ErrorIs(t, err, ErrRecordNotFound)
+
+	require.Equal(t, "ops@example.com is now admin\n", run("users", "set-role", "ops@example.com", "admin"))
+	user, err := repo.GetUserByEmail(ctx, "ops@example.com")
+	require.NoError(t, err)
+	require.Equal(t, RoleAdmin, user.Role)
+	cli := &CLI{App: app, Repo: repo, Out: &bytes.Buffer{}}
+	require.EqualError(t, cli.Run(ctx, []string{"users", "set-role", "nobody@example.com", "admin"}), `no user with email "nobody@example.com"`)
+
+	require.NoError(t, repo.CreateSession(ctx, "expired", token.UserID, time.Now().Add(-time.Minute)))
+	require.Contains(t, run("purge-expired"), "sessions: 1\n")
+	run("migrate", "status")
+}
+
+func TestCLILinksImport(t *testing.T) {
+	app := newTestApp(t)
+	repo := app.Repo.(*Repo)
+	ctx := t.Context()
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		cli := &CLI{App: app, Repo: repo, Out: &out}
+		err := cli.Run(ctx, args)
+		return out.String(), err
+	}
+
+	user, err := repo.CreateUser(ctx, "ops@example.com", "hash")
+	require.NoError(t, err)
+	original := &Link{
+		Owner:          userOwner(user.ID),
+		OriginalURL:    "https://example.com/launch",
+		Alias:          "launch",
+		RedirectStatus: http.StatusMovedPermanently,
+		Passthrough:    true,
+		QueryConflict:  QueryKeep,
+		Variants:       []Variant{{Name: "a", URL: "https://example.com/a", Weight: 1}, {Name: "b", URL: "https://example.com/b", Weight: 1}},
+		ActiveFrom:     time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		BeforeActive:   BeforeActiveComingSoon,
+		Preview:        LinkPreview{Title: "Launch"},
+		FallbackURL:    "https://example.com/",
+	}
+	_, err = app.createLink(ctx, original)
+	require.NoError(t, err)
+	stored, err := repo.GetLinkByAlias(ctx, "launch")
+	require.NoError(t, err)
+	require.NoError(t, repo.SetLinkDisabled(ctx, stored.ID, true))
+
+	export := filepath.Join(t.TempDir(), "links.csv")
+	_, err = run("links", "export", export)
+	require.NoError(t, err)
+	require.NoError(t, repo.DeleteLink(ctx, stored.ID))
+
+	out, err := run("links", "import", "-dry-run", export)
+	require.NoError(t, err)
+	require.Equal(t, "1 links would be imported\n", out)
+	_, err = repo.GetLinkByAlias(ctx, "launch")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+
+	out, err = run("links", "import", export)
+	require.NoError(t, err)
+	require.Equal(t, "imported 1 links\n", out)
+	imported, err := repo.GetLinkByAlias(ctx, "launch")
+	require.NoError(t, err)
+	require.Equal(t, original.Owner, imported.Owner)
+	require.Equal(t, original.RedirectStatus, imported.RedirectStatus)
+	require.Equal(t, original.QueryConflict, imported.QueryConflict)
+	require.Equal(t, original.Variants, imported.Variants)
+	require.True(t, original.ActiveFrom.Equal(imported.ActiveFrom))
+	require.Equal(t, original.Preview, imported.Preview)
+	require.Equal(t, original.FallbackURL, imported.FallbackURL)
+	require.False(t, imported.DisabledAt.IsZero())
+
+	// A file with invalid rows is not imported at all.
+	bad := filepath.Join(t.TempDir(), "bad.csv")
+	require.NoError(t, os.WriteFile(bad, []byte("alias,original_url,owner\n"+
+		"fine,https://example.com/fine,\n"+
+		"nobody,https://example.com/nobody,user:999\n"+
+		"launch,https://example.com/other,\n"+
+		"broken,ftp://example.com/,\n"), 0o600))
+	out, err = run("links", "import", bad)
+	require.EqualError(t, err, "3 of 4 rows are invalid, nothing was imported")
+	require.Equal(t, `line 3: owner "user:999" does not exist
+line 4: alias "launch" is taken by another link
+line 5: original_url must be a valid HTTP(S) URL
+`, out)
+	_, err = repo.GetLinkByAlias(ctx, "fine")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+
+	_, err = run("links", "import", "-owner", "workspace:1", bad)
+	require.EqualError(t, err, `owner "workspace:1" does not exist`)
+	_, err = run("links", "create", "-owner", "user", "https://example.com/")
+	require.EqualError(t, err, `invalid owner "user"`)
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	dsn := createTestDB(t, randomDBName())
+	db, err := OpenDB(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+	require.ErrorContains(t, CheckSchemaVersion(db), "older")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Go(func() {
+			errs[i] = Migrate(db)
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.NoError(t, CheckSchemaVersion(db))
+
+	require.NoError(t, RunMigrations(db, "down"))
+	require.ErrorContains(t, CheckSchemaVersion(db), "older")
+}
+
+func TestRepoUpdateLink(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	for owner, alias := range map[string]string{"": "anonymous01", "user:1": "userlink001"} {
+		_, err := repo.Insert(ctx, &Link{
+			Owner:        owner,
+			OriginalURL:  "https://example.com/" + alias,
+			CanonicalURL: "https://example.com/" + alias,
+			Alias:        alias,
+		})
+		require.NoError(t, err)
+	}
+
+	link, err := repo.GetLink(ctx, "userlink001")
+	require.NoError(t, err)
+	require.Equal(t, DefaultRedirectStatus, link.RedirectStatus)
+	require.Empty(t, link.CacheControl)
+
+	status := http.StatusPermanentRedirect
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{RedirectStatus: &status})
+	require.NoError(t, err)
+	require.Equal(t, status, link.RedirectStatus)
+
+	cacheControl := "public, max-age=60"
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{CacheControl: &cacheControl})
+	require.NoError(t, err)
+	require.Equal(t, status, link.RedirectStatus)
+	require.Equal(t, cacheControl, link.CacheControl)
+
+	passthrough, conflict := true, QueryKeep
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{Passthrough: &passthrough, QueryConflict: &conflict})
+	require.NoError(t, err)
+	require.True(t, link.Passthrough)
+	require.Equal(t, QueryKeep, link.QueryConflict)
+	require.Empty(t, link.Rules)
+
+	rules := []Rule{{Countries: []string{"DE"}, URL: "https://example.de/"}}
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{Rules: &rules})
+	require.NoError(t, err)
+	require.Equal(t, rules, link.Rules)
+	link, err = repo.GetLink(ctx, "userlink001")
+	require.NoError(t, err)
+	require.Equal(t, rules, link.Rules)
+
+	preview := LinkPreview{Title: "Launch", Image: "https://example.com/card.png"}
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{Preview: &preview})
+	require.NoError(t, err)
+	require.Equal(t, preview, link.Preview)
+	clicks := link.Clicks
+	link, err = repo.PeekLink(ctx, "userlink001")
+	require.NoError(t, err)
+	require.Equal(t, clicks, link.Clicks)
+
+	require.True(t, link.Metadata.FetchedAt.IsZero())
+	meta := LinkMetadata{
+		Title:        "Example",
+		Description:  "An example page",
+		Favicon:      "https://example.com/favicon.ico",
+		CanonicalURL: "https://example.com/",
+		FetchedAt:    time.Now().UTC().Truncate(time.Microsecond),
+	}
+	require.NoError(t, repo.SetLinkMetadata(ctx, "userlink001", meta))
+	link, err = repo.PeekLink(ctx, "userlink001")
+	require.NoError(t, err)
+	require.Equal(t, meta.Title, link.Metadata.Title)
+	require.Equal(t, meta.CanonicalURL, link.Metadata.CanonicalURL)
+	require.True(t, meta.FetchedAt.Equal(link.Metadata.FetchedAt))
+	require.ErrorIs(t, repo.SetLinkMetadata(ctx, "missing", meta), ErrRecordNotFound)
+
+	variants := []Variant{
+		{Name: "a", URL: "https://example.com/a", Weight: 1},
+		{Name: "b", URL: "https://example.com/b", Weight: 2},
+	}
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{Variants: &variants})
+	require.NoError(t, err)
+	require.Equal(t, variants, link.Variants)
+	require.Empty(t, link.VariantClicks)
+	require.NoError(t, repo.CountVariantClick(ctx, link.ID, "b"))
+	require.NoError(t, repo.CountVariantClick(ctx, link.ID, "b"))
+	link, err = repo.GetLink(ctx, "userlink001")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"b": 2}, link.VariantClicks)
+
+	activeFrom := time.Now().Add(time.Hour)
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{ActiveFrom: &activeFrom})
+	require.NoError(t, err)
+	require.WithinDuration(t, activeFrom, link.ActiveFrom, time.Millisecond)
+	clicks = link.Clicks
+	link, err = repo.GetLink(ctx, "userlink001")
+	require.NoError(t, err)
+	require.Equal(t, clicks, link.Clicks, "pending links do not count clicks")
+
+	activeUntil := activeFrom.Add(-time.Minute)
+	_, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{ActiveUntil: &activeUntil})
+	require.ErrorIs(t, err, ErrInvalidActiveWindow)
+	link, err = repo.UpdateLink(ctx, "user:1", "userlink001", LinkUpdate{ActiveFrom: &time.Time{}})
+	require.NoError(t, err)
+	require.True(t, link.ActiveFrom.IsZero())
+
+	_, err = repo.UpdateLink(ctx, "user:2", "userlink001", LinkUpdate{RedirectStatus: &status})
+	require.ErrorIs(t, err, ErrRecordNotFound)
+	_, err = repo.UpdateLink(ctx, "", "anonymous01", LinkUpdate{RedirectStatus: &status})
+	require.ErrorIs(t, err, ErrRecordNotFound)
+}
+
+func TestRepoClickLimit(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	insert := func(alias string, maxClicks int, oneTime bool) string {
+		t.Helper()
+		got, err := repo.Insert(ctx, &Link{
+			Owner:        "user:1",
+			OriginalURL:  "https://example.com/onboarding",
+			CanonicalURL: "https://example.com/onboarding",
+			Alias:        alias,
+			MaxClicks:    maxClicks,
+			OneTime:      oneTime,
+		})
+		require.NoError(t, err)
+		return got
+	}
+	require.Equal(t, "limited0001", insert("limited0001", 3, false))
+	require.Equal(t, "onetime0001", insert("onetime0001", 1, true))
+	require.Equal(t, "unlimited01", insert("unlimited01", 0, false))
+	require.Equal(t, "unlimited01", insert("unlimited02", 0, false), "unlimited links are still deduplicated")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := map[error]int{}
+	for range 10 {
+		wg.Go(func() {
+			_, err := repo.GetLink(ctx, "limited0001")
+			mu.Lock()
+			defer mu.Unlock()
+			results[err]++
+		})
+	}
+	wg.Wait()
+	require.Equal(t, map[error]int{nil: 3, ErrClickLimitReached: 7}, results)
+
+	// Looking at a one-time link does not use it up, confirming does.
+	for range 2 {
+		link, err := repo.GetLink(ctx, "onetime0001")
+		require.NoError(t, err)
+		require.Zero(t, link.Clicks)
+	}
+	link, err := repo.ConfirmLink(ctx, "onetime0001")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, link.Clicks)
+	_, err = repo.ConfirmLink(ctx, "onetime0001")
+	require.ErrorIs(t, err, ErrClickLimitReached)
+	_, err = repo.GetLink(ctx, "onetime0001")
+	require.ErrorIs(t, err, ErrClickLimitReached)
+
+	// A refunded click can be used again.
+	require.NoError(t, repo.RefundClick(ctx, link.ID))
+	link, err = repo.ConfirmLink(ctx, "onetime0001")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, link.Clicks)
+	require.ErrorIs(t, repo.RefundClick(ctx, -1), ErrRecordNotFound)
+
+	_, err = repo.GetLink(ctx, "missing0001")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+	link, err = repo.PeekLink(ctx, "onetime0001")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, link.Clicks)
+
+	noLimit := 0
+	_, err = repo.UpdateLink(ctx, "user:1", "limited0001", LinkUpdate{MaxClicks: &noLimit})
+	require.ErrorIs(t, err, ErrDuplicateURL)
+	oneTime := true
+	_, err = repo.UpdateLink(ctx, "user:1", "unlimited01", LinkUpdate{OneTime: &oneTime})
+	require.ErrorIs(t, err, ErrInvalidOneTime)
+}
+
+func TestRepoLinkHealth(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	_, err := repo.Insert(ctx, &Link{
+		Owner:        "user:1",
+		OriginalURL:  "https://example.com/deleted",
+		CanonicalURL: "https://example.com/deleted",
+		Alias:        "health00001",
+		FallbackURL:  "https://example.com/",
+	})
+	require.NoError(t, err)
+
+	links, err := repo.ClaimLinksToCheck(ctx, time.Hour, 100)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	link := links[0]
+	require.Equal(t, "https://example.com/", link.FallbackURL)
+	links, err = repo.ClaimLinksToCheck(ctx, time.Hour, 100)
+	require.NoError(t, err)
+	require.Empty(t, links, "claimed links are not due again before the interval")
+
+	failed := LinkCheck{Status: 404, Failed: true, CheckedAt: time.Now()}
+	inconclusive := LinkCheck{Error: "check link: timeout", Inconclusive: true, CheckedAt: time.Now()}
+	for i := 1; i <= 2; i++ {
+		health, err := repo.RecordLinkCheck(ctx, link.ID, failed, 2)
+		require.NoError(t, err)
+		require.Equal(t, i, health.Failures)
+		require.Equal(t, i == 2, !health.BrokenSince.IsZero())
+
+		// Inconclusive checks neither count nor end the failures.
+		health, err = repo.RecordLinkCheck(ctx, link.ID, inconclusive, 2)
+		require.NoError(t, err)
+		require.Equal(t, i, health.Failures)
+		require.Equal(t, i == 2, !health.BrokenSince.IsZero())
+	}
+	broken, err := repo.ListBrokenLinks(ctx, "user:1", 10)
+	require.NoError(t, err)
+	require.Len(t, broken, 1)
+	require.True(t, broken[0].Broken())
+	require.Zero(t, broken[0].Health.Status)
+
+	health, err := repo.RecordLinkCheck(ctx, link.ID, LinkCheck{Status: 200, CheckedAt: time.Now()}, 2)
+	require.NoError(t, err)
+	require.Zero(t, health.Failures)
+	require.True(t, health.BrokenSince.IsZero())
+	broken, err = repo.ListBrokenLinks(ctx, "user:1", 10)
+	require.NoError(t, err)
+	require.Empty(t, broken)
+
+	checks, err := repo.ListLinkChecks(ctx, "user:1", "health00001")
+	require.NoError(t, err)
+	require.Len(t, checks, 5)
+	require.Equal(t, 200, checks[0].Status)
+	_, err = repo.ListLinkChecks(ctx, "user:2", "health00001")
+	require.ErrorIs(t, err, ErrRecordNotFound)
+	_, err = repo.RecordLinkCheck(ctx, -1, failed, 2)
+	require.ErrorIs(t, err, ErrRecordNotFound)
+}
+
+func TestRepoReserveIdempotencyKeyPurgesExpiredKeys(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	repo := &Repo{DB: db}
+	ctx := t.Context()
+
+	_, err := db.ExecContext(ctx, `INSERT INTO idempotency_keys (scope, key, request_hash, expires_at)
+	VALUES ('POST /api/shorten ip:192.0.2.1', 'old', 'hash', NOW() - INTERVAL '1 hour');`)
+	require.NoError(t, err)
+
+	record, err := repo.ReserveIdempotencyKey(ctx, "POST /api/shorten ip:192.0.2.2", "new", "hash", time.Hour)
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	var keys []string
+	rows, err := db.QueryContext(ctx, `SELECT key FROM idempotency_keys;`)
+	require.NoError(t, err)
+	for rows.Next() {
+		var key string
+		require.NoError(t, rows.Scan(&key))
+		keys = append(keys, key)
+	}
+	require.NoError(t, rows.Err())
+	require.NoError(t, rows.Close())
+	require.Equal(t, []string{"new"}, keys)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// GeoIP maps client addresses to countries. It reads a MaxMind DB file with
+// country data, such as GeoLite2 Country or City, GeoIP2 Country or City, or
+// DB-IP Country Lite.
+type GeoIP struct {
+	db *maxminddb.Reader
+}
+
+// geoIPRecord is the part of a GeoIP record that country rules use.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// LoadGeoIP opens the GeoIP database at path.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if db.Metadata.IPVersion != 6 {
+		// Visitors connect over IPv6 too, which an IPv4 database cannot
+		// look up.
+		_ = db.Close()
+		return nil, fmt.Errorf("%s is an IPv%d database, not an IPv6 one", path, db.Metadata.IPVersion)
+	}
+	return &GeoIP{db: db}, nil
+}
+
+// Country returns the ISO 3166 alpha-2 code of the country of addr, or ""
+// when it is not in the database.
+func (g *GeoIP) Country(addr netip.Addr) string {
+	var record geoIPRecord
+	if err := g.db.Lookup(addr.Unmap()).Decode(&record); err != nil {
+		return ""
+	}
+	if !countryCodePattern.MatchString(record.Country.ISOCode) {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// Close releases the database.
+func (g *GeoIP) Close() error {
+	return g.db.Close()
+}
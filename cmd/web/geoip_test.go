@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestGeoIP writes an IPv6 MaxMind DB mapping the given networks to
+// country codes and returns its path. Networks must not overlap.
+func writeTestGeoIP(t *testing.T, countries map[string]string) string {
+	t.Helper()
+
+	// The search tree has a node for each bit of the networks' prefixes.
+	// Records hold the index of the next node, or a leaf: -1 for no data
+	// and the offset in the data section otherwise, plus 1.
+	type node [2]int
+	nodes := []node{{-1, -1}}
+	var data bytes.Buffer
+	for network, country := range countries {
+		prefix := netip.MustParsePrefix(network).Masked()
+		bits := prefix.Bits()
+		addr := prefix.Addr()
+		if addr.Is4() {
+			// IPv4 networks live under ::/96.
+			addr = netip.AddrFrom16([16]byte(append(make([]byte, 12), addr.AsSlice()...)))
+			bits += 96
+		}
+		ip := addr.As16()
+		current := 0
+		for i := range bits {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				nodes[current][bit] = -(data.Len() + 2)
+				writeMMDBMap(&data, map[string]any{"country": map[string]any{"iso_code": country}})
+				break
+			}
+			if nodes[current][bit] < 0 {
+				nodes = append(nodes, node{-1, -1})
+				nodes[current][bit] = len(nodes) - 1
+			}
+			current = nodes[current][bit]
+		}
+	}
+
+	var db bytes.Buffer
+	for _, n := range nodes {
+		for _, record := range n {
+			value := record
+			switch {
+			case record == -1:
+				value = len(nodes)
+			case record < -1:
+				value = len(nodes) + 16 + (-record - 2)
+			}
+			db.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	writeMMDBMap(&db, map[string]any{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint32(24),
+		"ip_version":                  uint32(6),
+		"database_type":               "Test-Country",
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(0),
+	})
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	require.NoError(t, os.WriteFile(path, db.Bytes(), 0o600))
+	return path
+}
+
+// writeMMDBMap encodes m in the data format of MaxMind DB files. Only the
+// types the tests need are supported.
+func writeMMDBMap(b *bytes.Buffer, m map[string]any) {
+	b.WriteByte(7<<5 | byte(len(m)))
+	for key, value := range m {
+		writeMMDBString(b, key)
+		switch v := value.(type) {
+		case string:
+			writeMMDBString(b, v)
+		case uint32:
+			b.WriteByte(6<<5 | 4)
+			b.Write(binary.BigEndian.AppendUint32(nil, v))
+		case map[string]any:
+			writeMMDBMap(b, v)
+		}
+	}
+}
+
+func writeMMDBString(b *bytes.Buffer, s string) {
+	b.WriteByte(2<<5 | byte(len(s)))
+	b.WriteString(s)
+}
+
+func TestGeoIP(t *testing.T) {
+	g, err := LoadGeoIP(writeTestGeoIP(t, map[string]string{
+		"81.2.69.0/25":   "GB",
+		"81.2.69.128/25": "IE",
+		"2001:db8::/32":  "DE",
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, g.Close()) })
+
+	tests := map[string]string{
+		"81.2.69.1":          "GB",
+		"81.2.69.200":        "IE",
+		"::ffff:81.2.69.200": "IE",
+		"2001:db8::1":        "DE",
+		"192.0.2.1":          "",
+		"2001:db9::1":        "",
+	}
+	for ip, want := range tests {
+		require.Equal(t, want, g.Country(netip.MustParseAddr(ip)), ip)
+	}
+
+	_, err = LoadGeoIP(filepath.Join(t.TempDir(), "missing.mmdb"))
+	require.Error(t, err)
+	notMMDB := filepath.Join(t.TempDir(), "countries.csv")
+	require.NoError(t, os.WriteFile(notMMDB, []byte("81.2.69.0/24,GB\n"), 0o600))
+	_, err = LoadGeoIP(notMMDB)
+	require.Error(t, err)
+}
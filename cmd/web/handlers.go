@@ -1,15 +1,32 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 func (app *Application) Index(c echo.Context) error {
-	return c.Render(http.StatusOK, "index.html", map[string]any{"version": version})
+	var links []Link
+	if user := currentUser(c); user != nil {
+		var err error
+		links, err = app.Repo.ListLinks(c.Request().Context(), userOwner(user.ID), 50)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Render(http.StatusOK, "index.html", app.pageData(c, map[string]any{
+		"links":   links,
+		"baseURL": app.BaseURL,
+	}))
 }
 
 func (app *Application) Shorten(c echo.Context) error {
@@ -18,7 +35,24 @@ func (app *Application) Shorten(c echo.Context) error {
 	}
 
 	var request struct {
-		URL string `json:"url" validate:"required,http_url,max=500"`
+		URL            string      `json:"url" validate:"required,http_url,max=500"`
+		RedirectStatus int         `json:"redirect_status" validate:"omitempty,oneof=301 302 303 307 308"`
+		CacheControl   string      `json:"cache_control" validate:"max=200"`
+		Passthrough    bool        `json:"passthrough"`
+		QueryConflict  string      `json:"query_conflict" validate:"omitempty,oneof=override keep append"`
+		Template       bool        `json:"template"`
+		Rules          []Rule      `json:"rules"`
+		Variants       []Variant   `json:"variants"`
+		IOSURL         string      `json:"ios_url"`
+		AndroidURL     string      `json:"android_url"`
+		ActiveFrom     time.Time   `json:"active_from"`
+		ActiveUntil    time.Time   `json:"active_until"`
+		BeforeActive   string      `json:"before_active" validate:"omitempty,oneof=not_found coming_soon"`
+		ExpiredURL     string      `json:"expired_url" validate:"max=500"`
+		MaxClicks      int         `json:"max_clicks"`
+		OneTime        bool        `json:"one_time"`
+		Preview        LinkPreview `json:"preview"`
+		FallbackURL    string      `json:"fallback_url" validate:"max=500"`
 	}
 	if err := c.Bind(&request); err != nil {
 		return err
@@ -27,11 +61,70 @@ func (app *Application) Shorten(c echo.Context) error {
 	if err := c.Validate(request); err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
 	}
+	if !validCacheControl(request.CacheControl) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidCacheControl.Error()})
+	}
+	if request.Template && !validTemplate(request.URL) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrNoPlaceholders.Error()})
+	}
+	if err := validateRules(request.Rules); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	}
+	if err := validateVariants(request.Variants); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	}
+	if !validAppURL(request.IOSURL) || !validAppURL(request.AndroidURL) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidAppURL.Error()})
+	}
+	if !request.ActiveFrom.IsZero() && !request.ActiveUntil.IsZero() && !request.ActiveUntil.After(request.ActiveFrom) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidActiveWindow.Error()})
+	}
+	if request.ExpiredURL != "" && !validDestination(request.ExpiredURL) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "expired_url " + ErrInvalidURL.Error()})
+	}
+	if request.FallbackURL != "" && !validDestination(request.FallbackURL) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "fallback_url " + ErrInvalidURL.Error()})
+	}
+	if request.MaxClicks < 0 {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidMaxClicks.Error()})
+	}
+	if linkOwner(c) == "" && (len(request.Rules) > 0 || len(request.Variants) > 0 || request.IOSURL != "" ||
+		request.AndroidURL != "" || request.ExpiredURL != "" || request.FallbackURL != "") {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrAnonymousRouting.Error()})
+	}
+	if request.OneTime {
+		if request.MaxClicks > 1 {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidOneTime.Error()})
+		}
+		request.MaxClicks = 1
+	}
 
-	alias := GenerateAlias(request.URL)
-
-	alias, err := app.Repo.Insert(c.Request().Context(), request.URL, alias)
+	link := &Link{
+		Owner:          linkOwner(c),
+		OriginalURL:    request.URL,
+		RedirectStatus: request.RedirectStatus,
+		CacheControl:   request.CacheControl,
+		Passthrough:    request.Passthrough,
+		QueryConflict:  request.QueryConflict,
+		Template:       request.Template,
+		Rules:          request.Rules,
+		Variants:       request.Variants,
+		IOSURL:         request.IOSURL,
+		AndroidURL:     request.AndroidURL,
+		ActiveFrom:     request.ActiveFrom,
+		ActiveUntil:    request.ActiveUntil,
+		BeforeActive:   request.BeforeActive,
+		ExpiredURL:     request.ExpiredURL,
+		MaxClicks:      request.MaxClicks,
+		OneTime:        request.OneTime,
+		Preview:        request.Preview,
+		FallbackURL:    request.FallbackURL,
+	}
+	alias, err := app.createLink(c.Request().Context(), link)
 	if err != nil {
+		if errors.Is(err, ErrInvalidURL) {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
 		return err
 	}
 
@@ -41,21 +134,442 @@ func (app *Application) Shorten(c echo.Context) error {
 	})
 }
 
+var (
+	ErrInvalidURL          = errors.New("must be a valid HTTP(S) URL")
+	ErrInvalidCacheControl = errors.New("cache_control must be a list of Cache-Control directives")
+	// ErrAnonymousRouting is returned for anonymous links with settings that
+	// send visitors somewhere else than their destination, which nobody
+	// could see or change afterwards.
+	ErrAnonymousRouting = errors.New("rules, variants, app URLs, expired_url and fallback_url require an account")
+)
+
+// createLink stores link and returns its alias, which is the existing one
+// when the owner already shortened the same URL. link.Alias is used as is
+// when it is not empty; otherwise one is generated.
+func (app *Application) createLink(ctx context.Context, link *Link) (string, error) {
+	alias, err := app.insertLink(ctx, link)
+	// Links handed out again already had their destination fetched.
+	// Templates have no single destination to fetch, and fetching the
+	// destination of a one-time link could use it up.
+	if err == nil && link.ID != 0 && app.Metadata != nil && !link.Template && !link.OneTime {
+		app.Metadata.Enqueue(alias, link.OriginalURL)
+	}
+	return alias, err
+}
+
+func (app *Application) insertLink(ctx context.Context, link *Link) (string, error) {
+	if !validDestination(link.OriginalURL) {
+		return "", ErrInvalidURL
+	}
+	canonicalURL, err := Canonicalize(link.OriginalURL, app.Canonicalize)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+	link.CanonicalURL = canonicalURL
+
+	if link.Alias != "" {
+		return app.Repo.Insert(ctx, link)
+	}
+
+	// Anonymous links keep hashing the bare URL so that their aliases do not
+	// change; owned links must not collide with the same URL elsewhere.
+	aliasKey := canonicalURL
+	if link.Owner != "" {
+		aliasKey = link.Owner + " " + canonicalURL
+	}
+	if !link.Plain() {
+		// Only plain links are deduplicated, so the others each need an
+		// alias of their own.
+		nonce, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		aliasKey += " " + nonce
+	}
+	for attempt := 0; ; attempt++ {
+		key := aliasKey
+		if attempt > 0 {
+			// Deterministic strategies would generate the same alias again.
+			key += " " + strconv.Itoa(attempt)
+		}
+		link.Alias, err = app.aliases().Generate(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		alias, err := app.Repo.Insert(ctx, link)
+		if errors.Is(err, ErrDuplicateAlias) && attempt < 4 {
+			continue
+		}
+		return alias, err
+	}
+}
+
+// validDestination reports whether s is an absolute HTTP(S) URL.
+func validDestination(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+type linkResponse struct {
+	Alias          string            `json:"alias"`
+	ShortURL       string            `json:"short_url"`
+	OriginalURL    string            `json:"original_url"`
+	RedirectStatus int               `json:"redirect_status"`
+	CacheControl   string            `json:"cache_control"`
+	Passthrough    bool              `json:"passthrough"`
+	QueryConflict  string            `json:"query_conflict"`
+	Template       bool              `json:"template"`
+	Rules          []Rule            `json:"rules"`
+	Variants       []variantResponse `json:"variants"`
+	IOSURL         string            `json:"ios_url"`
+	AndroidURL     string            `json:"android_url"`
+	ActiveFrom     time.Time         `json:"active_from,omitzero"`
+	ActiveUntil    time.Time         `json:"active_until,omitzero"`
+	BeforeActive   string            `json:"before_active"`
+	ExpiredURL     string            `json:"expired_url"`
+	MaxClicks      int               `json:"max_clicks,omitempty"`
+	OneTime        bool              `json:"one_time"`
+	Preview        LinkPreview       `json:"preview"`
+	Metadata       LinkMetadata      `json:"metadata"`
+	FallbackURL    string            `json:"fallback_url"`
+	Health         LinkHealth        `json:"health"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+type variantResponse struct {
+	Variant
+	Clicks int64 `json:"clicks"`
+}
+
+func (app *Application) newLinkResponse(link *Link) linkResponse {
+	rules := link.Rules
+	if rules == nil {
+		rules = []Rule{}
+	}
+	variants := make([]variantResponse, 0, len(link.Variants))
+	for _, v := range link.Variants {
+		variants = append(variants, variantResponse{Variant: v, Clicks: link.VariantClicks[v.Name]})
+	}
+	return linkResponse{
+		Alias:          link.Alias,
+		ShortURL:       fmt.Sprintf("%s/r/%s", app.BaseURL, link.Alias),
+		OriginalURL:    link.OriginalURL,
+		RedirectStatus: link.RedirectStatus,
+		CacheControl:   link.CacheControl,
+		Passthrough:    link.Passthrough,
+		QueryConflict:  link.QueryConflict,
+		Template:       link.Template,
+		Rules:          rules,
+		Variants:       variants,
+		IOSURL:         link.IOSURL,
+		AndroidURL:     link.AndroidURL,
+		ActiveFrom:     link.ActiveFrom,
+		ActiveUntil:    link.ActiveUntil,
+		BeforeActive:   link.BeforeActive,
+		ExpiredURL:     link.ExpiredURL,
+		MaxClicks:      link.MaxClicks,
+		OneTime:        link.OneTime,
+		Preview:        link.Preview,
+		Metadata:       link.Metadata,
+		FallbackURL:    link.FallbackURL,
+		Health:         link.Health,
+		CreatedAt:      link.CreatedAt,
+	}
+}
+
+func (app *Application) ListLinksAPI(c echo.Context) error {
+	owner := linkOwner(c)
+	if owner == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	}
+
+	links, err := app.Repo.ListLinks(c.Request().Context(), owner, 100)
+	if err != nil {
+		return err
+	}
+
+	response := make([]linkResponse, 0, len(links))
+	for _, link := range links {
+		response = append(response, app.newLinkResponse(&link))
+	}
+	return c.JSON(http.StatusOK, map[string]any{"links": response})
+}
+
+type linkStatsResponse struct {
+	Alias    string            `json:"alias"`
+	Clicks   int64             `json:"clicks"`
+	Variants []variantResponse `json:"variants"`
+}
+
+// LinkStatsAPI returns the click counts of a link owned by the caller.
+func (app *Application) LinkStatsAPI(c echo.Context) error {
+	owner := linkOwner(c)
+	if owner == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	}
+
+	link, err := app.Repo.GetOwnedLink(c.Request().Context(), owner, c.Param("alias"))
+	if err != nil {
+		return linkLookupError(c, err)
+	}
+	return c.JSON(http.StatusOK, linkStatsResponse{
+		Alias:    link.Alias,
+		Clicks:   link.Clicks,
+		Variants: app.newLinkResponse(link).Variants,
+	})
+}
+
+// UpdateLinkAPI changes the settings of a link owned by the caller. Fields
+// missing from the request are left as they are.
+func (app *Application) UpdateLinkAPI(c echo.Context) error {
+	owner := linkOwner(c)
+	if owner == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	}
+
+	var request struct {
+		RedirectStatus *int       `json:"redirect_status" validate:"omitnil,oneof=301 302 303 307 308"`
+		CacheControl   *string    `json:"cache_control" validate:"omitnil,max=200"`
+		Passthrough    *bool      `json:"passthrough"`
+		QueryConflict  *string    `json:"query_conflict" validate:"omitnil,oneof=override keep append"`
+		Rules          *[]Rule    `json:"rules"`
+		Variants       *[]Variant `json:"variants"`
+		IOSURL         *string    `json:"ios_url"`
+		AndroidURL     *string    `json:"android_url"`
+		// A null active_from or active_until removes the bound.
+		ActiveFrom   NullableTime `json:"active_from"`
+		ActiveUntil  NullableTime `json:"active_until"`
+		BeforeActive *string      `json:"before_active" validate:"omitnil,oneof=not_found coming_soon"`
+		ExpiredURL   *string      `json:"expired_url" validate:"omitnil,max=500"`
+		// A max_clicks of 0 removes the limit.
+		MaxClicks   *int         `json:"max_clicks"`
+		OneTime     *bool        `json:"one_time"`
+		Preview     *LinkPreview `json:"preview"`
+		FallbackURL *string      `json:"fallback_url" validate:"omitnil,max=500"`
+	}
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+	if err := c.Validate(request); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	}
+	if request.CacheControl != nil && !validCacheControl(*request.CacheControl) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidCacheControl.Error()})
+	}
+	if request.Rules != nil {
+		if err := validateRules(*request.Rules); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
+	}
+	if request.Variants != nil {
+		if err := validateVariants(*request.Variants); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		}
+	}
+	if (request.IOSURL != nil && !validAppURL(*request.IOSURL)) || (request.AndroidURL != nil && !validAppURL(*request.AndroidURL)) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidAppURL.Error()})
+	}
+	if request.ExpiredURL != nil && *request.ExpiredURL != "" && !validDestination(*request.ExpiredURL) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "expired_url " + ErrInvalidURL.Error()})
+	}
+	if request.FallbackURL != nil && *request.FallbackURL != "" && !validDestination(*request.FallbackURL) {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "fallback_url " + ErrInvalidURL.Error()})
+	}
+	if request.MaxClicks != nil && *request.MaxClicks < 0 {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": ErrInvalidMaxClicks.Error()})
+	}
+	if request.OneTime != nil && *request.OneTime && request.MaxClicks == nil {
+		oneClick := 1
+		request.MaxClicks = &oneClick
+	}
+
+	link, err := app.Repo.UpdateLink(c.Request().Context(), owner, c.Param("alias"), LinkUpdate{
+		RedirectStatus: request.RedirectStatus,
+		CacheControl:   request.CacheControl,
+		Passthrough:    request.Passthrough,
+		QueryConflict:  request.QueryConflict,
+		Rules:          request.Rules,
+		Variants:       request.Variants,
+		IOSURL:         request.IOSURL,
+		AndroidURL:     request.AndroidURL,
+		ActiveFrom:     request.ActiveFrom.Ptr(),
+		ActiveUntil:    request.ActiveUntil.Ptr(),
+		BeforeActive:   request.BeforeActive,
+		ExpiredURL:     request.ExpiredURL,
+		MaxClicks:      request.MaxClicks,
+		OneTime:        request.OneTime,
+		Preview:        request.Preview,
+		FallbackURL:    request.FallbackURL,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+		case errors.Is(err, ErrInvalidActiveWindow), errors.Is(err, ErrInvalidOneTime):
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		case errors.Is(err, ErrDuplicateURL):
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, app.newLinkResponse(link))
+}
+
 func (app *Application) Redirect(c echo.Context) error {
 	alias := c.Param("alias")
-	if len(alias) != 11 || !isValidAlias(alias) {
+	if !plausibleAlias(alias) {
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
 	}
 
-	originalURL, err := app.Repo.GetOriginalURL(c.Request().Context(), alias)
+	if IsUnfurlBot(c.Request().UserAgent()) {
+		return app.preview(c, alias)
+	}
+
+	link, err := app.Repo.GetLink(c.Request().Context(), alias)
 	if err != nil {
-		if errors.Is(err, ErrRecordNotFound) {
+		return linkLookupError(c, err)
+	}
+	if link.OneTime && link.Phase(time.Now()) == LinkActive {
+		return confirmPage(c)
+	}
+	return app.serveLink(c, alias, link)
+}
+
+// confirmPage asks the visitor of a one-time link to confirm. Unfurl bots
+// only GET, so the click is spent on the form submission.
+func confirmPage(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.Render(http.StatusOK, "confirm.html", map[string]any{
+		"action": c.Request().URL.RequestURI(),
+	})
+}
+
+// ConfirmRedirect follows a one-time link once its visitor has confirmed the
+// interstitial page. Other links are followed as by Redirect.
+func (app *Application) ConfirmRedirect(c echo.Context) error {
+	alias := c.Param("alias")
+	if !plausibleAlias(alias) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+	}
+
+	link, err := app.Repo.ConfirmLink(c.Request().Context(), alias)
+	if err != nil {
+		return linkLookupError(c, err)
+	}
+	return app.serveLink(c, alias, link)
+}
+
+func linkLookupError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+	case errors.Is(err, ErrClickLimitReached):
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+		return c.JSON(http.StatusGone, map[string]string{"error": err.Error()})
+	}
+	return err
+}
+
+// serveLink sends the visitor of the short URL of alias on to link.
+func (app *Application) serveLink(c echo.Context, alias string, link *Link) error {
+	if phase := link.Phase(time.Now()); phase != LinkActive {
+		return app.inactiveLink(c, link, phase)
+	}
+	link = link.WithFallback()
+	var variant *Variant
+	if len(link.Rules) > 0 || len(link.Variants) > 0 {
+		visitor := app.visitor(c, alias)
+		link, variant = link.Route(visitor)
+		if variant != nil && variant.Name != visitor.Variant {
+			app.setVariantCookie(c, alias, variant.Name)
+		}
+	}
+
+	// Valid aliases have no characters that need escaping, so the escaped
+	// path starts with the alias as is.
+	extraPath := strings.TrimPrefix(c.Request().URL.EscapedPath(), "/r/"+alias)
+	destination, err := link.Destination(extraPath, c.QueryParams())
+	if err != nil {
+		if link.MaxClicks > 0 {
+			// The visit was counted, but the visitor is not going anywhere,
+			// and must not lose a use of the link for it.
+			if err := app.Repo.RefundClick(c.Request().Context(), link.ID); err != nil {
+				app.Logger.Error("failed to refund click", "alias", alias, "error", err)
+			}
+		}
+		switch {
+		case errors.Is(err, ErrNoPassthrough):
 			return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+		case errors.Is(err, ErrMissingTemplateValue):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 		}
 		return err
 	}
 
-	return c.Redirect(http.StatusSeeOther, originalURL)
+	if variant != nil {
+		// A lost count is better than a failed redirect.
+		if err := app.Repo.CountVariantClick(c.Request().Context(), link.ID, variant.Name); err != nil {
+			app.Logger.Warn("failed to count variant click", "alias", alias, "variant", variant.Name, "error", err)
+		}
+	}
+
+	if policy := link.CachePolicy(app.permanentRedirectMaxAge()); policy != "" {
+		c.Response().Header().Set(echo.HeaderCacheControl, policy)
+	}
+	status := cmp.Or(link.RedirectStatus, DefaultRedirectStatus)
+	if c.Request().Method == http.MethodPost {
+		// 307 and 308 would make the browser post the form to the destination.
+		status = http.StatusSeeOther
+	}
+	if appURL := link.AppURL(Platform(c.Request().UserAgent())); appURL != "" {
+		return app.openApp(c, status, appURL, destination)
+	}
+	return c.Redirect(status, destination)
+}
+
+// inactiveLink answers for a link outside its activation window: with the
+// coming soon page or a 404 before it opens, and with the fallback URL or a
+// 410 after it closes.
+func (app *Application) inactiveLink(c echo.Context, link *Link, phase string) error {
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	if phase == LinkPending {
+		if link.BeforeActive == BeforeActiveComingSoon {
+			return c.Render(http.StatusOK, "coming_soon.html", nil)
+		}
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+	}
+	if link.ExpiredURL == "" {
+		return c.JSON(http.StatusGone, map[string]string{"error": "link has expired"})
+	}
+	return c.Redirect(http.StatusFound, link.ExpiredURL)
+}
+
+// linkOwner returns the namespace new links are created in. Authentication
+// middleware stores it in the context; without it links are anonymous.
+func linkOwner(c echo.Context) string {
+	owner, _ := c.Get("owner").(string)
+	return owner
+}
+
+func (app *Application) permanentRedirectMaxAge() time.Duration {
+	return cmp.Or(app.PermanentRedirectMaxAge, DefaultPermanentRedirectMaxAge)
+}
+
+func (app *Application) aliases() AliasGenerator {
+	if app.Aliases == nil {
+		return &HashAliasGenerator{Length: 11}
+	}
+	return app.Aliases
+}
+
+// maxAliasLength bounds the aliases looked up. It is longer than anything
+// the generators produce, so that aliases of every strategy keep resolving
+// when the strategy changes.
+const maxAliasLength = 128
+
+// plausibleAlias reports whether alias is worth looking up.
+func plausibleAlias(alias string) bool {
+	return alias != "" && len(alias) <= maxAliasLength && isValidAlias(alias)
 }
 
 func isValidAlias(s string) bool {
@@ -67,6 +581,21 @@ func isValidAlias(s string) bool {
 	return true
 }
 
+// Readyz reports whether the application can serve traffic, which it cannot
+// while the database is unreachable.
+func (app *Application) Readyz(c echo.Context) error {
+	if app.DB == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "database not connected"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+	if err := app.DB.PingContext(ctx); err != nil {
+		app.Logger.Warn("readiness check failed", "error", err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "database unreachable"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ready"})
+}
+
 func (app *Application) CustomHTTPErrorHandler(err error, c echo.Context) {
 	if c.Response().Committed {
 		return
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
@@ -17,16 +20,67 @@ import (
 )
 
 type mockRepo struct {
-	insertFn         func(ctx context.Context, url, alias string) (string, error)
-	getOriginalURLFn func(ctx context.Context, alias string) (string, error)
+	insertFn     func(ctx context.Context, link *Link) (string, error)
+	getLinkFn    func(ctx context.Context, alias string) (*Link, error)
+	confirmFn    func(ctx context.Context, alias string) (*Link, error)
+	peekLinkFn   func(ctx context.Context, alias string) (*Link, error)
+	listLinksFn  func(ctx context.Context, owner string, limit int) ([]Link, error)
+	ownedLinkFn  func(ctx context.Context, owner, alias string) (*Link, error)
+	updateLinkFn func(ctx context.Context, owner, alias string, update LinkUpdate) (*Link, error)
+	brokenFn     func(ctx context.Context, owner string, limit int) ([]Link, error)
+	checksFn     func(ctx context.Context, owner, alias string) ([]LinkCheck, error)
+
+	variantClicks map[string]int64
+	refunds       []int64
 }
 
-func (m *mockRepo) Insert(ctx context.Context, url, alias string) (string, error) {
-	return m.insertFn(ctx, url, alias)
+func (m *mockRepo) Insert(ctx context.Context, link *Link) (string, error) {
+	return m.insertFn(ctx, link)
 }
 
-func (m *mockRepo) GetOriginalURL(ctx context.Context, alias string) (string, error) {
-	return m.getOriginalURLFn(ctx, alias)
+func (m *mockRepo) GetLink(ctx context.Context, alias string) (*Link, error) {
+	return m.getLinkFn(ctx, alias)
+}
+
+func (m *mockRepo) ConfirmLink(ctx context.Context, alias string) (*Link, error) {
+	return m.confirmFn(ctx, alias)
+}
+
+func (m *mockRepo) PeekLink(ctx context.Context, alias string) (*Link, error) {
+	return m.peekLinkFn(ctx, alias)
+}
+
+func (m *mockRepo) ListLinks(ctx context.Context, owner string, limit int) ([]Link, error) {
+	return m.listLinksFn(ctx, owner, limit)
+}
+
+func (m *mockRepo) GetOwnedLink(ctx context.Context, owner, alias string) (*Link, error) {
+	return m.ownedLinkFn(ctx, owner, alias)
+}
+
+func (m *mockRepo) UpdateLink(ctx context.Context, owner, alias string, update LinkUpdate) (*Link, error) {
+	return m.updateLinkFn(ctx, owner, alias, update)
+}
+
+func (m *mockRepo) ListBrokenLinks(ctx context.Context, owner string, limit int) ([]Link, error) {
+	return m.brokenFn(ctx, owner, limit)
+}
+
+func (m *mockRepo) ListLinkChecks(ctx context.Context, owner, alias string) ([]LinkCheck, error) {
+	return m.checksFn(ctx, owner, alias)
+}
+
+func (m *mockRepo) CountVariantClick(_ context.Context, _ int64, variant string) error {
+	if m.variantClicks == nil {
+		m.variantClicks = map[string]int64{}
+	}
+	m.variantClicks[variant]++
+	return nil
+}
+
+func (m *mockRepo) RefundClick(_ context.Context, linkID int64) error {
+	m.refunds = append(m.refunds, linkID)
+	return nil
 }
 
 func newTestEcho() *echo.Echo {
@@ -43,14 +97,15 @@ func TestShortenSuccess(t *testing.T) {
 		BaseURL: "http://localhost:8080",
 		Logger:  slog.New(slog.DiscardHandler),
 		Repo: &mockRepo{
-			insertFn: func(_ context.Context, url, alias string) (string, error) {
-				return alias, nil
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				require.Equal(t, "https://example.com/", link.CanonicalURL)
+				return link.Alias, nil
 			},
 		},
 	}
 
 	e := newTestEcho()
-	body := `{"url":"https://example.com"}`
+	body := `{"url":"HTTPS://Example.com"}`
 	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
@@ -113,7 +168,7 @@ func TestShortenRepoError(t *testing.T) {
 		BaseURL: "http://localhost:8080",
 		Logger:  slog.New(slog.DiscardHandler),
 		Repo: &mockRepo{
-			insertFn: func(_ context.Context, _, _ string) (string, error) {
+			insertFn: func(_ context.Context, _ *Link) (string, error) {
 				return "", fmt.Errorf("db connection failed")
 			},
 		},
@@ -136,8 +191,8 @@ func TestRedirectSuccess(t *testing.T) {
 	app := &Application{
 		Logger: slog.New(slog.DiscardHandler),
 		Repo: &mockRepo{
-			getOriginalURLFn: func(_ context.Context, _ string) (string, error) {
-				return "https://example.com", nil
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				return &Link{OriginalURL: "https://example.com"}, nil
 			},
 		},
 	}
@@ -161,11 +216,11 @@ func TestRedirectInvalidAlias(t *testing.T) {
 	}
 
 	e := newTestEcho()
-	req := httptest.NewRequest(http.MethodGet, "/r/short", nil)
+	req := httptest.NewRequest(http.MethodGet, "/r/sh.rt", nil)
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
 	c.SetParamNames("alias")
-	c.SetParamValues("short")
+	c.SetParamValues("sh.rt")
 
 	err := app.Redirect(c)
 	require.NoError(t, err)
@@ -176,8 +231,8 @@ func TestRedirectNotFound(t *testing.T) {
 	app := &Application{
 		Logger: slog.New(slog.DiscardHandler),
 		Repo: &mockRepo{
-			getOriginalURLFn: func(_ context.Context, _ string) (string, error) {
-				return "", ErrRecordNotFound
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				return nil, ErrRecordNotFound
 			},
 		},
 	}
@@ -202,8 +257,8 @@ func TestRedirectRepoError(t *testing.T) {
 	app := &Application{
 		Logger: slog.New(slog.DiscardHandler),
 		Repo: &mockRepo{
-			getOriginalURLFn: func(_ context.Context, _ string) (string, error) {
-				return "", fmt.Errorf("db timeout")
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				return nil, fmt.Errorf("db timeout")
 			},
 		},
 	}
@@ -276,3 +331,688 @@ func TestCustomHTTPErrorHandlerEntityTooLarge(t *testing.T) {
 	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
 	require.Equal(t, "request entity too large", resp["error"])
 }
+
+func TestRedirectKeepsAliasesOfOtherStrategies(t *testing.T) {
+	app := &Application{
+		Logger:  slog.New(slog.DiscardHandler),
+		Aliases: &WordAliasGenerator{Count: 2},
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, alias string) (*Link, error) {
+				require.NotEqual(t, "bad alias!", alias)
+				if alias == "bold-swan" || alias == "abcdefghijk" {
+					return &Link{OriginalURL: "https://example.com"}, nil
+				}
+				return nil, ErrRecordNotFound
+			},
+		},
+	}
+
+	e := newTestEcho()
+	for alias, code := range map[string]int{
+		"bold-swan":                           http.StatusSeeOther,
+		"abcdefghijk":                         http.StatusSeeOther,
+		"missing":                             http.StatusNotFound,
+		"bad alias!":                          http.StatusNotFound,
+		strings.Repeat("a", maxAliasLength+1): http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/r/"+url.PathEscape(alias), nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("alias")
+		c.SetParamValues(alias)
+
+		require.NoError(t, app.Redirect(c))
+		require.Equal(t, code, rec.Code, alias)
+	}
+}
+
+func TestShortenRetriesDuplicateAlias(t *testing.T) {
+	var aliases []string
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Aliases: &RandomAliasGenerator{Length: 8},
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				aliases = append(aliases, link.Alias)
+				if len(aliases) < 3 {
+					return "", ErrDuplicateAlias
+				}
+				return link.Alias, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://example.com"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	require.NoError(t, app.Shorten(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Len(t, aliases, 3)
+	require.NotEqual(t, aliases[0], aliases[1])
+}
+
+func TestShortenSaltsHashAliasRetries(t *testing.T) {
+	var aliases []string
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Aliases: &HashAliasGenerator{Length: 11},
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				aliases = append(aliases, link.Alias)
+				if len(aliases) < 2 {
+					return "", ErrDuplicateAlias
+				}
+				return link.Alias, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://example.com"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	require.NoError(t, app.Shorten(c))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Len(t, aliases, 2)
+	require.Equal(t, GenerateAlias("https://example.com/"), aliases[0])
+	require.NotEqual(t, aliases[0], aliases[1])
+}
+
+func TestShortenScopesAliasToOwner(t *testing.T) {
+	var links []*Link
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				links = append(links, link)
+				return link.Alias, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	for _, owner := range []string{"", "user:1", "user:2"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://example.com"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		require.NoError(t, app.Shorten(c))
+	}
+
+	require.Len(t, links, 3)
+	require.Equal(t, "", links[0].Owner)
+	require.Equal(t, GenerateAlias("https://example.com/"), links[0].Alias)
+	require.Equal(t, "user:1", links[1].Owner)
+	require.NotEqual(t, links[0].Alias, links[1].Alias)
+	require.NotEqual(t, links[1].Alias, links[2].Alias)
+}
+
+func TestReadyzWithoutDatabase(t *testing.T) {
+	app := &Application{Logger: slog.New(slog.DiscardHandler)}
+
+	e := newTestEcho()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	require.NoError(t, app.Readyz(c))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestRedirectUsesLinkPolicy(t *testing.T) {
+	tests := []struct {
+		link         Link
+		status       int
+		cacheControl string
+	}{
+		{Link{RedirectStatus: http.StatusMovedPermanently}, http.StatusMovedPermanently, "max-age=3600"},
+		{Link{RedirectStatus: http.StatusFound}, http.StatusFound, ""},
+		{Link{Owner: "user:1", RedirectStatus: http.StatusTemporaryRedirect}, http.StatusTemporaryRedirect, "no-store"},
+		{Link{Owner: "user:1", RedirectStatus: http.StatusPermanentRedirect, CacheControl: "public, max-age=3600"}, http.StatusPermanentRedirect, "public, max-age=3600"},
+	}
+	for _, tc := range tests {
+		app := &Application{
+			Logger:                  slog.New(slog.DiscardHandler),
+			PermanentRedirectMaxAge: time.Hour,
+			Repo: &mockRepo{
+				getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+					link := tc.link
+					link.OriginalURL = "https://example.com"
+					return &link, nil
+				},
+			},
+		}
+
+		e := newTestEcho()
+		req := httptest.NewRequest(http.MethodGet, "/r/abcdefghijk", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("alias")
+		c.SetParamValues("abcdefghijk")
+
+		require.NoError(t, app.Redirect(c))
+		require.Equal(t, tc.status, rec.Code)
+		require.Equal(t, tc.cacheControl, rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestShortenRedirectOptions(t *testing.T) {
+	var inserted *Link
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				inserted = link
+				return link.Alias, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	for body, code := range map[string]int{
+		`{"url":"https://example.com","redirect_status":308,"cache_control":"public, max-age=60"}`: http.StatusCreated,
+		`{"url":"https://example.com","redirect_status":304}`:                                      http.StatusUnprocessableEntity,
+		`{"url":"https://example.com","cache_control":"max-age=1\r\nX-Injected: 1"}`:               http.StatusUnprocessableEntity,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		require.NoError(t, app.Shorten(c))
+		require.Equal(t, code, rec.Code, body)
+	}
+	require.Equal(t, http.StatusPermanentRedirect, inserted.RedirectStatus)
+	require.Equal(t, "public, max-age=60", inserted.CacheControl)
+}
+
+func TestUpdateLinkAPI(t *testing.T) {
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			updateLinkFn: func(_ context.Context, owner, alias string, update LinkUpdate) (*Link, error) {
+				if alias != "abcdefghijk" {
+					return nil, ErrRecordNotFound
+				}
+				require.Equal(t, "user:1", owner)
+				require.Equal(t, http.StatusMovedPermanently, *update.RedirectStatus)
+				require.Nil(t, update.CacheControl)
+				return &Link{Owner: owner, Alias: alias, OriginalURL: "https://example.com", RedirectStatus: *update.RedirectStatus}, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	update := func(owner, alias, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/links/"+alias, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("alias")
+		c.SetParamValues(alias)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		if err := app.UpdateLinkAPI(c); err != nil {
+			app.CustomHTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	rec := update("user:1", "abcdefghijk", `{"redirect_status":301}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.EqualValues(t, http.StatusMovedPermanently, resp["redirect_status"])
+
+	require.Equal(t, http.StatusUnauthorized, update("", "abcdefghijk", `{"redirect_status":301}`).Code)
+	require.Equal(t, http.StatusNotFound, update("user:1", "missing", `{"redirect_status":301}`).Code)
+	require.Equal(t, http.StatusUnprocessableEntity, update("user:1", "abcdefghijk", `{"redirect_status":200}`).Code)
+	require.Equal(t, http.StatusUnprocessableEntity, update("user:1", "abcdefghijk", `{"cache_control":"bad value"}`).Code)
+}
+
+func TestRedirectPassthroughRoute(t *testing.T) {
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, alias string) (*Link, error) {
+				require.Equal(t, "abcdefghijk", alias)
+				return &Link{OriginalURL: "https://docs.example.com/v2", Passthrough: true}, nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+
+	resp, err := newClient().Get(server.URL + "/r/abcdefghijk/guide/intro?utm_source=qr")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "https://docs.example.com/v2/guide/intro?utm_source=qr", resp.Header.Get("Location"))
+}
+
+func TestTemplatedLink(t *testing.T) {
+	var stored *Link
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				stored = link
+				return link.Alias, nil
+			},
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				return stored, nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+	client := newClient()
+
+	resp, err := client.Post(server.URL+"/api/shorten", echo.MIMEApplicationJSON,
+		strings.NewReader(`{"url": "https://jira.example.com/browse/{1}", "template": true}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.True(t, stored.Template)
+
+	resp, err = client.Get(server.URL + "/r/" + stored.Alias + "/ABC-123")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "https://jira.example.com/browse/ABC-123", resp.Header.Get("Location"))
+
+	resp, err = client.Get(server.URL + "/r/" + stored.Alias)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Without the flag, braces are part of the destination.
+	resp, err = client.Post(server.URL+"/api/shorten", echo.MIMEApplicationJSON,
+		strings.NewReader(`{"url": "https://example.com/wiki/{1}"}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.False(t, stored.Template)
+
+	resp, err = client.Get(server.URL + "/r/" + stored.Alias)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "https://example.com/wiki/{1}", resp.Header.Get("Location"))
+
+	resp, err = client.Post(server.URL+"/api/shorten", echo.MIMEApplicationJSON,
+		strings.NewReader(`{"url": "https://example.com/wiki", "template": true}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestRedirectRules(t *testing.T) {
+	geoIP, err := LoadGeoIP(writeTestGeoIP(t, map[string]string{"192.0.2.0/24": "DE"}))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, geoIP.Close()) })
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		GeoIP:  geoIP,
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				return &Link{
+					OriginalURL: "https://example.com/",
+					Rules: []Rule{
+						{Countries: []string{"DE"}, URL: "https://example.de/"},
+						{Devices: []string{DeviceMobile}, URL: "https://m.example.com/"},
+					},
+				}, nil
+			},
+		},
+	}
+
+	tests := []struct {
+		remoteAddr string
+		userAgent  string
+		want       string
+	}{
+		{"192.0.2.10:1234", "curl/8.8.0", "https://example.de/"},
+		{"198.51.100.10:1234", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) Mobile/15E148", "https://m.example.com/"},
+		{"198.51.100.10:1234", "curl/8.8.0", "https://example.com/"},
+	}
+	for _, tc := range tests {
+		e := newTestEcho()
+		req := httptest.NewRequest(http.MethodGet, "/r/abcdefghijk", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("User-Agent", tc.userAgent)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("alias")
+		c.SetParamValues("abcdefghijk")
+
+		require.NoError(t, app.Redirect(c))
+		require.Equal(t, tc.want, rec.Header().Get("Location"))
+		require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestRedirectVariants(t *testing.T) {
+	repo := &mockRepo{
+		getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+			return &Link{
+				ID:          1,
+				Alias:       "abcdefghijk",
+				OriginalURL: "https://example.com/",
+				Variants: []Variant{
+					{Name: "a", URL: "https://example.com/a", Weight: 1},
+					{Name: "b", URL: "https://example.com/b", Weight: 1},
+				},
+			}, nil
+		},
+	}
+	app := &Application{Logger: slog.New(slog.DiscardHandler), Repo: repo}
+
+	redirect := func(cookie string) *httptest.ResponseRecorder {
+		e := newTestEcho()
+		req := httptest.NewRequest(http.MethodGet, "/r/abcdefghijk", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: variantCookieName("abcdefghijk"), Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("alias")
+		c.SetParamValues("abcdefghijk")
+		require.NoError(t, app.Redirect(c))
+		return rec
+	}
+
+	rec := redirect("")
+	location := rec.Header().Get("Location")
+	require.Contains(t, []string{"https://example.com/a", "https://example.com/b"}, location)
+	require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, "/r/abcdefghijk", cookies[0].Path)
+	require.Equal(t, "https://example.com/"+cookies[0].Value, location)
+
+	other := map[string]string{"a": "b", "b": "a"}[cookies[0].Value]
+	rec = redirect(other)
+	require.Equal(t, "https://example.com/"+other, rec.Header().Get("Location"))
+	require.Empty(t, rec.Result().Cookies())
+
+	require.Equal(t, map[string]int64{cookies[0].Value: 1, other: 1}, repo.variantClicks)
+}
+
+func TestRedirectActivationWindow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		link     Link
+		status   int
+		location string
+		body     string
+	}{
+		{"pending", Link{ActiveFrom: now.Add(time.Hour)}, http.StatusNotFound, "", "could not be found"},
+		{"coming soon", Link{ActiveFrom: now.Add(time.Hour), BeforeActive: BeforeActiveComingSoon}, http.StatusOK, "", "Coming soon"},
+		{"active", Link{ActiveFrom: now.Add(-time.Hour), ActiveUntil: now.Add(time.Hour)}, http.StatusSeeOther, "https://example.com/launch", ""},
+		{"expired", Link{ActiveUntil: now.Add(-time.Hour)}, http.StatusGone, "", "expired"},
+		{"expired with fallback", Link{ActiveUntil: now.Add(-time.Hour), ExpiredURL: "https://example.com/archive"}, http.StatusFound, "https://example.com/archive", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &Application{
+				Logger: slog.New(slog.DiscardHandler),
+				Repo: &mockRepo{
+					getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+						link := tc.link
+						link.OriginalURL = "https://example.com/launch"
+						return &link, nil
+					},
+				},
+			}
+			server := httptest.NewServer(app.Router())
+			t.Cleanup(server.Close)
+
+			resp, err := newClient().Get(server.URL + "/r/abcdefghijk")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, tc.status, resp.StatusCode)
+			require.Equal(t, tc.location, resp.Header.Get("Location"))
+			require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+			require.Contains(t, string(body), tc.body)
+		})
+	}
+}
+
+func TestOneTimeLink(t *testing.T) {
+	link := &Link{ID: 1, OriginalURL: "https://example.com/onboarding", RedirectStatus: http.StatusPermanentRedirect, MaxClicks: 1, OneTime: true}
+	used := false
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				if used {
+					return nil, ErrClickLimitReached
+				}
+				return link, nil
+			},
+			confirmFn: func(_ context.Context, _ string) (*Link, error) {
+				if used {
+					return nil, ErrClickLimitReached
+				}
+				used = true
+				return link, nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+	client := newClient()
+
+	// Unfurl bots only fetch the page.
+	for range 2 {
+		resp, err := client.Get(server.URL + "/r/abcdefghijk?ref=chat")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+		require.Contains(t, string(body), `action="/r/abcdefghijk?ref=chat"`)
+	}
+	require.False(t, used)
+
+	resp, err := client.Post(server.URL+"/r/abcdefghijk?ref=chat", "application/x-www-form-urlencoded", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "https://example.com/onboarding", resp.Header.Get("Location"))
+	require.True(t, used)
+
+	resp, err = client.Get(server.URL + "/r/abcdefghijk")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestOneTimeLinkRefundsFailedVisits(t *testing.T) {
+	link := &Link{ID: 7, OriginalURL: "https://jira.example.com/browse/{1}", Template: true, MaxClicks: 1, OneTime: true}
+	repo := &mockRepo{}
+	clicks := 0
+	repo.confirmFn = func(_ context.Context, _ string) (*Link, error) {
+		if clicks-len(repo.refunds) >= link.MaxClicks {
+			return nil, ErrClickLimitReached
+		}
+		clicks++
+		return link, nil
+	}
+	app := &Application{Logger: slog.New(slog.DiscardHandler), Repo: repo}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+	client := newClient()
+
+	// Without the value for its placeholder, the link cannot redirect, so
+	// its single use is given back.
+	resp, err := client.Post(server.URL+"/r/abcdefghijk", "application/x-www-form-urlencoded", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, []int64{7}, repo.refunds)
+
+	resp, err = client.Post(server.URL+"/r/abcdefghijk/ABC-1", "application/x-www-form-urlencoded", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "https://jira.example.com/browse/ABC-1", resp.Header.Get("Location"))
+	require.Len(t, repo.refunds, 1)
+
+	resp, err = client.Post(server.URL+"/r/abcdefghijk/ABC-1", "application/x-www-form-urlencoded", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestShortenClickLimit(t *testing.T) {
+	var inserted []*Link
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				inserted = append(inserted, link)
+				return link.Alias, nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+
+	shorten := func(body string) int {
+		resp, err := http.Post(server.URL+"/api/shorten", echo.MIMEApplicationJSON, strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusCreated, shorten(`{"url": "https://example.com/onboarding", "one_time": true}`))
+	require.Equal(t, http.StatusCreated, shorten(`{"url": "https://example.com/onboarding", "max_clicks": 5}`))
+	require.Equal(t, http.StatusUnprocessableEntity, shorten(`{"url": "https://example.com/onboarding", "one_time": true, "max_clicks": 5}`))
+	require.Equal(t, http.StatusUnprocessableEntity, shorten(`{"url": "https://example.com/onboarding", "max_clicks": -1}`))
+
+	require.Len(t, inserted, 2)
+	require.Equal(t, 1, inserted[0].MaxClicks)
+	require.True(t, inserted[0].OneTime)
+	require.Equal(t, 5, inserted[1].MaxClicks)
+	require.NotEqual(t, inserted[0].Alias, inserted[1].Alias, "limited links get their own alias")
+}
+
+func TestLinkStatsAPI(t *testing.T) {
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			ownedLinkFn: func(_ context.Context, owner, alias string) (*Link, error) {
+				if owner != "user:1" || alias != "abcdefghijk" {
+					return nil, ErrRecordNotFound
+				}
+				return &Link{
+					Alias:         alias,
+					Clicks:        7,
+					Variants:      []Variant{{Name: "a", URL: "https://example.com/a", Weight: 1}},
+					VariantClicks: map[string]int64{"a": 5},
+				}, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	get := func(owner, alias string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.SetParamNames("alias")
+		c.SetParamValues(alias)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		if err := app.LinkStatsAPI(c); err != nil {
+			app.CustomHTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	rec := get("user:1", "abcdefghijk")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"alias":"abcdefghijk","clicks":7,"variants":[{"name":"a","url":"https://example.com/a","weight":1,"clicks":5}]}`, rec.Body.String())
+	require.Equal(t, http.StatusNotFound, get("user:2", "abcdefghijk").Code)
+	require.Equal(t, http.StatusUnauthorized, get("", "abcdefghijk").Code)
+}
+
+func TestShortenRoutingOptions(t *testing.T) {
+	var stored []*Link
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				copied := *link
+				stored = append(stored, &copied)
+				return link.Alias, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	shorten := func(owner, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := e.NewContext(req, rec)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		if err := app.Shorten(c); err != nil {
+			app.CustomHTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	for _, body := range []string{
+		`{"url":"https://example.com/","rules":[{"countries":["DE"],"url":"https://example.de/"}]}`,
+		`{"url":"https://example.com/","variants":[{"name":"a","url":"https://example.com/a","weight":1},{"name":"b","url":"https://example.com/b","weight":1}]}`,
+		`{"url":"https://example.com/","ios_url":"myapp://home"}`,
+		`{"url":"https://example.com/","expired_url":"https://example.com/over"}`,
+		`{"url":"https://example.com/","fallback_url":"https://example.com/mirror"}`,
+	} {
+		rec := shorten("", body)
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code, body)
+		require.Contains(t, rec.Body.String(), ErrAnonymousRouting.Error(), body)
+	}
+	require.Empty(t, stored)
+
+	// Links with settings get an alias of their own, even for the same URL
+	// and settings.
+	for range 2 {
+		rec := shorten("user:1", `{"url":"https://example.com/","rules":[{"countries":["DE"],"url":"https://example.de/"}]}`)
+		require.Equal(t, http.StatusCreated, rec.Code)
+	}
+	require.Len(t, stored, 2)
+	require.Len(t, stored[0].Rules, 1)
+	require.NotEqual(t, stored[0].Alias, stored[1].Alias)
+
+	// Plain links share theirs.
+	for range 2 {
+		rec := shorten("user:1", `{"url":"https://example.com/"}`)
+		require.Equal(t, http.StatusCreated, rec.Code)
+	}
+	require.Len(t, stored, 4)
+	require.Equal(t, stored[2].Alias, stored[3].Alias)
+}
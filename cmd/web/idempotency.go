@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+type IdempotencyRecord struct {
+	RequestHash string
+	// StatusCode is zero while the first request is still being processed.
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims the key for a new request and returns nil,
+	// or returns the record stored by an earlier request with the same key.
+	ReserveIdempotencyKey(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, scope, key string, record IdempotencyRecord) error
+	ReleaseIdempotencyKey(ctx context.Context, scope, key string) error
+}
+
+// Idempotent makes a mutating endpoint safe to retry. The first response
+// for an Idempotency-Key is stored for IdempotencyTTL and replayed for retries
+// with the same body; reusing the key with a different body is rejected.
+// Server errors are not stored, so the request can be retried.
+func (app *Application) Idempotent() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(HeaderIdempotencyKey)
+			if key == "" || app.Idempotency == nil {
+				return next(c)
+			}
+			if len(key) > 255 {
+				return echo.NewHTTPError(http.StatusBadRequest, "idempotency key must be at most 255 characters long")
+			}
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return err
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+			req := c.Request()
+			scope := req.Method + " " + c.Path() + " " + idempotencyIdentity(c)
+			sum := sha256.Sum256(body)
+			requestHash := hex.EncodeToString(sum[:])
+
+			ttl := app.IdempotencyTTL
+			if ttl == 0 {
+				ttl = 24 * time.Hour
+			}
+
+			record, err := app.Idempotency.ReserveIdempotencyKey(req.Context(), scope, key, requestHash, ttl)
+			if err != nil {
+				return err
+			}
+			if record != nil {
+				if record.RequestHash != requestHash {
+					return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "idempotency key has already been used with a different request"})
+				}
+				if record.StatusCode == 0 {
+					return echo.NewHTTPError(http.StatusConflict, "a request with this idempotency key is still being processed")
+				}
+				c.Response().Header().Set("Idempotent-Replayed", "true")
+				return c.Blob(record.StatusCode, record.ContentType, record.Body)
+			}
+
+			rec := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rec
+
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			// The request context may already be cancelled at this point, but
+			// the outcome still has to be recorded.
+			ctx := context.WithoutCancel(req.Context())
+			status := c.Response().Status
+			if status >= http.StatusInternalServerError {
+				if err := app.Idempotency.ReleaseIdempotencyKey(ctx, scope, key); err != nil {
+					app.Logger.Error("failed to release idempotency key", "error", err)
+				}
+				return nil
+			}
+			err = app.Idempotency.CompleteIdempotencyKey(ctx, scope, key, IdempotencyRecord{
+				RequestHash: requestHash,
+				StatusCode:  status,
+				ContentType: c.Response().Header().Get(echo.HeaderContentType),
+				Body:        rec.body.Bytes(),
+			})
+			if err != nil {
+				app.Logger.Error("failed to store idempotent response", "error", err)
+			}
+			return nil
+		}
+	}
+}
+
+// idempotencyIdentity scopes keys to the API token or logged-in user of the
+// caller and to the namespace the link is created in, so that two clients can
+// never replay each other's responses. Anonymous callers can only be told
+// apart by their IP, so their retries are replayed only from the same address.
+func idempotencyIdentity(c echo.Context) string {
+	identity := "ip:" + c.RealIP()
+	if token := currentToken(c); token != nil {
+		identity = fmt.Sprintf("token:%d", token.ID)
+	} else if user := currentUser(c); user != nil {
+		identity = userOwner(user.ID)
+	}
+	if owner := linkOwner(c); owner != "" && owner != identity {
+		identity += " " + owner
+	}
+	return identity
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+func (s *memoryIdempotencyStore) ReserveIdempotencyKey(_ context.Context, scope, key, requestHash string, _ time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[scope+key]; ok {
+		return &record, nil
+	}
+	s.records[scope+key] = IdempotencyRecord{RequestHash: requestHash}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) CompleteIdempotencyKey(_ context.Context, scope, key string, record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[scope+key] = record
+	return nil
+}
+
+func (s *memoryIdempotencyStore) ReleaseIdempotencyKey(_ context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, scope+key)
+	return nil
+}
+
+func newIdempotencyTestEcho(app *Application, handler echo.HandlerFunc) *echo.Echo {
+	e := newTestEcho()
+	e.HTTPErrorHandler = app.CustomHTTPErrorHandler
+	e.POST("/things", handler, app.Idempotent())
+	return e
+}
+
+func postWithKey(e *echo.Echo, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if key != "" {
+		req.Header.Set(HeaderIdempotencyKey, key)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	app := &Application{
+		Logger:      slog.New(slog.DiscardHandler),
+		Idempotency: &memoryIdempotencyStore{records: map[string]IdempotencyRecord{}},
+	}
+	calls := 0
+	e := newIdempotencyTestEcho(app, func(c echo.Context) error {
+		calls++
+		return c.JSON(http.StatusCreated, map[string]int{"call": calls})
+	})
+
+	rec := postWithKey(e, "k1", `{"a":1}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.JSONEq(t, `{"call":1}`, rec.Body.String())
+
+	rec = postWithKey(e, "k1", `{"a":1}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.JSONEq(t, `{"call":1}`, rec.Body.String())
+	require.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	require.Equal(t, echo.MIMEApplicationJSON, rec.Header().Get(echo.HeaderContentType))
+
+	rec = postWithKey(e, "k1", `{"a":2}`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = postWithKey(e, "", `{"a":1}`)
+	require.JSONEq(t, `{"call":2}`, rec.Body.String())
+
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotentStoresClientErrors(t *testing.T) {
+	app := &Application{
+		Logger:      slog.New(slog.DiscardHandler),
+		Idempotency: &memoryIdempotencyStore{records: map[string]IdempotencyRecord{}},
+	}
+	calls := 0
+	e := newIdempotencyTestEcho(app, func(c echo.Context) error {
+		calls++
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	})
+
+	rec := postWithKey(e, "k1", `{}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = postWithKey(e, "k1", `{}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.JSONEq(t, `{"error":"bad request"}`, rec.Body.String())
+	require.Equal(t, 1, calls)
+}
+
+func TestIdempotentReleasesOnServerError(t *testing.T) {
+	app := &Application{
+		Logger:      slog.New(slog.DiscardHandler),
+		Idempotency: &memoryIdempotencyStore{records: map[string]IdempotencyRecord{}},
+	}
+	calls := 0
+	e := newIdempotencyTestEcho(app, func(c echo.Context) error {
+		calls++
+		if calls == 1 {
+			return fmt.Errorf("db timeout")
+		}
+		return c.NoContent(http.StatusCreated)
+	})
+
+	rec := postWithKey(e, "k1", `{}`)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	rec = postWithKey(e, "k1", `{}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	store := &memoryIdempotencyStore{records: map[string]IdempotencyRecord{}}
+	app := &Application{
+		Logger:      slog.New(slog.DiscardHandler),
+		Idempotency: store,
+	}
+	e := newIdempotencyTestEcho(app, func(c echo.Context) error {
+		rec := postWithKey(c.Echo(), "k1", `{}`)
+		require.Equal(t, http.StatusConflict, rec.Code)
+		return c.NoContent(http.StatusCreated)
+	})
+
+	rec := postWithKey(e, "k1", `{}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+}
+
+func TestIdempotentScopesAnonymousCallersByIP(t *testing.T) {
+	app := &Application{
+		Logger:      slog.New(slog.DiscardHandler),
+		Idempotency: &memoryIdempotencyStore{records: map[string]IdempotencyRecord{}},
+	}
+	calls := 0
+	e := newIdempotencyTestEcho(app, func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, fmt.Sprintf("call %d", calls))
+	})
+
+	post := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(`{}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(HeaderIdempotencyKey, "k1")
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, "call 1", post("192.0.2.1").Body.String())
+	// Another anonymous caller using the same key gets its own response.
+	rec := post("192.0.2.2")
+	require.Equal(t, "call 2", rec.Body.String())
+	require.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	rec = post("192.0.2.1")
+	require.Equal(t, "call 1", rec.Body.String())
+	require.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+}
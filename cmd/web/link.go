@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRedirectStatus is used for links created without a redirect status.
+// 303 See Other makes clients follow the redirect with a GET.
+const DefaultRedirectStatus = 303
+
+var redirectStatuses = []int{301, 302, 303, 307, 308}
+
+func validRedirectStatus(code int) bool {
+	return slices.Contains(redirectStatuses, code)
+}
+
+// How a passthrough link merges a query parameter that both the short URL
+// and the destination have.
+const (
+	// QueryOverride replaces the destination's values.
+	QueryOverride = "override"
+	// QueryKeep ignores the values of the short URL.
+	QueryKeep = "keep"
+	// QueryAppend sends both, the destination's values first.
+	QueryAppend = "append"
+)
+
+// ErrNoPassthrough is returned for a short URL with extra path segments that
+// its link does not forward.
+var ErrNoPassthrough = errors.New("link does not accept extra path segments")
+
+// LinkUpdate holds the changes to make to a link. Nil fields are left alone.
+type LinkUpdate struct {
+	RedirectStatus *int
+	CacheControl   *string
+	Passthrough    *bool
+	QueryConflict  *string
+	// Rules replaces all the rules of the link; an empty slice removes them.
+	Rules *[]Rule
+	// Variants replaces all the variants of the link; an empty slice removes
+	// them.
+	Variants   *[]Variant
+	IOSURL     *string
+	AndroidURL *string
+	// ActiveFrom and ActiveUntil pointing to the zero time remove the bound.
+	ActiveFrom   *time.Time
+	ActiveUntil  *time.Time
+	BeforeActive *string
+	ExpiredURL   *string
+	// MaxClicks pointing to 0 removes the click limit.
+	MaxClicks *int
+	OneTime   *bool
+	// Preview replaces all of the preview of the link.
+	Preview *LinkPreview
+	// FallbackURL pointing to "" removes the fallback.
+	FallbackURL *string
+}
+
+var (
+	ErrClickLimitReached = errors.New("link has reached its click limit")
+	ErrInvalidMaxClicks  = errors.New("max_clicks must not be negative")
+	ErrInvalidOneTime    = errors.New("one-time links must have a max_clicks of 1")
+)
+
+// What a link shows before its activation window opens.
+const (
+	BeforeActiveNotFound   = "not_found"
+	BeforeActiveComingSoon = "coming_soon"
+)
+
+// ErrInvalidActiveWindow is returned for activation windows that close
+// before they open.
+var ErrInvalidActiveWindow = errors.New("active_until must be after active_from")
+
+// Plain reports whether the link has no settings beyond its destination.
+// Shortening the same URL again hands out the existing plain link; any other
+// link would impose its settings on callers that did not ask for them.
+func (l *Link) Plain() bool {
+	return (l.RedirectStatus == 0 || l.RedirectStatus == DefaultRedirectStatus) && l.CacheControl == "" &&
+		!l.Passthrough && (l.QueryConflict == "" || l.QueryConflict == QueryOverride) && !l.Template &&
+		len(l.Rules) == 0 && len(l.Variants) == 0 && l.IOSURL == "" && l.AndroidURL == "" &&
+		l.ActiveFrom.IsZero() && l.ActiveUntil.IsZero() && (l.BeforeActive == "" || l.BeforeActive == BeforeActiveNotFound) &&
+		l.ExpiredURL == "" && l.MaxClicks == 0 && !l.OneTime && l.Preview == LinkPreview{} && l.FallbackURL == ""
+}
+
+// Where a link is relative to its activation window.
+const (
+	LinkPending = "pending"
+	LinkActive  = "active"
+	LinkExpired = "expired"
+)
+
+// Phase returns where now is relative to the activation window of the link.
+func (l *Link) Phase(now time.Time) string {
+	switch {
+	case !l.ActiveFrom.IsZero() && now.Before(l.ActiveFrom):
+		return LinkPending
+	case !l.ActiveUntil.IsZero() && !now.Before(l.ActiveUntil):
+		return LinkExpired
+	}
+	return LinkActive
+}
+
+// NullableTime is a time in a JSON request that tells a missing field from
+// null, which clears the time.
+type NullableTime struct {
+	Set  bool
+	Time time.Time
+}
+
+func (t *NullableTime) UnmarshalJSON(b []byte) error {
+	t.Set = true
+	if string(b) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	return json.Unmarshal(b, &t.Time)
+}
+
+// Ptr returns nil when the field was missing and the time otherwise.
+func (t NullableTime) Ptr() *time.Time {
+	if !t.Set {
+		return nil
+	}
+	return &t.Time
+}
+
+var cacheDirectivePattern = regexp.MustCompile(`^[a-z-]+(=[0-9]+)?$`)
+
+// validCacheControl reports whether s is a comma separated list of
+// Cache-Control directives, such as "public, max-age=3600".
+func validCacheControl(s string) bool {
+	if s == "" {
+		return true
+	}
+	for directive := range strings.SplitSeq(s, ",") {
+		if !cacheDirectivePattern.MatchString(strings.TrimSpace(directive)) {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultPermanentRedirectMaxAge is how long browsers may cache permanent
+// redirects that have no lifetime of their own.
+const DefaultPermanentRedirectMaxAge = 24 * time.Hour
+
+// CachePolicy returns the Cache-Control header to send with redirects to the
+// link, or "" to send none. A cached redirect keeps working after the link
+// changes, so links that their owner can edit send no-store unless the owner
+// asked for something else. So do links with rules, variants or app URLs,
+// whose redirects depend on the visitor, and links with a fallback URL, whose
+// redirects change when the destination breaks. Links with an activation window
+// always send no-store, as a cached answer would outlive the window, and so
+// do click-limited links, as caches would let visitors past the limit.
+//
+// Browsers keep 301 and 308 redirects forever when nothing says otherwise,
+// so permanent redirects whose policy sets no lifetime get a max-age of
+// permanentMaxAge.
+func (l *Link) CachePolicy(permanentMaxAge time.Duration) string {
+	policy := l.cachePolicy()
+	if l.RedirectStatus != http.StatusMovedPermanently && l.RedirectStatus != http.StatusPermanentRedirect {
+		return policy
+	}
+	for directive := range strings.SplitSeq(policy, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "max-age" || name == "no-store" || name == "no-cache" {
+			return policy
+		}
+	}
+	maxAge := fmt.Sprintf("max-age=%d", int64(permanentMaxAge/time.Second))
+	if policy == "" {
+		return maxAge
+	}
+	return policy + ", " + maxAge
+}
+
+func (l *Link) cachePolicy() string {
+	if !l.ActiveFrom.IsZero() || !l.ActiveUntil.IsZero() || l.MaxClicks > 0 {
+		return "no-store"
+	}
+	if l.CacheControl != "" {
+		return l.CacheControl
+	}
+	if l.Owner != "" || len(l.Rules) > 0 || len(l.Variants) > 0 || l.IOSURL != "" || l.AndroidURL != "" || l.FallbackURL != "" {
+		return "no-store"
+	}
+	return ""
+}
+
+// Destination returns the URL to redirect to. extraPath is the escaped path
+// that followed the alias in the short URL, if any, and query its query
+// parameters. Templated links fill their placeholders from them; otherwise
+// they are only forwarded by passthrough links.
+func (l *Link) Destination(extraPath string, query url.Values) (string, error) {
+	if l.Template {
+		return l.templateDestination(extraPath, query)
+	}
+	if !l.Passthrough {
+		if extraPath != "" {
+			return "", ErrNoPassthrough
+		}
+		return l.OriginalURL, nil
+	}
+
+	u, err := url.Parse(l.OriginalURL)
+	if err != nil {
+		return "", err
+	}
+	if extraPath != "" {
+		// Dot segments, even escaped ones, would let the short URL climb out
+		// of the destination's path.
+		for segment := range strings.SplitSeq(extraPath, "/") {
+			if unescaped, err := url.PathUnescape(segment); err != nil || unescaped == "." || unescaped == ".." {
+				return "", ErrNoPassthrough
+			}
+		}
+		u = u.JoinPath(extraPath)
+	}
+	l.mergeQuery(u, query)
+	return u.String(), nil
+}
+
+func (l *Link) mergeQuery(u *url.URL, query url.Values) {
+	if len(query) == 0 {
+		return
+	}
+	merged := u.Query()
+	for key, values := range query {
+		switch {
+		case !merged.Has(key) || l.QueryConflict == QueryOverride || l.QueryConflict == "":
+			merged[key] = values
+		case l.QueryConflict == QueryAppend:
+			merged[key] = append(merged[key], values...)
+		}
+	}
+	u.RawQuery = merged.Encode()
+}
+
+// placeholderPattern matches the placeholders of templated destinations:
+// {1}, {2}, ... stand for the path segments after the alias and {name} for
+// the query parameter name of the short URL.
+var placeholderPattern = regexp.MustCompile(`\{([1-9][0-9]*|[A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ErrMissingTemplateValue is returned when the short URL of a templated link
+// lacks the value for one of its placeholders.
+var ErrMissingTemplateValue = errors.New("missing value for placeholder")
+
+// ErrNoPlaceholders is returned for a templated link whose destination has no
+// placeholders.
+var ErrNoPlaceholders = errors.New("template destination must have a placeholder")
+
+// validTemplate reports whether destination has placeholders to fill in.
+func validTemplate(destination string) bool {
+	return placeholderPattern.MatchString(destination)
+}
+
+func (l *Link) templateDestination(extraPath string, query url.Values) (string, error) {
+	var segments []string
+	if extraPath = strings.Trim(extraPath, "/"); extraPath != "" {
+		for segment := range strings.SplitSeq(extraPath, "/") {
+			unescaped, err := url.PathUnescape(segment)
+			if err != nil {
+				return "", ErrNoPassthrough
+			}
+			segments = append(segments, unescaped)
+		}
+	}
+
+	tmpl := l.OriginalURL
+	queryStart := strings.IndexAny(tmpl, "?#")
+	if queryStart < 0 {
+		queryStart = len(tmpl)
+	}
+	fragmentStart := strings.IndexByte(tmpl, '#')
+	if fragmentStart < 0 {
+		fragmentStart = len(tmpl)
+	}
+
+	var b strings.Builder
+	usedSegments := 0
+	usedParams := make(map[string]bool)
+	last := 0
+	for _, m := range placeholderPattern.FindAllStringSubmatchIndex(tmpl, -1) {
+		name := tmpl[m[2]:m[3]]
+		var value string
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > len(segments) {
+				return "", fmt.Errorf("%w {%s}", ErrMissingTemplateValue, name)
+			}
+			value = segments[n-1]
+			usedSegments = max(usedSegments, n)
+		} else {
+			if !query.Has(name) {
+				return "", fmt.Errorf("%w {%s}", ErrMissingTemplateValue, name)
+			}
+			value = query.Get(name)
+			usedParams[name] = true
+		}
+
+		b.WriteString(tmpl[last:m[0]])
+		switch {
+		case m[0] > queryStart && m[0] < fragmentStart:
+			b.WriteString(url.QueryEscape(value))
+		case value == "." || value == "..":
+			return "", ErrNoPassthrough
+		default:
+			b.WriteString(url.PathEscape(value))
+		}
+		last = m[1]
+	}
+	b.WriteString(tmpl[last:])
+
+	if len(segments) > usedSegments {
+		return "", ErrNoPassthrough
+	}
+	u, err := url.Parse(b.String())
+	if err != nil {
+		return "", err
+	}
+	if l.Passthrough {
+		rest := make(url.Values)
+		for key, values := range query {
+			if !usedParams[key] {
+				rest[key] = values
+			}
+		}
+		l.mergeQuery(u, rest)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidCacheControl(t *testing.T) {
+	for s, want := range map[string]bool{
+		"":                                  true,
+		"no-store":                          true,
+		"public, max-age=3600":              true,
+		"private,max-age=0,must-revalidate": true,
+		"max-age=abc":                       false,
+		"public;":                           false,
+		"no-store\r\nSet-Cookie: a=b":       false,
+		"public,":                           false,
+	} {
+		require.Equal(t, want, validCacheControl(s), s)
+	}
+}
+
+func TestLinkCachePolicy(t *testing.T) {
+	day := 24 * time.Hour
+	require.Equal(t, "", (&Link{}).CachePolicy(day))
+	require.Equal(t, "public, max-age=60", (&Link{CacheControl: "public, max-age=60"}).CachePolicy(day))
+	require.Equal(t, "no-store", (&Link{Owner: "user:1"}).CachePolicy(day))
+	require.Equal(t, "max-age=60", (&Link{Owner: "user:1", CacheControl: "max-age=60"}).CachePolicy(day))
+	require.Equal(t, "no-store", (&Link{Rules: []Rule{{Countries: []string{"DE"}}}}).CachePolicy(day))
+	require.Equal(t, "no-store", (&Link{CacheControl: "max-age=60", ActiveUntil: time.Now()}).CachePolicy(day))
+
+	// Permanent redirects always get a lifetime.
+	require.Equal(t, "max-age=86400", (&Link{RedirectStatus: http.StatusMovedPermanently}).CachePolicy(day))
+	require.Equal(t, "max-age=3600", (&Link{RedirectStatus: http.StatusPermanentRedirect}).CachePolicy(time.Hour))
+	require.Equal(t, "public, max-age=86400", (&Link{RedirectStatus: http.StatusMovedPermanently, CacheControl: "public"}).CachePolicy(day))
+	require.Equal(t, "public, max-age=60", (&Link{RedirectStatus: http.StatusMovedPermanently, CacheControl: "public, max-age=60"}).CachePolicy(day))
+	require.Equal(t, "no-store", (&Link{RedirectStatus: http.StatusMovedPermanently, Owner: "user:1"}).CachePolicy(day))
+	require.Equal(t, "", (&Link{RedirectStatus: http.StatusFound}).CachePolicy(day))
+}
+
+func TestLinkDestination(t *testing.T) {
+	tests := []struct {
+		name      string
+		link      Link
+		extraPath string
+		query     string
+		want      string
+		err       error
+	}{
+		{"plain", Link{OriginalURL: "https://example.com/a?x=1"}, "", "y=2", "https://example.com/a?x=1", nil},
+		{"plain with path", Link{OriginalURL: "https://example.com/a"}, "/b", "", "", ErrNoPassthrough},
+		{"path", Link{OriginalURL: "https://docs.example.com/v2/", Passthrough: true}, "/guide/intro", "", "https://docs.example.com/v2/guide/intro", nil},
+		{"trailing slash", Link{OriginalURL: "https://docs.example.com", Passthrough: true}, "/guide/", "", "https://docs.example.com/guide/", nil},
+		{"escaped path", Link{OriginalURL: "https://example.com/files", Passthrough: true}, "/a%20b", "", "https://example.com/files/a%20b", nil},
+		{"dot segment", Link{OriginalURL: "https://example.com/a/b", Passthrough: true}, "/../c", "", "", ErrNoPassthrough},
+		{"escaped dot segment", Link{OriginalURL: "https://example.com/a/b", Passthrough: true}, "/%2e%2E/c", "", "", ErrNoPassthrough},
+		{"query override", Link{OriginalURL: "https://example.com/?utm_source=print&id=1", Passthrough: true, QueryConflict: QueryOverride}, "", "utm_source=mail", "https://example.com/?id=1&utm_source=mail", nil},
+		{"query keep", Link{OriginalURL: "https://example.com/?utm_source=print", Passthrough: true, QueryConflict: QueryKeep}, "", "utm_source=mail&ref=x", "https://example.com/?ref=x&utm_source=print", nil},
+		{"query append", Link{OriginalURL: "https://example.com/?tag=a", Passthrough: true, QueryConflict: QueryAppend}, "", "tag=b", "https://example.com/?tag=a&tag=b", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			require.NoError(t, err)
+			got, err := tc.link.Destination(tc.extraPath, query)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestTemplateDestination(t *testing.T) {
+	tests := []struct {
+		name      string
+		link      Link
+		extraPath string
+		query     string
+		want      string
+		err       error
+	}{
+		{"segment", Link{OriginalURL: "https://jira.example.com/browse/{1}", Template: true}, "/ABC-123", "", "https://jira.example.com/browse/ABC-123", nil},
+		{"segment is escaped", Link{OriginalURL: "https://example.com/users/{1}/posts", Template: true}, "/a%2Fb%20c", "", "https://example.com/users/a%2Fb%20c/posts", nil},
+		{"several segments", Link{OriginalURL: "https://github.com/{1}/{2}/pulls", Template: true}, "/golang/go", "", "https://github.com/golang/go/pulls", nil},
+		{"query parameter", Link{OriginalURL: "https://example.com/search?q={q}", Template: true}, "", "q=a%26b+c", "https://example.com/search?q=a%26b+c", nil},
+		{"segment in query", Link{OriginalURL: "https://example.com/search?q={1}&lang=en", Template: true}, "/x y", "", "https://example.com/search?q=x+y&lang=en", nil},
+		{"missing segment", Link{OriginalURL: "https://jira.example.com/browse/{1}", Template: true}, "", "", "", ErrMissingTemplateValue},
+		{"missing parameter", Link{OriginalURL: "https://example.com/search?q={q}", Template: true}, "", "x=1", "", ErrMissingTemplateValue},
+		{"extra segment", Link{OriginalURL: "https://jira.example.com/browse/{1}", Template: true}, "/ABC-1/more", "", "", ErrNoPassthrough},
+		{"dot segment", Link{OriginalURL: "https://example.com/a/{1}", Template: true}, "/..", "", "", ErrNoPassthrough},
+		{"unused parameters ignored", Link{OriginalURL: "https://example.com/search?q={q}", Template: true}, "", "q=go&utm_source=qr", "https://example.com/search?q=go", nil},
+		{"not a template", Link{OriginalURL: "https://example.com/search?q={q}"}, "", "q=go", "https://example.com/search?q={q}", nil},
+		{"unused parameters passed through", Link{OriginalURL: "https://example.com/search?q={q}", Template: true, Passthrough: true}, "", "q=go&utm_source=qr", "https://example.com/search?q=go&utm_source=qr", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			require.NoError(t, err)
+			got, err := tc.link.Destination(tc.extraPath, query)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestLinkPhase(t *testing.T) {
+	now := time.Now()
+	require.Equal(t, LinkActive, (&Link{}).Phase(now))
+	require.Equal(t, LinkPending, (&Link{ActiveFrom: now.Add(time.Second)}).Phase(now))
+	require.Equal(t, LinkActive, (&Link{ActiveFrom: now}).Phase(now))
+	require.Equal(t, LinkActive, (&Link{ActiveFrom: now, ActiveUntil: now.Add(time.Second)}).Phase(now))
+	require.Equal(t, LinkExpired, (&Link{ActiveUntil: now}).Phase(now))
+}
+
+func TestNullableTime(t *testing.T) {
+	var request struct {
+		A NullableTime `json:"a"`
+		B NullableTime `json:"b"`
+		C NullableTime `json:"c"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"a": "2026-05-01T12:00:00Z", "b": null}`), &request))
+	require.Equal(t, time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC), *request.A.Ptr())
+	require.True(t, request.B.Ptr().IsZero())
+	require.Nil(t, request.C.Ptr())
+	require.Error(t, json.Unmarshal([]byte(`{"a": "tomorrow"}`), &request))
+}
+
+func TestLinkPlain(t *testing.T) {
+	require.True(t, (&Link{OriginalURL: "https://example.com/"}).Plain())
+	require.True(t, (&Link{
+		OriginalURL:    "https://example.com/",
+		RedirectStatus: DefaultRedirectStatus,
+		QueryConflict:  QueryOverride,
+		BeforeActive:   BeforeActiveNotFound,
+	}).Plain())
+
+	for name, link := range map[string]Link{
+		"redirect status": {RedirectStatus: 301},
+		"cache control":   {CacheControl: "no-store"},
+		"passthrough":     {Passthrough: true},
+		"query conflict":  {QueryConflict: QueryKeep},
+		"template":        {Template: true},
+		"rules":           {Rules: []Rule{{Countries: []string{"DE"}, URL: "https://example.de/"}}},
+		"variants":        {Variants: []Variant{{Name: "a", URL: "https://example.com/a", Weight: 1}}},
+		"ios url":         {IOSURL: "myapp://home"},
+		"android url":     {AndroidURL: "myapp://home"},
+		"active from":     {ActiveFrom: time.Now()},
+		"active until":    {ActiveUntil: time.Now()},
+		"before active":   {BeforeActive: BeforeActiveComingSoon},
+		"expired url":     {ExpiredURL: "https://example.com/over"},
+		"max clicks":      {MaxClicks: 5},
+		"one time":        {OneTime: true, MaxClicks: 1},
+		"preview":         {Preview: LinkPreview{Title: "Hello"}},
+		"fallback url":    {FallbackURL: "https://example.com/mirror"},
+	} {
+		require.False(t, link.Plain(), name)
+	}
+}
@@ -2,25 +2,75 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
 type Repository interface {
-	Insert(ctx context.Context, url, alias string) (string, error)
-	GetOriginalURL(ctx context.Context, alias string) (string, error)
+	// Insert stores link and sets its ID, and returns its alias. When the
+	// owner already has a plain link to the same URL, nothing is stored and
+	// the alias of that link is returned instead.
+	Insert(ctx context.Context, link *Link) (string, error)
+	// GetLink returns an enabled link and counts a click on it.
+	GetLink(ctx context.Context, alias string) (*Link, error)
+	// ConfirmLink is GetLink for confirmed visits, the only ones that count
+	// for one-time links.
+	ConfirmLink(ctx context.Context, alias string) (*Link, error)
+	// PeekLink returns an enabled link without counting a click.
+	PeekLink(ctx context.Context, alias string) (*Link, error)
+	ListLinks(ctx context.Context, owner string, limit int) ([]Link, error)
+	// GetOwnedLink returns a link of owner, enabled or not, without counting
+	// a click.
+	GetOwnedLink(ctx context.Context, owner, alias string) (*Link, error)
+	UpdateLink(ctx context.Context, owner, alias string, update LinkUpdate) (*Link, error)
+	CountVariantClick(ctx context.Context, linkID int64, variant string) error
+	// RefundClick takes back a click that GetLink or ConfirmLink counted.
+	RefundClick(ctx context.Context, linkID int64) error
+	ListBrokenLinks(ctx context.Context, owner string, limit int) ([]Link, error)
+	ListLinkChecks(ctx context.Context, owner, alias string) ([]LinkCheck, error)
 }
 
 type Application struct {
-	BaseURL string
-	Logger  *slog.Logger
-	Repo    Repository
+	BaseURL            string
+	Logger             *slog.Logger
+	DB                 *sql.DB
+	Repo               Repository
+	Idempotency        IdempotencyStore
+	IdempotencyTTL     time.Duration
+	RateLimitPolicies  map[string]RateLimitPolicy
+	RateLimitBackend   string
+	RateLimitDBTimeout time.Duration
+	// RateLimitDBCooldown is how long the local store stands in for the
+	// postgres one after it failed.
+	RateLimitDBCooldown time.Duration
+	// PermanentRedirectMaxAge bounds how long browsers cache 301 and 308
+	// redirects that set no lifetime of their own.
+	PermanentRedirectMaxAge time.Duration
+	Canonicalize            CanonicalizeOptions
+	Aliases                 AliasGenerator
+	Users                   UserStore
+	Workspaces              WorkspaceStore
+	Tokens                  TokenStore
+	Moderation              ModerationStore
+	TokenSigner             *TokenSigner
+	SessionTTL              time.Duration
+	OIDC                    *OIDCProvider
+	// GeoIP resolves visitor countries for routing rules. Without it country
+	// conditions never match.
+	GeoIP    *GeoIP
+	AppLinks AppLinks
+	// Metadata fetches the destinations of new links, if set.
+	Metadata *MetadataFetcher
+
+	verifiedTokens verifiedTokens
 }
 
 var (
@@ -47,14 +97,94 @@ func run(logger *slog.Logger) error {
 	var tlsCertFile string
 	var tlsKeyFile string
 	var displayVersion bool
+	var rateLimitBackend string
+	var rateLimitDBTimeout time.Duration
+	var rateLimitDBCooldown time.Duration
+	var permanentRedirectMaxAge time.Duration
+	var idempotencyTTL time.Duration
+	var sessionTTL time.Duration
+	var aliasStrategy string
+	var aliasLength int
+	var aliasSalt string
+	var oidcConfig OIDCConfig
+	var oidcScopes string
+	var oidcRoleMap string
+	var tokenKeys string
+	var geoIPPath string
+	var appLinksDomain string
+	var iosAppIDs string
+	var androidApps string
+	var metadataWorkers int
+	var metadataTimeout time.Duration
+	var metadataMaxBytes int64
+	var metadataMaxRedirects int
+	var migrateMode string
+	var dbRetry DBRetryConfig
+	canonicalize := DefaultCanonicalizeOptions()
+	rateLimitPolicies := DefaultRateLimitPolicies()
+	monitor := NewLinkMonitor(nil, nil, nil)
 
 	flag.StringVar(&dsn, "dsn", os.Getenv("DB_DSN"), "PostgreSQL data source name")
+	flag.DurationVar(&dbRetry.Deadline, "db-connect-timeout", time.Minute, "How long to keep retrying to reach the database at startup (0 tries once)")
+	flag.DurationVar(&dbRetry.InitialBackoff, "db-retry-backoff", 500*time.Millisecond, "Wait before the first database connection retry, doubled after every attempt")
+	flag.DurationVar(&dbRetry.MaxBackoff, "db-retry-max-backoff", 10*time.Second, "Longest wait between database connection retries")
 	flag.IntVar(&port, "port", 8080, "HTTP server port")
 	flag.StringVar(&baseURL, "base-url", "http://localhost:8080", "Base URL for the application")
 	flag.BoolVar(&tls, "tls", false, "Enable TLS")
 	flag.StringVar(&tlsCertFile, "tls-cert-file", "./tls/cert.pem", "Path to TLS certificate file")
 	flag.StringVar(&tlsKeyFile, "tls-key-file", "./tls/key.pem", "Path to TLS key file")
 	flag.BoolVar(&displayVersion, "version", false, "Display version information")
+	flag.StringVar(&migrateMode, "migrate", "auto", "Apply database migrations before starting (auto), never (skip) or apply them and exit (only)")
+	flag.StringVar(&rateLimitBackend, "rate-limit-backend", "memory", "Rate limiter store (memory|postgres)")
+	flag.DurationVar(&rateLimitDBTimeout, "rate-limit-db-timeout", 50*time.Millisecond, "Time to wait for the postgres rate limiter before falling back to the local store")
+	flag.DurationVar(&rateLimitDBCooldown, "rate-limit-db-cooldown", 5*time.Second, "How long to keep using the local rate limiter after the postgres one failed")
+	flag.DurationVar(&permanentRedirectMaxAge, "permanent-redirect-max-age", DefaultPermanentRedirectMaxAge, "How long browsers may cache 301 and 308 redirects of links without a cache policy of their own")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", 24*time.Hour, "How long responses are kept for replay by Idempotency-Key")
+	flag.DurationVar(&sessionTTL, "session-ttl", 7*24*time.Hour, "Lifetime of web login sessions")
+	flag.StringVar(&aliasStrategy, "alias-strategy", "hash", "Alias generation strategy (hash|random|sequence|words)")
+	flag.IntVar(&aliasLength, "alias-length", 0, "Alias length, minimum length for sequence, word count for words (default depends on strategy)")
+	flag.StringVar(&aliasSalt, "alias-salt", os.Getenv("ALIAS_SALT"), "Salt used to obfuscate sequence aliases")
+	flag.StringVar(&oidcConfig.IssuerURL, "oidc-issuer", "", "OpenID Connect issuer URL (enables single sign-on)")
+	flag.StringVar(&oidcConfig.ClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&oidcConfig.ClientSecret, "oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"), "OpenID Connect client secret")
+	flag.StringVar(&oidcScopes, "oidc-scopes", "openid email profile", "Space separated OpenID Connect scopes")
+	flag.StringVar(&oidcConfig.GroupsClaim, "oidc-groups-claim", "groups", "ID token claim holding the user's groups")
+	flag.StringVar(&oidcRoleMap, "oidc-role-map", "", "Map provider groups to roles as group=role,... (roles: user, admin)")
+	flag.StringVar(&tokenKeys, "token-keys", os.Getenv("TOKEN_KEYS"), "Signing keys for API tokens as kid:base64-secret,... (the first one signs new tokens)")
+	flag.StringVar(&geoIPPath, "geoip-db", os.Getenv("GEOIP_DB"), "MaxMind DB file, such as GeoLite2-Country.mmdb, for country routing rules")
+	flag.StringVar(&appLinksDomain, "app-links-domain", "", "Only serve the app association files for this host (default any host)")
+	flag.StringVar(&iosAppIDs, "ios-app-ids", "", "Comma separated TEAMID.bundle.id of iOS apps that open short URLs")
+	flag.StringVar(&androidApps, "android-apps", "", "Android apps that open short URLs as package:sha256-fingerprint,...")
+	flag.IntVar(&metadataWorkers, "metadata-workers", 2, "Number of workers fetching the title and favicon of new destinations (0 disables)")
+	flag.DurationVar(&metadataTimeout, "metadata-timeout", 10*time.Second, "Time allowed to fetch the metadata of a destination")
+	flag.Int64Var(&metadataMaxBytes, "metadata-max-bytes", 1<<20, "Largest part of a destination page read for its metadata")
+	flag.IntVar(&metadataMaxRedirects, "metadata-max-redirects", 5, "Redirects followed when fetching the metadata of a destination")
+	flag.DurationVar(&monitor.Interval, "monitor-interval", monitor.Interval, "How often to check that link destinations still work (0 disables)")
+	flag.IntVar(&monitor.Concurrency, "monitor-concurrency", monitor.Concurrency, "Number of hosts whose links are checked at the same time")
+	flag.DurationVar(&monitor.HostDelay, "monitor-host-delay", monitor.HostDelay, "Pause between two checks of links to the same host")
+	flag.DurationVar(&monitor.Timeout, "monitor-timeout", monitor.Timeout, "Time allowed to check a link destination")
+	flag.IntVar(&monitor.FailureThreshold, "monitor-failures", monitor.FailureThreshold, "Failed checks in a row after which a link is flagged as broken")
+	flag.Func("monitor-broken-statuses", "Comma separated response statuses that fail a link check (default every 4xx and 5xx)", func(s string) error {
+		statuses, err := ParseBrokenStatuses(s)
+		if err != nil {
+			return err
+		}
+		monitor.BrokenStatuses = statuses
+		return nil
+	})
+	flag.BoolVar(&canonicalize.StripTrackingParams, "strip-tracking-params", canonicalize.StripTrackingParams, "Ignore tracking query parameters (utm_*, fbclid, ...) when deduplicating URLs; links keep redirecting to the first URL submitted")
+	flag.Func("rate-limit", "Override a rate limit policy as name=rate:burst (repeatable, rate 0 disables)", func(s string) error {
+		name, policy, err := ParseRateLimitPolicy(s)
+		if err != nil {
+			return err
+		}
+		rateLimitPolicies[name] = policy
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n%s\nFlags:\n", os.Args[0], commandUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if displayVersion {
@@ -65,12 +195,102 @@ func run(logger *slog.Logger) error {
 		return nil
 	}
 
+	if rateLimitBackend != "memory" && rateLimitBackend != "postgres" {
+		return fmt.Errorf("invalid rate limit backend %q", rateLimitBackend)
+	}
+	if migrateMode != "auto" && migrateMode != "skip" && migrateMode != "only" {
+		return fmt.Errorf("invalid migrate mode %q", migrateMode)
+	}
+	if metadataWorkers < 0 || metadataTimeout <= 0 || metadataMaxBytes <= 0 || metadataMaxRedirects < 0 {
+		return fmt.Errorf("metadata workers, timeout, size and redirects must not be negative")
+	}
+	if monitor.Interval < 0 || monitor.Concurrency <= 0 || monitor.HostDelay < 0 || monitor.Timeout <= 0 || monitor.FailureThreshold <= 0 {
+		return fmt.Errorf("monitor interval and delay must not be negative, and its concurrency, timeout and failures must be positive")
+	}
+	if permanentRedirectMaxAge <= 0 {
+		return fmt.Errorf("permanent redirect max age must be positive")
+	}
+	if dbRetry.InitialBackoff <= 0 || dbRetry.MaxBackoff < dbRetry.InitialBackoff {
+		return fmt.Errorf("database retry backoff must be positive and at most the maximum backoff")
+	}
+
+	command := flag.Args()
+	if len(command) > 0 {
+		if _, _, err := lookupCommand(command); err != nil {
+			return err
+		}
+		if migrateMode == "only" {
+			return fmt.Errorf("-migrate=only cannot be combined with a command")
+		}
+		// Keep stdout for the output of the command.
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+
 	app := &Application{
-		BaseURL: baseURL,
-		Logger:  logger,
+		BaseURL:                 baseURL,
+		Logger:                  logger,
+		RateLimitPolicies:       rateLimitPolicies,
+		RateLimitBackend:        rateLimitBackend,
+		RateLimitDBTimeout:      rateLimitDBTimeout,
+		RateLimitDBCooldown:     rateLimitDBCooldown,
+		PermanentRedirectMaxAge: permanentRedirectMaxAge,
+		IdempotencyTTL:          idempotencyTTL,
+		Canonicalize:            canonicalize,
+		SessionTTL:              sessionTTL,
+	}
+
+	if oidcConfig.IssuerURL != "" {
+		oidcConfig.RedirectURL = strings.TrimSuffix(baseURL, "/") + "/auth/oidc/callback"
+		oidcConfig.Scopes = strings.Fields(oidcScopes)
+		roleMap, err := ParseRoleMap(oidcRoleMap)
+		if err != nil {
+			return fmt.Errorf("parse oidc role map: %w", err)
+		}
+		oidcConfig.RoleMap = roleMap
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		provider, err := NewOIDCProvider(ctx, oidcConfig)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("configure oidc: %w", err)
+		}
+		app.OIDC = provider
+	}
+
+	if tokenKeys != "" {
+		signer, err := NewTokenSigner(tokenKeys)
+		if err != nil {
+			return fmt.Errorf("parse token keys: %w", err)
+		}
+		app.TokenSigner = signer
 	}
 
-	db, err := OpenDB(dsn)
+	app.AppLinks.Domain = appLinksDomain
+	for id := range strings.SplitSeq(iosAppIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			app.AppLinks.IOSAppIDs = append(app.AppLinks.IOSAppIDs, id)
+		}
+	}
+	androidAppLinks, err := ParseAndroidApps(androidApps)
+	if err != nil {
+		return fmt.Errorf("parse android apps: %w", err)
+	}
+	app.AppLinks.AndroidApps = androidAppLinks
+
+	if geoIPPath != "" {
+		geoIP, err := LoadGeoIP(geoIPPath)
+		if err != nil {
+			return fmt.Errorf("load geoip database: %w", err)
+		}
+		defer func() { _ = geoIP.Close() }()
+		app.GeoIP = geoIP
+	}
+
+	if aliasLength == 0 {
+		aliasLength = map[string]int{"hash": 11, "random": 8, "sequence": 6, "words": 3}[aliasStrategy]
+	}
+
+	db, err := ConnectDB(dsn, dbRetry, logger)
 	if err != nil {
 		return fmt.Errorf("open database: %w", err)
 	}
@@ -85,11 +305,76 @@ func run(logger *slog.Logger) error {
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxIdleTime(15 * time.Minute)
 
-	if err := Migrate(db); err != nil {
-		return fmt.Errorf("run database migrations: %w", err)
+	// The migrate command manages the schema itself.
+	if len(command) == 0 || command[0] != "migrate" {
+		if migrateMode != "skip" {
+			if err := Migrate(db); err != nil {
+				return fmt.Errorf("run database migrations: %w", err)
+			}
+		}
+		if migrateMode == "only" {
+			logger.Info("database migrations applied")
+			return nil
+		}
+		if err := CheckSchemaVersion(db); err != nil {
+			return err
+		}
+	}
+
+	app.DB = db
+	repo := &Repo{DB: db}
+	app.Repo = repo
+	app.Idempotency = repo
+	app.Users = repo
+	app.Workspaces = repo
+	app.Tokens = repo
+	app.Moderation = repo
+
+	app.Aliases, err = NewAliasGenerator(aliasStrategy, aliasLength, aliasSalt, repo)
+	if err != nil {
+		return fmt.Errorf("create alias generator: %w", err)
+	}
+
+	if len(command) > 0 {
+		cli := &CLI{App: app, Repo: repo, Out: os.Stdout}
+		return cli.Run(context.Background(), command)
+	}
+
+	if metadataWorkers > 0 {
+		fetcher := NewMetadataFetcher(NewDestinationClient(), repo, logger)
+		fetcher.Timeout = metadataTimeout
+		fetcher.MaxBytes = metadataMaxBytes
+		fetcher.MaxRedirects = metadataMaxRedirects
+		app.Metadata = fetcher
+
+		ctx, stop := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			fetcher.Run(ctx, metadataWorkers)
+			close(done)
+		}()
+		defer func() {
+			stop()
+			<-done
+		}()
 	}
 
-	app.Repo = &Repo{DB: db}
+	if monitor.Interval > 0 {
+		monitor.Client = NewDestinationClient()
+		monitor.Store = repo
+		monitor.Logger = logger
+
+		ctx, stop := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			monitor.Run(ctx)
+			close(done)
+		}()
+		defer func() {
+			stop()
+			<-done
+		}()
+	}
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
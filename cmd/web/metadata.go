@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// LinkMetadata is what the destination of a link says about itself in its
+// HTML head. FetchedAt is zero until the destination has been fetched, and
+// set even when nothing could be extracted from it.
+type LinkMetadata struct {
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	Favicon      string    `json:"favicon"`
+	CanonicalURL string    `json:"canonical_url"`
+	FetchedAt    time.Time `json:"fetched_at,omitzero"`
+}
+
+type MetadataStore interface {
+	SetLinkMetadata(ctx context.Context, alias string, meta LinkMetadata) error
+}
+
+var (
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrPrivateAddress   = errors.New("destination resolves to a private address")
+)
+
+// metadataQueueSize is the number of links that can wait to be fetched.
+// Links created while the queue is full are not fetched.
+const metadataQueueSize = 1000
+
+// MetadataFetcher fetches the destinations of new links in the background
+// and stores their metadata.
+type MetadataFetcher struct {
+	Client *http.Client
+	Store  MetadataStore
+	Logger *slog.Logger
+	// MaxBytes is how much of a page is read, Timeout how long a fetch may
+	// take in total and MaxRedirects how many redirects it follows.
+	MaxBytes     int64
+	Timeout      time.Duration
+	MaxRedirects int
+
+	jobs chan metadataJob
+}
+
+type metadataJob struct {
+	alias string
+	url   string
+}
+
+func NewMetadataFetcher(client *http.Client, store MetadataStore, logger *slog.Logger) *MetadataFetcher {
+	return &MetadataFetcher{
+		Client:       client,
+		Store:        store,
+		Logger:       logger,
+		MaxBytes:     1 << 20,
+		Timeout:      10 * time.Second,
+		MaxRedirects: 5,
+		jobs:         make(chan metadataJob, metadataQueueSize),
+	}
+}
+
+// Enqueue schedules the destination of alias to be fetched. It never blocks
+// and reports whether the job was queued.
+func (f *MetadataFetcher) Enqueue(alias, destination string) bool {
+	select {
+	case f.jobs <- metadataJob{alias: alias, url: destination}:
+		return true
+	default:
+		f.Logger.Warn("metadata queue is full", "alias", alias)
+		return false
+	}
+}
+
+// Run fetches queued destinations with the given number of workers until ctx
+// is done. Jobs still queued then are dropped.
+func (f *MetadataFetcher) Run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-f.jobs:
+					f.process(ctx, job)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func (f *MetadataFetcher) process(ctx context.Context, job metadataJob) {
+	meta, err := f.Fetch(ctx, job.url)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		// Store the failed attempt too, so that it is not waited for.
+		f.Logger.Info("failed to fetch link metadata", "alias", job.alias, "error", err)
+	}
+	meta.FetchedAt = time.Now()
+	if err := f.Store.SetLinkMetadata(ctx, job.alias, meta); err != nil {
+		f.Logger.Error("failed to store link metadata", "alias", job.alias, "error", err)
+	}
+}
+
+// Fetch requests destination and extracts the metadata of the HTML page it
+// leads to.
+func (f *MetadataFetcher) Fetch(ctx context.Context, destination string) (LinkMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, destination, nil)
+	if err != nil {
+		return LinkMetadata{}, fmt.Errorf("fetch metadata: %w", err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "url-shortener-metadata/"+version)
+
+	client := *f.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > f.MaxRedirects {
+			return ErrTooManyRedirects
+		}
+		if !validDestination(req.URL.String()) {
+			return ErrInvalidURL
+		}
+		return nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return LinkMetadata{}, fmt.Errorf("fetch metadata: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return LinkMetadata{}, fmt.Errorf("fetch metadata: %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get(echo.HeaderContentType))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return LinkMetadata{}, fmt.Errorf("fetch metadata: unsupported content type %q", mediaType)
+	}
+	return parseMetadata(io.LimitReader(resp.Body, f.MaxBytes), resp.Request.URL), nil
+}
+
+// parseMetadata reads the head of an HTML page served at base. Open Graph
+// tags win over their plain HTML counterparts.
+func parseMetadata(r io.Reader, base *url.URL) LinkMetadata {
+	var title, ogTitle, description, ogDescription, icon, touchIcon, canonical, ogURL string
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := z.TagName()
+		tag := atom.Lookup(name)
+		if tag == atom.Body {
+			// Metadata lives in the head.
+			break
+		}
+		attrs := map[string]string{}
+		for hasAttr {
+			var key, value []byte
+			key, value, hasAttr = z.TagAttr()
+			attrs[string(key)] = string(value)
+		}
+		switch tag {
+		case atom.Title:
+			if z.Next() == html.TextToken && title == "" {
+				title = string(z.Text())
+			}
+		case atom.Meta:
+			content := attrs["content"]
+			switch strings.ToLower(cmp.Or(attrs["property"], attrs["name"])) {
+			case "og:title":
+				ogTitle = cmp.Or(ogTitle, content)
+			case "og:description":
+				ogDescription = cmp.Or(ogDescription, content)
+			case "og:url":
+				ogURL = cmp.Or(ogURL, content)
+			case "description":
+				description = cmp.Or(description, content)
+			}
+		case atom.Link:
+			href := attrs["href"]
+			for rel := range strings.FieldsSeq(strings.ToLower(attrs["rel"])) {
+				switch rel {
+				case "canonical":
+					canonical = cmp.Or(canonical, href)
+				case "icon":
+					icon = cmp.Or(icon, href)
+				case "apple-touch-icon":
+					touchIcon = cmp.Or(touchIcon, href)
+				}
+			}
+		}
+	}
+
+	return LinkMetadata{
+		Title:        cleanText(cmp.Or(ogTitle, title), 200),
+		Description:  cleanText(cmp.Or(ogDescription, description), 1000),
+		Favicon:      resolveURL(base, cmp.Or(icon, touchIcon, "/favicon.ico")),
+		CanonicalURL: resolveURL(base, cmp.Or(canonical, ogURL)),
+	}
+}
+
+// cleanText collapses the white space of s and truncates it to limit runes.
+func cleanText(s string, limit int) string {
+	s = strings.Join(strings.Fields(strings.ToValidUTF8(s, "")), " ")
+	if runes := []rune(s); len(runes) > limit {
+		s = string(runes[:limit])
+	}
+	return s
+}
+
+// resolveURL resolves ref against base, and returns it if it is an HTTP(S)
+// URL short enough to store.
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ""
+	}
+	s := u.String()
+	if !validDestination(s) || len(s) > 500 {
+		return ""
+	}
+	return s
+}
+
+// NewDestinationClient returns the client used to fetch destinations. It
+// refuses to connect to loopback, private and link-local addresses, so that
+// links cannot make the server reach the internal network.
+func NewDestinationClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addr) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, addr)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+	}
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !carrierGradeNAT.Contains(addr)
+}
+
+var carrierGradeNAT = netip.MustParsePrefix("100.64.0.0/10")
+
+// LinkMetadataAPI returns the metadata of the destination of a link of the
+// caller, for the index page to show once it has been fetched. Anonymous
+// links belong to nobody, so theirs is not shown.
+func (app *Application) LinkMetadataAPI(c echo.Context) error {
+	owner := linkOwner(c)
+	if owner == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	}
+
+	link, err := app.Repo.GetOwnedLink(c.Request().Context(), owner, c.Param("alias"))
+	if err != nil {
+		return linkLookupError(c, err)
+	}
+	return c.JSON(http.StatusOK, link.Metadata)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMetadata(t *testing.T) {
+	base, err := url.Parse("https://example.com/blog/post?id=1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		html string
+		want LinkMetadata
+	}{
+		{
+			name: "plain html",
+			html: `<html><head><title> Hello
+				&amp; welcome </title>
+				<meta name="description" content="A post">
+				<link rel="shortcut icon" href="/static/icon.png">
+				<link rel="canonical" href="post">
+				</head><body></body></html>`,
+			want: LinkMetadata{
+				Title:        "Hello & welcome",
+				Description:  "A post",
+				Favicon:      "https://example.com/static/icon.png",
+				CanonicalURL: "https://example.com/blog/post",
+			},
+		},
+		{
+			name: "open graph wins",
+			html: `<head><title>Plain</title>
+				<meta property="og:title" content="Social">
+				<meta name="description" content="Plain description">
+				<meta property="og:description" content="Social description">
+				<meta property="og:url" content="https://example.com/canonical">
+				<link rel="apple-touch-icon" href="https://cdn.example.com/touch.png">`,
+			want: LinkMetadata{
+				Title:        "Social",
+				Description:  "Social description",
+				Favicon:      "https://cdn.example.com/touch.png",
+				CanonicalURL: "https://example.com/canonical",
+			},
+		},
+		{
+			name: "default favicon",
+			html: `<title>Only a title</title>`,
+			want: LinkMetadata{Title: "Only a title", Favicon: "https://example.com/favicon.ico"},
+		},
+		{
+			name: "head only",
+			html: `<head></head><body><title>Not the title</title><link rel="canonical" href="/body"></body>`,
+			want: LinkMetadata{Favicon: "https://example.com/favicon.ico"},
+		},
+		{
+			name: "unsafe urls",
+			html: `<link rel="icon" href="javascript:alert(1)"><link rel="canonical" href="ftp://example.com/">`,
+			want: LinkMetadata{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, parseMetadata(strings.NewReader(tt.html), base))
+		})
+	}
+
+	long := parseMetadata(strings.NewReader("<title>"+strings.Repeat("é", 300)+"</title>"), base)
+	require.Equal(t, strings.Repeat("é", 200), long.Title)
+}
+
+func newMetadataTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = fmt.Fprint(w, `<html><head><title>The page</title><link rel="icon" href="/icon.svg"></head></html>`)
+	})
+	mux.HandleFunc("/hop/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.PathValue("n"))
+		if n == 0 {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/hop/%d", n-1), http.StatusFound)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, "<!-- "+strings.Repeat("x", 4096)+" --><title>Too far</title>")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/data.json", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"title":"no"}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMetadataFetcherFetch(t *testing.T) {
+	server := newMetadataTestServer(t)
+	fetcher := NewMetadataFetcher(server.Client(), nil, slog.New(slog.DiscardHandler))
+	fetcher.MaxBytes = 1024
+	fetcher.Timeout = 200 * time.Millisecond
+	fetcher.MaxRedirects = 2
+	ctx := context.Background()
+
+	meta, err := fetcher.Fetch(ctx, server.URL+"/page")
+	require.NoError(t, err)
+	require.Equal(t, LinkMetadata{Title: "The page", Favicon: server.URL + "/icon.svg"}, meta)
+
+	// Relative URLs resolve against the page the redirects end at.
+	meta, err = fetcher.Fetch(ctx, server.URL+"/hop/1")
+	require.NoError(t, err)
+	require.Equal(t, "The page", meta.Title)
+
+	_, err = fetcher.Fetch(ctx, server.URL+"/hop/2")
+	require.ErrorIs(t, err, ErrTooManyRedirects)
+
+	meta, err = fetcher.Fetch(ctx, server.URL+"/large")
+	require.NoError(t, err)
+	require.Empty(t, meta.Title)
+
+	_, err = fetcher.Fetch(ctx, server.URL+"/slow")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = fetcher.Fetch(ctx, server.URL+"/data.json")
+	require.ErrorContains(t, err, "unsupported content type")
+
+	_, err = fetcher.Fetch(ctx, server.URL+"/missing")
+	require.ErrorContains(t, err, "404")
+}
+
+type memoryMetadataStore struct {
+	stored chan LinkMetadata
+}
+
+func (s *memoryMetadataStore) SetLinkMetadata(_ context.Context, alias string, meta LinkMetadata) error {
+	s.stored <- meta
+	return nil
+}
+
+func TestMetadataFetcherRun(t *testing.T) {
+	server := newMetadataTestServer(t)
+	store := &memoryMetadataStore{stored: make(chan LinkMetadata)}
+	fetcher := NewMetadataFetcher(server.Client(), store, slog.New(slog.DiscardHandler))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fetcher.Run(ctx, 2)
+		close(done)
+	}()
+
+	require.True(t, fetcher.Enqueue("abc", server.URL+"/page"))
+	meta := <-store.stored
+	require.Equal(t, "The page", meta.Title)
+	require.False(t, meta.FetchedAt.IsZero())
+
+	// Failures are stored too, so that nobody waits for them.
+	require.True(t, fetcher.Enqueue("def", server.URL+"/missing"))
+	meta = <-store.stored
+	require.Empty(t, meta.Title)
+	require.False(t, meta.FetchedAt.IsZero())
+
+	cancel()
+	<-done
+}
+
+func TestDestinationClient(t *testing.T) {
+	server := newMetadataTestServer(t)
+	_, err := NewDestinationClient().Get(server.URL + "/page")
+	require.ErrorIs(t, err, ErrPrivateAddress)
+
+	for addr, public := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"192.168.0.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"::1":              false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+		"0.0.0.0":          false,
+	} {
+		require.Equal(t, public, publicAddr(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestShortenFetchesMetadata(t *testing.T) {
+	stored := map[string]bool{}
+	app := &Application{
+		BaseURL: "https://sho.rt",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				// Plain links to the same URL are handed out again.
+				if link.Plain() && stored[link.CanonicalURL] {
+					return link.Alias, nil
+				}
+				stored[link.CanonicalURL] = true
+				link.ID = int64(len(stored))
+				return link.Alias, nil
+			},
+		},
+	}
+	app.Metadata = NewMetadataFetcher(http.DefaultClient, nil, app.Logger)
+
+	e := newTestEcho()
+	shorten := func(owner, body string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		c := e.NewContext(req, rec)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		require.NoError(t, app.Shorten(c))
+		require.Equal(t, http.StatusCreated, rec.Code)
+		require.NotContains(t, rec.Body.String(), "metadata")
+	}
+
+	// Fetches happen in the background, for anonymous links too.
+	for _, owner := range []string{"", "user:1"} {
+		shorten(owner, `{"url":"https://example.com/article"}`)
+		require.Len(t, app.Metadata.jobs, 1)
+		job := <-app.Metadata.jobs
+		require.Equal(t, "https://example.com/article", job.url)
+		require.NotEmpty(t, job.alias)
+		clear(stored)
+	}
+
+	// Links handed out again are not fetched again.
+	shorten("", `{"url":"https://example.com/again"}`)
+	<-app.Metadata.jobs
+	shorten("", `{"url":"https://example.com/again"}`)
+	require.Empty(t, app.Metadata.jobs)
+
+	shorten("", `{"url":"https://example.com/secret","one_time":true}`)
+	shorten("", `{"url":"https://example.com/search?q={query}","template":true}`)
+	require.Empty(t, app.Metadata.jobs)
+}
+
+func TestLinkMetadataAPI(t *testing.T) {
+	fetchedAt := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	link := &Link{
+		Alias:       "fetched",
+		OriginalURL: "https://example.com/",
+		Metadata:    LinkMetadata{Title: "Example", Favicon: "https://example.com/favicon.ico", FetchedAt: fetchedAt},
+	}
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			ownedLinkFn: func(_ context.Context, owner, alias string) (*Link, error) {
+				if owner != "user:1" || alias != link.Alias {
+					return nil, ErrRecordNotFound
+				}
+				return link, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	get := func(owner, alias string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.SetParamNames("alias")
+		c.SetParamValues(alias)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		if err := app.LinkMetadataAPI(c); err != nil {
+			app.CustomHTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	rec := get("user:1", "fetched")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var meta LinkMetadata
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &meta))
+	require.Equal(t, link.Metadata, meta)
+
+	require.Equal(t, http.StatusNotFound, get("user:1", "missing").Code)
+	require.Equal(t, http.StatusNotFound, get("user:2", "fetched").Code)
+	require.Equal(t, http.StatusUnauthorized, get("", "fetched").Code)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MaxLinkChecks is the number of checks kept in the history of a link.
+const MaxLinkChecks = 50
+
+// LinkCheck is the result of one request to the destination of a link.
+// Status is 0 when no response was received, and Error says why.
+// Failed is set when the destination looked broken. Inconclusive is set when
+// the check tells nothing about the destination, as when the request timed
+// out; such checks neither count as failures nor end a series of them.
+type LinkCheck struct {
+	Status       int       `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Failed       bool      `json:"-"`
+	Inconclusive bool      `json:"-"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// LinkHealth sums up the checks of the destination of a link. BrokenSince is
+// set while the link is flagged as broken.
+type LinkHealth struct {
+	Status      int       `json:"status"`
+	Failures    int       `json:"consecutive_failures"`
+	CheckedAt   time.Time `json:"checked_at,omitzero"`
+	BrokenSince time.Time `json:"broken_since,omitzero"`
+}
+
+// Broken reports whether the monitor flagged the destination of the link.
+func (l *Link) Broken() bool {
+	return !l.Health.BrokenSince.IsZero()
+}
+
+// WithFallback returns l, or a copy of l leading to its fallback URL when its
+// destination is broken. Rules and variants are left alone, as their
+// destinations are not checked.
+func (l *Link) WithFallback() *Link {
+	if !l.Broken() || l.FallbackURL == "" {
+		return l
+	}
+	fallback := *l
+	fallback.OriginalURL = l.FallbackURL
+	return &fallback
+}
+
+type HealthStore interface {
+	ClaimLinksToCheck(ctx context.Context, interval time.Duration, limit int) ([]Link, error)
+	RecordLinkCheck(ctx context.Context, linkID int64, check LinkCheck, threshold int) (*LinkHealth, error)
+}
+
+// monitorBatchSize is the number of links claimed at a time, and
+// monitorPollInterval how long to wait for more once none are due.
+const (
+	monitorBatchSize    = 500
+	monitorPollInterval = time.Minute
+)
+
+// LinkMonitor checks the destinations of links periodically, to find the
+// ones that point to deleted pages.
+type LinkMonitor struct {
+	Client *http.Client
+	Store  HealthStore
+	Logger *slog.Logger
+	// Interval is how often each destination is checked.
+	Interval time.Duration
+	// Concurrency bounds the number of hosts checked at the same time.
+	// HostDelay is the pause between two requests to the same host.
+	Concurrency int
+	HostDelay   time.Duration
+	Timeout     time.Duration
+	// FailureThreshold is the number of failed checks in a row after which
+	// a link is flagged as broken.
+	FailureThreshold int
+	// BrokenStatuses are the response statuses that fail a check. When
+	// empty, every 4xx and 5xx status does; otherwise the other ones are
+	// inconclusive.
+	BrokenStatuses []int
+}
+
+func NewLinkMonitor(client *http.Client, store HealthStore, logger *slog.Logger) *LinkMonitor {
+	return &LinkMonitor{
+		Client:           client,
+		Store:            store,
+		Logger:           logger,
+		Interval:         24 * time.Hour,
+		Concurrency:      4,
+		HostDelay:        2 * time.Second,
+		Timeout:          10 * time.Second,
+		FailureThreshold: 3,
+	}
+}
+
+// Run checks the destinations that are due until ctx is done.
+func (m *LinkMonitor) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, err := m.CheckDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			m.Logger.Error("failed to check links", "error", err)
+		}
+		if n == monitorBatchSize {
+			// There may be more.
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(monitorPollInterval):
+		}
+	}
+}
+
+// CheckDue checks a batch of the destinations that are due and returns how
+// many links it claimed.
+func (m *LinkMonitor) CheckDue(ctx context.Context) (int, error) {
+	links, err := m.Store.ClaimLinksToCheck(ctx, m.Interval, monitorBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Links to the same host are checked one after the other, so that the
+	// delay between them can be honored.
+	var hosts []string
+	byHost := map[string][]Link{}
+	for _, link := range links {
+		if link.Template {
+			continue
+		}
+		u, err := url.Parse(link.OriginalURL)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], link)
+	}
+
+	work := make(chan []Link)
+	var wg sync.WaitGroup
+	for range min(max(m.Concurrency, 1), len(hosts)) {
+		wg.Go(func() {
+			for group := range work {
+				m.checkHost(ctx, group)
+			}
+		})
+	}
+	for _, host := range hosts {
+		work <- byHost[host]
+	}
+	close(work)
+	wg.Wait()
+	return len(links), ctx.Err()
+}
+
+func (m *LinkMonitor) checkHost(ctx context.Context, links []Link) {
+	for i, link := range links {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(m.HostDelay):
+			}
+		}
+		check := m.Check(ctx, link.OriginalURL)
+		if ctx.Err() != nil {
+			return
+		}
+		health, err := m.Store.RecordLinkCheck(ctx, link.ID, check, m.FailureThreshold)
+		if errors.Is(err, ErrRecordNotFound) {
+			// Deleted since it was claimed.
+			continue
+		}
+		if err != nil {
+			m.Logger.Error("failed to record link check", "alias", link.Alias, "error", err)
+			continue
+		}
+		if check.Failed && health.Failures == m.FailureThreshold {
+			m.Logger.Warn("link destination is broken", "alias", link.Alias, "status", check.Status, "error", check.Error)
+		}
+	}
+}
+
+// Check requests destination and reports how it answered. Redirects are
+// followed. Servers that refuse HEAD requests are asked again with GET.
+func (m *LinkMonitor) Check(ctx context.Context, destination string) LinkCheck {
+	check := LinkCheck{CheckedAt: time.Now()}
+	status, err := m.request(ctx, http.MethodHead, destination)
+	if err == nil && status >= 400 {
+		status, err = m.request(ctx, http.MethodGet, destination)
+	}
+	if err != nil {
+		check.Error = err.Error()
+		check.Failed = unreachable(err)
+		check.Inconclusive = !check.Failed
+		return check
+	}
+	check.Status = status
+	check.Failed = m.broken(status)
+	check.Inconclusive = !check.Failed && status >= 400
+	return check
+}
+
+// broken reports whether status fails a check.
+func (m *LinkMonitor) broken(status int) bool {
+	if len(m.BrokenStatuses) == 0 {
+		return status >= 400
+	}
+	return slices.Contains(m.BrokenStatuses, status)
+}
+
+// ParseBrokenStatuses parses a comma separated list of 4xx and 5xx statuses,
+// such as "404,410".
+func ParseBrokenStatuses(s string) ([]int, error) {
+	var statuses []int
+	for field := range strings.SplitSeq(s, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid broken status %q: must be between 400 and 599", field)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// unreachable reports whether err says that the host does not exist or
+// refused the connection, rather than that the request timed out. Hosts the
+// client refused to dial because they resolve to a private address are not
+// unreachable: they may well work for the people the link is shared with.
+func unreachable(err error) bool {
+	if errors.Is(err, ErrPrivateAddress) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout()
+}
+
+func (m *LinkMonitor) request(ctx context.Context, method, destination string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, destination, nil)
+	if err != nil {
+		return 0, fmt.Errorf("check link: %w", err)
+	}
+	req.Header.Set("User-Agent", "url-shortener-monitor/"+version)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("check link: %w", err)
+	}
+	// Only the status matters.
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// ListBrokenLinksAPI lists the links of the caller whose destination is
+// flagged as broken.
+func (app *Application) ListBrokenLinksAPI(c echo.Context) error {
+	owner := linkOwner(c)
+	if owner == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	}
+
+	links, err := app.Repo.ListBrokenLinks(c.Request().Context(), owner, 100)
+	if err != nil {
+		return err
+	}
+
+	response := make([]linkResponse, 0, len(links))
+	for _, link := range links {
+		response = append(response, app.newLinkResponse(&link))
+	}
+	return c.JSON(http.StatusOK, map[string]any{"links": response})
+}
+
+// LinkChecksAPI returns the check history of a link of the caller.
+func (app *Application) LinkChecksAPI(c echo.Context) error {
+	owner := linkOwner(c)
+	if owner == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+	}
+
+	checks, err := app.Repo.ListLinkChecks(c.Request().Context(), owner, c.Param("alias"))
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]any{"checks": checks})
+}
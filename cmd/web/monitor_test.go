@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func newMonitorTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, _ *http.Request) {})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/no-head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.PathValue("code"))
+		w.WriteHeader(code)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLinkMonitorCheck(t *testing.T) {
+	server := newMonitorTestServer(t)
+	monitor := NewLinkMonitor(server.Client(), nil, slog.New(slog.DiscardHandler))
+	monitor.Timeout = 100 * time.Millisecond
+	ctx := context.Background()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		url          string
+		status       int
+		failed       bool
+		inconclusive bool
+	}{
+		{server.URL + "/ok", http.StatusOK, false, false},
+		{server.URL + "/moved", http.StatusOK, false, false},
+		{server.URL + "/no-head", http.StatusOK, false, false},
+		{server.URL + "/gone", http.StatusGone, true, false},
+		{server.URL + "/missing", http.StatusNotFound, true, false},
+		{server.URL + "/status/401", http.StatusUnauthorized, true, false},
+		{server.URL + "/status/403", http.StatusForbidden, true, false},
+		{server.URL + "/status/429", http.StatusTooManyRequests, true, false},
+		{server.URL + "/status/500", http.StatusInternalServerError, true, false},
+		{server.URL + "/status/503", http.StatusServiceUnavailable, true, false},
+		// Timeouts say nothing about the destination.
+		{server.URL + "/slow", 0, false, true},
+		// Nothing listens on the port of a closed server.
+		{closed.URL, 0, true, false},
+	}
+	for _, tc := range tests {
+		check := monitor.Check(ctx, tc.url)
+		require.Equal(t, tc.status, check.Status, tc.url)
+		require.Equal(t, tc.status == 0, check.Error != "", tc.url)
+		require.Equal(t, tc.failed, check.Failed, tc.url)
+		require.Equal(t, tc.inconclusive, check.Inconclusive, tc.url)
+	}
+
+	// Other statuses are inconclusive when the broken ones are narrowed.
+	monitor.BrokenStatuses = []int{http.StatusNotFound, http.StatusGone}
+	for path, failed := range map[string]bool{"/gone": true, "/missing": true, "/status/403": false, "/status/503": false, "/ok": false} {
+		check := monitor.Check(ctx, server.URL+path)
+		require.Equal(t, failed, check.Failed, path)
+		require.Equal(t, !failed && check.Status >= 400, check.Inconclusive, path)
+	}
+
+	// Destinations the client refuses to reach may work for everyone else.
+	monitor.Client = NewDestinationClient()
+	check := monitor.Check(ctx, server.URL+"/gone")
+	require.Zero(t, check.Status)
+	require.Contains(t, check.Error, ErrPrivateAddress.Error())
+	require.False(t, check.Failed)
+	require.True(t, check.Inconclusive)
+}
+
+func TestParseBrokenStatuses(t *testing.T) {
+	statuses, err := ParseBrokenStatuses("404, 410,500")
+	require.NoError(t, err)
+	require.Equal(t, []int{404, 410, 500}, statuses)
+	for _, s := range []string{"", "404,", "200", "600", "gone"} {
+		_, err := ParseBrokenStatuses(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	for err, want := range map[error]bool{
+		&url.Error{Op: "Head", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}}: true,
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}:                                                              true,
+		&net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}:                                false,
+		&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}:                                                            false,
+		&net.OpError{Op: "read", Err: syscall.ECONNRESET}:                                                                false,
+		&net.OpError{Op: "dial", Err: fmt.Errorf("%w: 10.0.0.1", ErrPrivateAddress)}:                                     false,
+		context.DeadlineExceeded: false,
+	} {
+		require.Equal(t, want, unreachable(err), err.Error())
+	}
+}
+
+type memoryHealthStore struct {
+	mu     sync.Mutex
+	links  []Link
+	checks map[int64][]LinkCheck
+	health map[int64]*LinkHealth
+}
+
+func (s *memoryHealthStore) ClaimLinksToCheck(_ context.Context, _ time.Duration, limit int) ([]Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.links[:min(limit, len(s.links))], nil
+}
+
+func (s *memoryHealthStore) RecordLinkCheck(_ context.Context, linkID int64, check LinkCheck, threshold int) (*LinkHealth, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks[linkID] = append(s.checks[linkID], check)
+	health := s.health[linkID]
+	if health == nil {
+		health = &LinkHealth{}
+		s.health[linkID] = health
+	}
+	health.Status, health.CheckedAt = check.Status, check.CheckedAt
+	switch {
+	case check.Inconclusive:
+	case !check.Failed:
+		health.Failures, health.BrokenSince = 0, time.Time{}
+	default:
+		health.Failures++
+		if health.Failures >= threshold && health.BrokenSince.IsZero() {
+			health.BrokenSince = check.CheckedAt
+		}
+	}
+	copied := *health
+	return &copied, nil
+}
+
+func TestLinkMonitorCheckDue(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	requests := map[string][]time.Time{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		if r.Method == http.MethodHead {
+			// A GET follows failed HEADs right away, as part of the same check.
+			requests[r.Host] = append(requests[r.Host], time.Now())
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/deleted"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+	// Both names reach the test server, as two different hosts.
+	other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	store := &memoryHealthStore{
+		links: []Link{
+			{ID: 1, Alias: "one", OriginalURL: server.URL + "/page"},
+			{ID: 2, Alias: "two", OriginalURL: server.URL + "/deleted"},
+			{ID: 3, Alias: "three", OriginalURL: server.URL + "/deleted/too"},
+			{ID: 4, Alias: "four", OriginalURL: other + "/page"},
+			{ID: 5, Alias: "five", OriginalURL: other + "/search?q={query}", Template: true},
+			{ID: 6, Alias: "six", OriginalURL: other + "/unavailable"},
+		},
+		checks: map[int64][]LinkCheck{},
+		health: map[int64]*LinkHealth{},
+	}
+	monitor := NewLinkMonitor(server.Client(), store, slog.New(slog.DiscardHandler))
+	monitor.Concurrency = 1
+	monitor.HostDelay = 50 * time.Millisecond
+	monitor.FailureThreshold = 2
+	monitor.BrokenStatuses = []int{http.StatusNotFound}
+	ctx := context.Background()
+
+	n, err := monitor.CheckDue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	require.Equal(t, 1, maxInFlight)
+	// Templated destinations are not checked.
+	require.Empty(t, store.checks[5])
+	for _, times := range requests {
+		for i := 1; i < len(times); i++ {
+			require.GreaterOrEqual(t, times[i].Sub(times[i-1]), monitor.HostDelay)
+		}
+	}
+	require.True(t, store.health[2].BrokenSince.IsZero())
+	require.Equal(t, 1, store.health[2].Failures)
+
+	_, err = monitor.CheckDue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, store.health[2].Failures)
+	require.False(t, store.health[2].BrokenSince.IsZero())
+	require.True(t, store.health[1].BrokenSince.IsZero())
+	require.Len(t, store.checks[1], 2)
+	// Statuses that are not broken do not make their links broken.
+	require.Len(t, store.checks[6], 2)
+	require.Zero(t, store.health[6].Failures)
+	require.True(t, store.health[6].BrokenSince.IsZero())
+}
+
+func TestRedirectFallback(t *testing.T) {
+	broken := LinkHealth{Status: http.StatusNotFound, Failures: 3, BrokenSince: time.Now().Add(-time.Hour)}
+	links := map[string]*Link{
+		"working0001": {OriginalURL: "https://example.com/page", FallbackURL: "https://example.com/"},
+		"broken00001": {OriginalURL: "https://example.com/page", FallbackURL: "https://example.com/", Health: broken},
+		"nofallback1": {OriginalURL: "https://example.com/page", Health: broken},
+	}
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, alias string) (*Link, error) {
+				return links[alias], nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+
+	for alias, want := range map[string]string{
+		"working0001": "https://example.com/page",
+		"broken00001": "https://example.com/",
+		"nofallback1": "https://example.com/page",
+	} {
+		resp, err := newClient().Get(server.URL + "/r/" + alias)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, want, resp.Header.Get(echo.HeaderLocation), alias)
+		if links[alias].FallbackURL != "" {
+			require.Equal(t, "no-store", resp.Header.Get(echo.HeaderCacheControl), alias)
+		}
+	}
+}
+
+func TestBrokenLinksAPI(t *testing.T) {
+	brokenSince := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	app := &Application{
+		BaseURL: "http://localhost:8080",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			brokenFn: func(_ context.Context, owner string, _ int) ([]Link, error) {
+				require.Equal(t, "user:1", owner)
+				return []Link{{
+					Owner:       owner,
+					Alias:       "abcdefghijk",
+					OriginalURL: "https://example.com/deleted",
+					FallbackURL: "https://example.com/",
+					Health:      LinkHealth{Status: http.StatusNotFound, Failures: 3, BrokenSince: brokenSince},
+				}}, nil
+			},
+			checksFn: func(_ context.Context, owner, alias string) ([]LinkCheck, error) {
+				if alias != "abcdefghijk" {
+					return nil, ErrRecordNotFound
+				}
+				return []LinkCheck{{Status: http.StatusNotFound, CheckedAt: brokenSince}}, nil
+			},
+		},
+	}
+
+	e := newTestEcho()
+	get := func(handler echo.HandlerFunc, owner, alias string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.SetParamNames("alias")
+		c.SetParamValues(alias)
+		if owner != "" {
+			c.Set("owner", owner)
+		}
+		if err := handler(c); err != nil {
+			app.CustomHTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	rec := get(app.ListBrokenLinksAPI, "user:1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var broken struct {
+		Links []linkResponse `json:"links"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &broken))
+	require.Len(t, broken.Links, 1)
+	require.Equal(t, "https://example.com/", broken.Links[0].FallbackURL)
+	require.Equal(t, 3, broken.Links[0].Health.Failures)
+	require.True(t, brokenSince.Equal(broken.Links[0].Health.BrokenSince))
+
+	rec = get(app.LinkChecksAPI, "user:1", "abcdefghijk")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"checks":[{"status":404,"checked_at":"2026-10-01T00:00:00Z"}]}`, rec.Body.String())
+
+	require.Equal(t, http.StatusNotFound, get(app.LinkChecksAPI, "user:1", "missing").Code)
+	require.Equal(t, http.StatusUnauthorized, get(app.ListBrokenLinksAPI, "", "").Code)
+	require.Equal(t, http.StatusUnauthorized, get(app.LinkChecksAPI, "", "abcdefghijk").Code)
+}
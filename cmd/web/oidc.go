@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const oidcStateCookieName = "oidc_auth"
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// GroupsClaim names the ID token claim listing the groups of the user.
+	GroupsClaim string
+	// RoleMap maps group names to roles. Users in no mapped group get RoleUser.
+	RoleMap    map[string]string
+	HTTPClient *http.Client
+}
+
+type OIDCIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Role          string
+}
+
+// OIDCProvider implements the authorization code flow with PKCE against a
+// provider found through OpenID Connect discovery. ID tokens must be signed
+// with RS256.
+type OIDCProvider struct {
+	config   OIDCConfig
+	metadata oidcMetadata
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	p := &OIDCProvider{config: config}
+	wellKnown := strings.TrimSuffix(config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &p.metadata); err != nil {
+		return nil, fmt.Errorf("discover provider: %w", err)
+	}
+	if p.metadata.Issuer != config.IssuerURL {
+		return nil, fmt.Errorf("discovered issuer %q does not match %q", p.metadata.Issuer, config.IssuerURL)
+	}
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete provider metadata")
+	}
+	return p, nil
+}
+
+// ParseRoleMap parses a role mapping of the form group=role,group=role.
+func ParseRoleMap(s string) (map[string]string, error) {
+	roles := map[string]string{}
+	for pair := range strings.SplitSeq(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || group == "" {
+			return nil, fmt.Errorf("invalid role mapping %q: want group=role", pair)
+		}
+		if role != RoleUser && role != RoleAdmin {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		roles[group] = role
+	}
+	return roles, nil
+}
+
+type oidcAuthState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// AuthCodeURL starts a login and returns the provider URL to redirect to
+// along with the state that has to be kept until the callback.
+func (p *OIDCProvider) AuthCodeURL() (string, oidcAuthState, error) {
+	var st oidcAuthState
+	var err error
+	if st.State, err = randomToken(); err != nil {
+		return "", st, err
+	}
+	if st.Nonce, err = randomToken(); err != nil {
+		return "", st, err
+	}
+	if st.Verifier, err = randomToken(); err != nil {
+		return "", st, err
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+
+	u, err := url.Parse(p.metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", st, fmt.Errorf("parse authorization endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), st, nil
+}
+
+// Exchange redeems the authorization code and verifies the returned ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, st oidcAuthState) (*OIDCIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {st.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("create token request: %w", err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("parse token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+	return p.VerifyIDToken(ctx, tokens.IDToken, st.Nonce)
+}
+
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, token, nonce string) (*OIDCIdentity, error) {
+	header, payload, signingInput, signature, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyRS256(key, signingInput, signature); err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Issuer        string   `json:"iss"`
+		Subject       string   `json:"sub"`
+		Audience      audience `json:"aud"`
+		AuthorizedBy  string   `json:"azp"`
+		Expiry        int64    `json:"exp"`
+		Nonce         string   `json:"nonce"`
+		Email         string   `json:"email"`
+		EmailVerified bool     `json:"email_verified"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: parse claims: %v", ErrInvalidToken, err)
+	}
+	switch {
+	case claims.Issuer != p.metadata.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	case !slices.Contains(claims.Audience, p.config.ClientID):
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, fmt.Errorf("%w: unexpected authorized party", ErrInvalidToken)
+	case time.Now().After(time.Unix(claims.Expiry, 0).Add(time.Minute)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	case claims.Email == "":
+		return nil, fmt.Errorf("%w: missing email claim", ErrInvalidToken)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("%w: parse claims: %v", ErrInvalidToken, err)
+	}
+	var groups []string
+	if g, ok := raw[p.config.GroupsClaim]; ok {
+		_ = json.Unmarshal(g, &groups)
+	}
+
+	return &OIDCIdentity{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: claims.EmailVerified,
+		Role:          p.role(groups),
+	}, nil
+}
+
+func (p *OIDCProvider) role(groups []string) string {
+	for _, g := range groups {
+		if p.config.RoleMap[g] == RoleAdmin {
+			return RoleAdmin
+		}
+	}
+	return RoleUser
+}
+
+// key returns the signing key with the given ID, refreshing the key set when
+// the key is unknown so that provider key rotation is picked up.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch signing keys: %w", err)
+	}
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", u, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: status %d", u, resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("decode %s: %w", u, err)
+	}
+	return nil
+}
+
+func (app *Application) OIDCLogin(c echo.Context) error {
+	if app.OIDC == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+	authURL, st, err := app.OIDC.AuthCodeURL()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("encode oidc state: %w", err)
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/auth/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   app.secureCookies(),
+		// The callback is a top-level cross-site navigation from the provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+func (app *Application) OIDCCallback(c echo.Context) error {
+	if app.OIDC == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+
+	failed := func(msg string) error {
+		return c.Render(http.StatusUnauthorized, "login.html", app.pageData(c, map[string]any{"error": msg}))
+	}
+
+	cookie, err := c.Cookie(oidcStateCookieName)
+	if err != nil {
+		return failed("your sign-in session has expired, please try again")
+	}
+	c.SetCookie(&http.Cookie{Name: oidcStateCookieName, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true, Secure: app.secureCookies()})
+
+	var st oidcAuthState
+	raw, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || json.Unmarshal(raw, &st) != nil || st.State == "" || c.QueryParam("state") != st.State {
+		return failed("invalid sign-in state, please try again")
+	}
+	if e := c.QueryParam("error"); e != "" {
+		app.Logger.Warn("oidc provider returned an error", "error", e, "description", c.QueryParam("error_description"))
+		return failed("sign-in was cancelled or denied")
+	}
+
+	identity, err := app.OIDC.Exchange(c.Request().Context(), c.QueryParam("code"), st)
+	if err != nil {
+		app.Logger.Warn("oidc sign-in failed", "error", err)
+		return failed("sign-in failed")
+	}
+
+	user, err := app.Users.UpsertOIDCUser(c.Request().Context(), identity)
+	if err != nil {
+		if errors.Is(err, ErrDuplicateEmail) {
+			return failed("an account with this email already exists, log in with your password")
+		}
+		return err
+	}
+
+	if err := app.startSession(c, user); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider that signs in
+// everyone who reaches the authorization endpoint as the configured subject.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	mu       sync.Mutex
+	requests map[string]url.Values
+	// claims is merged into every ID token issued.
+	claims map[string]any
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := &mockOIDCProvider{
+		key:          key,
+		clientID:     "url-shortener",
+		clientSecret: "s3cret",
+		requests:     map[string]url.Values{},
+		claims: map[string]any{
+			"sub":            "alice-id",
+			"email":          "Alice@Example.com",
+			"email_verified": true,
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "key-1",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != p.clientID || q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		code := rand.Text()
+		p.mu.Lock()
+		p.requests[code] = q
+		p.mu.Unlock()
+
+		redirect, _ := url.Parse(q.Get("redirect_uri"))
+		rq := redirect.Query()
+		rq.Set("code", code)
+		rq.Set("state", q.Get("state"))
+		redirect.RawQuery = rq.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != p.clientID || secret != p.clientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		p.mu.Lock()
+		q, ok := p.requests[r.PostFormValue("code")]
+		delete(p.requests, r.PostFormValue("code"))
+		p.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || q.Get("redirect_uri") != r.PostFormValue("redirect_uri") ||
+			q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{
+			"access_token": "opaque",
+			"token_type":   "Bearer",
+			"id_token":     p.idToken(t, p.key, map[string]any{"nonce": q.Get("nonce")}),
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// idToken signs the provider's claims, overridden by extra, with key.
+func (p *mockOIDCProvider) idToken(t *testing.T, key *rsa.PrivateKey, extra map[string]any) string {
+	t.Helper()
+	claims := map[string]any{
+		"iss": p.URL,
+		"aud": p.clientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	}
+	p.mu.Lock()
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	p.mu.Unlock()
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: "key-1", Typ: "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	require.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *mockOIDCProvider) setClaim(name string, value any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.claims[name] = value
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newOIDCTestServer(t *testing.T) (*httptest.Server, *mockOIDCProvider, *memoryUserStore) {
+	t.Helper()
+	idp := newMockOIDCProvider(t)
+	users := newMemoryUserStore()
+	app := &Application{
+		Logger: slog.New(slog.DiscardHandler),
+		Users:  users,
+		Repo: &mockRepo{
+			listLinksFn: func(context.Context, string, int) ([]Link, error) { return nil, nil },
+		},
+	}
+	server := httptest.NewTLSServer(app.Router())
+	t.Cleanup(server.Close)
+	app.BaseURL = server.URL
+
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		IssuerURL:    idp.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.clientSecret,
+		RedirectURL:  server.URL + "/auth/oidc/callback",
+		RoleMap:      map[string]string{"shortener-admins": RoleAdmin},
+	})
+	require.NoError(t, err)
+	app.OIDC = provider
+	return server, idp, users
+}
+
+// oidcLogin follows the redirects of a sign-in through the provider and
+// returns the response of the callback.
+func oidcLogin(t *testing.T, client *http.Client, serverURL string) *http.Response {
+	t.Helper()
+	u := serverURL + "/auth/oidc/login"
+	for range 2 {
+		resp, err := client.Get(u)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		u = resp.Header.Get("Location")
+	}
+	require.True(t, strings.HasPrefix(u, serverURL+"/auth/oidc/callback?"), u)
+
+	resp, err := client.Get(u)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, resp.Body.Close()) })
+	return resp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	server, idp, users := newOIDCTestServer(t)
+	client := newBrowser(t)
+
+	status, body := getPage(t, client, server.URL+"/login")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `href="/auth/oidc/login"`)
+
+	resp := oidcLogin(t, client, server.URL)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Len(t, users.users, 1)
+	require.Equal(t, "alice@example.com", users.users[0].Email)
+	require.Equal(t, RoleUser, users.users[0].Role)
+
+	_, body = getPage(t, client, server.URL+"/")
+	require.Contains(t, body, "alice@example.com")
+
+	// Signing in again maps to the same account and refreshes the role.
+	idp.setClaim("groups", []string{"everyone", "shortener-admins"})
+	resp = oidcLogin(t, newBrowser(t), server.URL)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Len(t, users.users, 1)
+	require.Equal(t, RoleAdmin, users.users[0].Role)
+}
+
+func TestOIDCCallbackRejectsForgedState(t *testing.T) {
+	server, _, users := newOIDCTestServer(t)
+	client := newBrowser(t)
+
+	resp, err := client.Get(server.URL + "/auth/oidc/login")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	status, _ := getPage(t, client, server.URL+"/auth/oidc/callback?code=abc&state=forged")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = getPage(t, newBrowser(t), server.URL+"/auth/oidc/callback?code=abc&state=forged")
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Empty(t, users.users)
+}
+
+func TestOIDCDoesNotLinkExistingAccount(t *testing.T) {
+	server, idp, users := newOIDCTestServer(t)
+	_, err := users.CreateUser(context.Background(), "alice@example.com", "hash")
+	require.NoError(t, err)
+
+	// Local accounts do not verify their email, so whoever registered it
+	// first must not be handed over, whatever the provider says.
+	for _, verified := range []bool{false, true} {
+		idp.setClaim("email_verified", verified)
+		resp := oidcLogin(t, newBrowser(t), server.URL)
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Len(t, users.users, 1)
+		require.Empty(t, users.identities)
+		require.Empty(t, users.sessions)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newMockOIDCProvider(t)
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		IssuerURL: idp.URL,
+		ClientID:  idp.clientID,
+	})
+	require.NoError(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	identity, err := provider.VerifyIDToken(context.Background(), idp.idToken(t, idp.key, map[string]any{"nonce": "n"}), "n")
+	require.NoError(t, err)
+	require.Equal(t, &OIDCIdentity{
+		Issuer:        idp.URL,
+		Subject:       "alice-id",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Role:          RoleUser,
+	}, identity)
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		claims map[string]any
+	}{
+		{"wrong nonce", idp.key, map[string]any{"nonce": "other"}},
+		{"wrong audience", idp.key, map[string]any{"nonce": "n", "aud": "someone-else"}},
+		{"wrong issuer", idp.key, map[string]any{"nonce": "n", "iss": "https://evil.example.com"}},
+		{"expired", idp.key, map[string]any{"nonce": "n", "exp": time.Now().Add(-time.Hour).Unix()}},
+		{"missing email", idp.key, map[string]any{"nonce": "n", "email": ""}},
+		{"bad signature", otherKey, map[string]any{"nonce": "n"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := provider.VerifyIDToken(context.Background(), idp.idToken(t, tc.key, tc.claims), "n")
+			require.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+
+	t.Run("unsigned", func(t *testing.T) {
+		token := idp.idToken(t, idp.key, map[string]any{"nonce": "n"})
+		parts := strings.Split(token, ".")
+		parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		_, err := provider.VerifyIDToken(context.Background(), parts[0]+"."+parts[1]+".", "n")
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestParseRoleMap(t *testing.T) {
+	roles, err := ParseRoleMap("admins=admin, staff=user,")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"admins": RoleAdmin, "staff": RoleUser}, roles)
+
+	_, err = ParseRoleMap("admins=root")
+	require.Error(t, err)
+	_, err = ParseRoleMap("admins")
+	require.Error(t, err)
+}
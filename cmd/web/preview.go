@@ -0,0 +1,95 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// LinkPreview is the Open Graph metadata shown when a short URL is shared in
+// a chat or a social network.
+type LinkPreview struct {
+	Title       string `json:"title" validate:"max=200"`
+	Description string `json:"description" validate:"max=1000"`
+	Image       string `json:"image" validate:"omitempty,http_url,max=500"`
+}
+
+// unfurlBots are User-Agent tokens of the crawlers that fetch short URLs to
+// build link previews.
+var unfurlBots = []string{
+	"Slackbot",
+	"Twitterbot",
+	"facebookexternalhit",
+	"Discordbot",
+	"LinkedInBot",
+	"TelegramBot",
+	"WhatsApp",
+}
+
+// IsUnfurlBot reports whether a User-Agent header belongs to a link preview
+// crawler.
+func IsUnfurlBot(userAgent string) bool {
+	for _, bot := range unfurlBots {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// preview answers an unfurl bot with the Open Graph tags of link, without
+// counting a click. Links that visitors cannot follow right now, or only by
+// spending their single click, get what a visitor would get instead.
+func (app *Application) preview(c echo.Context, alias string) error {
+	link, err := app.Repo.PeekLink(c.Request().Context(), alias)
+	if err != nil {
+		return linkLookupError(c, err)
+	}
+	if link.MaxClicks > 0 && link.Clicks >= int64(link.MaxClicks) {
+		return linkLookupError(c, ErrClickLimitReached)
+	}
+	if phase := link.Phase(time.Now()); phase != LinkActive {
+		return app.inactiveLink(c, link, phase)
+	}
+	if link.OneTime {
+		return confirmPage(c)
+	}
+	link = link.WithFallback()
+
+	extraPath := strings.TrimPrefix(c.Request().URL.EscapedPath(), "/r/"+alias)
+	destination, err := link.Destination(extraPath, c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "requested resource could not be found"})
+	}
+
+	// The destination's own metadata stands in for a preview that was not
+	// set.
+	title := cmp.Or(link.Preview.Title, link.Metadata.Title)
+	shortURL := app.BaseURL + "/r/" + alias
+	if link.MaxClicks > 0 {
+		// Each click of a limited link counts, and previews are free, so
+		// they do not tell where the link leads.
+		destination = shortURL
+		title = cmp.Or(title, shortURL)
+	} else if title == "" {
+		// Without a title, previews at least show where the link leads.
+		if u, err := url.Parse(destination); err == nil {
+			title = u.Host
+		}
+	}
+	if policy := link.CachePolicy(app.permanentRedirectMaxAge()); policy != "" {
+		c.Response().Header().Set(echo.HeaderCacheControl, policy)
+	}
+	return c.Render(http.StatusOK, "preview.html", map[string]any{
+		"title":       title,
+		"description": cmp.Or(link.Preview.Description, link.Metadata.Description),
+		"image":       link.Preview.Image,
+		"favicon":     link.Metadata.Favicon,
+		"url":         destination,
+		"shortURL":    shortURL,
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsUnfurlBot(t *testing.T) {
+	for _, ua := range []string{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+		"Twitterbot/1.0",
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+		"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)",
+	} {
+		require.True(t, IsUnfurlBot(ua), ua)
+	}
+	require.False(t, IsUnfurlBot(iphoneUserAgent))
+	require.False(t, IsUnfurlBot(""))
+}
+
+func TestRedirectPreview(t *testing.T) {
+	links := map[string]*Link{
+		"withpreview": {
+			OriginalURL: "https://example.com/launch",
+			Preview:     LinkPreview{Title: "Launch <day>", Description: "Everything new", Image: "https://example.com/card.png"},
+		},
+		"nopreview01": {OriginalURL: "https://example.com/plain"},
+		"fetchedmeta": {
+			OriginalURL: "https://example.com/fetched",
+			Metadata:    LinkMetadata{Title: "Fetched", Description: "From the page", Favicon: "https://example.com/icon.png"},
+		},
+	}
+	app := &Application{
+		BaseURL: "https://sho.rt",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			getLinkFn: func(_ context.Context, _ string) (*Link, error) {
+				t.Fatal("previews must not count clicks")
+				return nil, nil
+			},
+			peekLinkFn: func(_ context.Context, alias string) (*Link, error) {
+				return links[alias], nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+
+	get := func(alias string) string {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/r/"+alias, nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+		resp, err := newClient().Do(req)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	body := get("withpreview")
+	require.Contains(t, body, `<meta property="og:title" content="Launch &lt;day&gt;"/>`)
+	require.Contains(t, body, `<meta property="og:description" content="Everything new"/>`)
+	require.Contains(t, body, `<meta property="og:image" content="https://example.com/card.png"/>`)
+	require.Contains(t, body, `<meta property="og:url" content="https://sho.rt/r/withpreview"/>`)
+	require.Contains(t, body, `<meta name="twitter:card" content="summary_large_image"/>`)
+
+	body = get("nopreview01")
+	require.Contains(t, body, `<meta property="og:title" content="example.com"/>`)
+	require.Contains(t, body, `<meta name="twitter:card" content="summary"/>`)
+	require.NotContains(t, body, "og:image")
+
+	// Fetched metadata fills in for a missing preview.
+	body = get("fetchedmeta")
+	require.Contains(t, body, `<meta property="og:title" content="Fetched"/>`)
+	require.Contains(t, body, `<meta property="og:description" content="From the page"/>`)
+	require.Contains(t, body, `<link rel="icon" href="https://example.com/icon.png"/>`)
+}
+
+func TestRedirectPreviewHidesUnavailableLinks(t *testing.T) {
+	links := map[string]*Link{
+		"onetime": {OriginalURL: "https://example.com/secret", MaxClicks: 1, OneTime: true},
+		"spent":   {OriginalURL: "https://example.com/secret", MaxClicks: 3, Clicks: 3},
+		"expired": {OriginalURL: "https://example.com/secret", ActiveUntil: time.Now().Add(-time.Hour)},
+		"moved": {
+			OriginalURL: "https://example.com/secret",
+			ActiveUntil: time.Now().Add(-time.Hour),
+			ExpiredURL:  "https://example.com/over",
+		},
+		"limited": {OriginalURL: "https://example.com/secret", MaxClicks: 3, Clicks: 1},
+	}
+	app := &Application{
+		BaseURL: "https://sho.rt",
+		Logger:  slog.New(slog.DiscardHandler),
+		Repo: &mockRepo{
+			peekLinkFn: func(_ context.Context, alias string) (*Link, error) {
+				return links[alias], nil
+			},
+		},
+	}
+	server := httptest.NewServer(app.Router())
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		alias    string
+		status   int
+		location string
+	}{
+		{"onetime", http.StatusOK, ""},
+		{"spent", http.StatusGone, ""},
+		{"expired", http.StatusGone, ""},
+		{"moved", http.StatusFound, "https://example.com/over"},
+		{"limited", http.StatusOK, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.alias, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/r/"+tc.alias, nil)
+			require.NoError(t, err)
+			req.Header.Set("User-Agent", "Twitterbot/1.0")
+			resp, err := newClient().Do(req)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resp.Body.Close()) }()
+			require.Equal(t, tc.status, resp.StatusCode)
+			require.Equal(t, tc.location, resp.Header.Get("Location"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NotContains(t, string(body), "secret")
+		})
+	}
+}
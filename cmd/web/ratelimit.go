@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+type RateLimitPolicy struct {
+	Rate      rate.Limit
+	Burst     int
+	ExpiresIn time.Duration
+}
+
+func DefaultRateLimitPolicies() map[string]RateLimitPolicy {
+	return map[string]RateLimitPolicy{
+		"default":  {Rate: 20, Burst: 40, ExpiresIn: time.Minute},
+		"shorten":  {Rate: 2, Burst: 20, ExpiresIn: time.Minute},
+		"redirect": {Rate: 100, Burst: 200, ExpiresIn: time.Minute},
+		"auth":     {Rate: 0.2, Burst: 10, ExpiresIn: 5 * time.Minute},
+	}
+}
+
+// ParseRateLimitPolicy parses a policy override of the form name=rate:burst.
+func ParseRateLimitPolicy(s string) (string, RateLimitPolicy, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", RateLimitPolicy{}, fmt.Errorf("invalid rate limit policy %q: want name=rate:burst", s)
+	}
+	rateValue, burstValue, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", RateLimitPolicy{}, fmt.Errorf("invalid rate limit policy %q: want name=rate:burst", s)
+	}
+	r, err := strconv.ParseFloat(rateValue, 64)
+	if err != nil || r < 0 {
+		return "", RateLimitPolicy{}, fmt.Errorf("invalid rate in policy %q", s)
+	}
+	burst, err := strconv.Atoi(burstValue)
+	if err != nil || burst < 0 || (r > 0 && burst == 0) {
+		return "", RateLimitPolicy{}, fmt.Errorf("invalid burst in policy %q", s)
+	}
+	return name, RateLimitPolicy{Rate: rate.Limit(r), Burst: burst, ExpiresIn: time.Minute}, nil
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore is a middleware.RateLimiterStore that also reports the state
+// of the bucket, so that RateLimit-* headers can be sent with every response.
+type RateLimitStore interface {
+	middleware.RateLimiterStore
+	Take(identifier string) (RateLimitResult, error)
+}
+
+type MemoryRateLimitStore struct {
+	policy RateLimitPolicy
+
+	mu          sync.Mutex
+	visitors    map[string]*visitor
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewMemoryRateLimitStore(policy RateLimitPolicy) *MemoryRateLimitStore {
+	if policy.ExpiresIn == 0 {
+		policy.ExpiresIn = time.Minute
+	}
+	return &MemoryRateLimitStore{
+		policy:      policy,
+		visitors:    make(map[string]*visitor),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+func (s *MemoryRateLimitStore) Allow(identifier string) (bool, error) {
+	res, err := s.Take(identifier)
+	return res.Allowed, err
+}
+
+func (s *MemoryRateLimitStore) Take(identifier string) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	v, ok := s.visitors[identifier]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(s.policy.Rate, s.policy.Burst)}
+		s.visitors[identifier] = v
+	}
+	v.lastSeen = now
+	if now.Sub(s.lastCleanup) > s.policy.ExpiresIn {
+		for id, v := range s.visitors {
+			if now.Sub(v.lastSeen) > s.policy.ExpiresIn {
+				delete(s.visitors, id)
+			}
+		}
+		s.lastCleanup = now
+	}
+
+	allowed := v.limiter.AllowN(now, 1)
+	return bucketResult(s.policy, allowed, v.limiter.TokensAt(now)), nil
+}
+
+func bucketResult(policy RateLimitPolicy, allowed bool, tokens float64) RateLimitResult {
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     policy.Burst,
+		Remaining: max(0, int(math.Floor(tokens))),
+	}
+	if policy.Rate > 0 {
+		res.Reset = secondsToDuration((float64(policy.Burst) - tokens) / float64(policy.Rate))
+		if !allowed {
+			res.RetryAfter = secondsToDuration((1 - tokens) / float64(policy.Rate))
+		}
+	}
+	return res
+}
+
+func secondsToDuration(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimit returns a middleware enforcing the named policy. Unknown policies
+// and policies with a zero rate disable rate limiting for the route.
+func (app *Application) RateLimit(name string) echo.MiddlewareFunc {
+	policies := app.RateLimitPolicies
+	if policies == nil {
+		policies = DefaultRateLimitPolicies()
+	}
+	policy, ok := policies[name]
+	if !ok || policy.Rate <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+	store := app.newRateLimitStore(name, policy)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			res, err := store.Take(app.rateLimitIdentifier(c))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusForbidden, "forbidden").SetInternal(err)
+			}
+
+			h := c.Response().Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Burst, ceilSeconds(secondsToDuration(float64(policy.Burst)/float64(policy.Rate)))))
+
+			if !res.Allowed {
+				h.Set(echo.HeaderRetryAfter, strconv.Itoa(max(1, ceilSeconds(res.RetryAfter))))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "too many requests")
+			}
+			return next(c)
+		}
+	}
+}
+
+func (app *Application) newRateLimitStore(name string, policy RateLimitPolicy) RateLimitStore {
+	if app.RateLimitBackend == "postgres" && app.DB != nil {
+		store := NewPgRateLimitStore(app.DB, name, policy, app.RateLimitDBTimeout, app.Logger)
+		if app.RateLimitDBCooldown > 0 {
+			store.Cooldown = app.RateLimitDBCooldown
+		}
+		return store
+	}
+	return NewMemoryRateLimitStore(policy)
+}
+
+// rateLimitIdentifier keys limits by the presented API token when
+// Authenticate accepted it recently and by the client IP otherwise. Limits run
+// before authentication, so unknown tokens, which could be made up for every
+// request, share the bucket of the client IP.
+func (app *Application) rateLimitIdentifier(c echo.Context) string {
+	if key := presentedToken(c); key != "" {
+		if hash := tokenKeyHash(key); app.verifiedTokens.has(hash, time.Now()) {
+			return "key:" + hash
+		}
+	}
+	return "ip:" + c.RealIP()
+}
+
+// tokenKeyHash hashes a presented token so that it never ends up in memory
+// or storage in clear text.
+func tokenKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// verifiedTokenTTL is how long a token accepted by Authenticate keeps its own
+// rate limit bucket without being verified again.
+const verifiedTokenTTL = 10 * time.Minute
+
+// verifiedTokens remembers the hashes of the tokens Authenticate accepted.
+// The zero value is ready to use.
+type verifiedTokens struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastPrune time.Time
+}
+
+func (v *verifiedTokens) add(hash string, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.expires == nil {
+		v.expires = map[string]time.Time{}
+	}
+	v.expires[hash] = now.Add(verifiedTokenTTL)
+	if now.Sub(v.lastPrune) > verifiedTokenTTL {
+		for h, expires := range v.expires {
+			if now.After(expires) {
+				delete(v.expires, h)
+			}
+		}
+		v.lastPrune = now
+	}
+}
+
+func (v *verifiedTokens) has(hash string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	expires, ok := v.expires[hash]
+	return ok && now.Before(expires)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
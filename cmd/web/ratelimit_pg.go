@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// PgRateLimitStore keeps token buckets in Postgres so that all replicas share
+// the same limits. Every Take is a single atomic upsert that refills the
+// bucket for the elapsed time and consumes one token when available. When the
+// database errors or does not answer within Timeout, the local Fallback store
+// decides instead, and keeps deciding for Cooldown so that an outage does not
+// stall every request.
+type PgRateLimitStore struct {
+	DB       *sql.DB
+	Name     string
+	Policy   RateLimitPolicy
+	Timeout  time.Duration
+	Cooldown time.Duration
+	Fallback RateLimitStore
+	Logger   *slog.Logger
+
+	mu          sync.Mutex
+	lastCleanup time.Time
+	// fallbackUntil is the end of the current cooldown and lastWarning the
+	// time the outage was last logged.
+	fallbackUntil time.Time
+	lastWarning   time.Time
+	now           func() time.Time
+}
+
+// pgRateLimitWarnInterval is the least time between two warnings about the
+// database being unavailable.
+const pgRateLimitWarnInterval = time.Minute
+
+func NewPgRateLimitStore(db *sql.DB, name string, policy RateLimitPolicy, timeout time.Duration, logger *slog.Logger) *PgRateLimitStore {
+	if policy.ExpiresIn == 0 {
+		policy.ExpiresIn = time.Minute
+	}
+	if timeout == 0 {
+		timeout = 50 * time.Millisecond
+	}
+	return &PgRateLimitStore{
+		DB:          db,
+		Name:        name,
+		Policy:      policy,
+		Timeout:     timeout,
+		Cooldown:    5 * time.Second,
+		Fallback:    NewMemoryRateLimitStore(policy),
+		Logger:      logger,
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+func (s *PgRateLimitStore) Allow(identifier string) (bool, error) {
+	res, err := s.Take(identifier)
+	return res.Allowed, err
+}
+
+func (s *PgRateLimitStore) Take(identifier string) (RateLimitResult, error) {
+	s.mu.Lock()
+	coolingDown := s.now().Before(s.fallbackUntil)
+	s.mu.Unlock()
+	if coolingDown {
+		return s.Fallback.Take(identifier)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	res, err := s.take(ctx, identifier)
+	if err != nil {
+		s.mu.Lock()
+		now := s.now()
+		s.fallbackUntil = now.Add(s.Cooldown)
+		warn := now.Sub(s.lastWarning) >= pgRateLimitWarnInterval
+		if warn {
+			s.lastWarning = now
+		}
+		s.mu.Unlock()
+		if warn {
+			s.Logger.Warn("rate limit store unavailable, using local fallback", "policy", s.Name, "retry_in", s.Cooldown, "error", err)
+		}
+		return s.Fallback.Take(identifier)
+	}
+
+	s.mu.Lock()
+	cleanup := time.Since(s.lastCleanup) > s.Policy.ExpiresIn
+	if cleanup {
+		s.lastCleanup = time.Now()
+	}
+	s.mu.Unlock()
+	if cleanup {
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		if err := s.cleanup(ctx); err != nil {
+			s.Logger.Warn("failed to clean up rate limit buckets", "policy", s.Name, "error", err)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *PgRateLimitStore) take(ctx context.Context, identifier string) (RateLimitResult, error) {
+	stmt := `INSERT INTO rate_limit_buckets AS b (policy, identifier, tokens, allowed, updated_at)
+	VALUES ($1, $2, $3::float8 - 1, TRUE, NOW())
+	ON CONFLICT (policy, identifier) DO UPDATE SET
+		tokens = CASE
+			WHEN LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at) * $4::float8) >= 1
+			THEN LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at) * $4::float8) - 1
+			ELSE LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at) * $4::float8)
+		END,
+		allowed = LEAST($3::float8, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at) * $4::float8) >= 1,
+		updated_at = NOW()
+	RETURNING tokens, allowed;`
+
+	var tokens float64
+	var allowed bool
+	err := s.DB.QueryRowContext(ctx, stmt, s.Name, identifier, s.Policy.Burst, float64(s.Policy.Rate)).Scan(&tokens, &allowed)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take token: %w", err)
+	}
+	return bucketResult(s.Policy, allowed, tokens), nil
+}
+
+func (s *PgRateLimitStore) cleanup(ctx context.Context) error {
+	stmt := `DELETE FROM rate_limit_buckets WHERE policy = $1 AND updated_at < NOW() - make_interval(secs => $2);`
+	if _, err := s.DB.ExecContext(ctx, stmt, s.Name, s.Policy.ExpiresIn.Seconds()); err != nil {
+		return fmt.Errorf("delete stale buckets: %w", err)
+	}
+	return nil
+}
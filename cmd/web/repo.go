@@ -1,20 +1,101 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrDuplicateAlias = errors.New("duplicate alias")
+	// ErrDuplicateURL is returned when removing the click limit of a link
+	// would make it a duplicate of another link of the owner.
+	ErrDuplicateURL   = errors.New("the owner already has a link to this URL without a click limit")
+	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
-var ErrRecordNotFound = errors.New("record not found")
+type Link struct {
+	ID int64
+	// Owner is the namespace the link belongs to, such as "user:42". Links are
+	// only deduplicated within the same owner. Anonymous links have no owner.
+	Owner        string
+	OriginalURL  string
+	CanonicalURL string
+	Alias        string
+	Clicks       int64
+	// RedirectStatus is the 3xx status code Redirect answers with.
+	RedirectStatus int
+	// CacheControl is the Cache-Control header requested for redirects. See
+	// CachePolicy for the header that is actually sent.
+	CacheControl string
+	// Passthrough links accept extra path segments and query parameters after
+	// the alias and forward them to the destination. QueryConflict decides
+	// what happens to parameters the destination already has.
+	Passthrough   bool
+	QueryConflict string
+	// Template links fill the placeholders of OriginalURL from the short URL.
+	// See Link.Destination.
+	Template bool
+	// Rules pick another destination for some visitors. The first rule that
+	// matches wins; OriginalURL is used when none does.
+	Rules []Rule
+	// Variants split the visitors that no rule matches between several
+	// destinations. VariantClicks counts the visits to each of them by name.
+	Variants      []Variant
+	VariantClicks map[string]int64
+	// IOSURL and AndroidURL open the link in an app on those platforms. The
+	// destination is the fallback when the app is not installed.
+	IOSURL     string
+	AndroidURL string
+	// ActiveFrom and ActiveUntil bound the time the link redirects, if set.
+	// BeforeActive says what to show until ActiveFrom and ExpiredURL, if set,
+	// is where to send visitors after ActiveUntil.
+	ActiveFrom   time.Time
+	ActiveUntil  time.Time
+	BeforeActive string
+	ExpiredURL   string
+	// MaxClicks, if not 0, is the number of clicks after which the link stops
+	// working. OneTime links have a single click, which a visitor spends by
+	// confirming an interstitial page.
+	MaxClicks int
+	OneTime   bool
+	// Preview is what unfurl bots are shown for the link.
+	Preview LinkPreview
+	// Metadata is what the destination says about itself, as last fetched
+	// by the MetadataFetcher.
+	Metadata LinkMetadata
+	// FallbackURL, if set, replaces the destination while the LinkMonitor
+	// finds it broken.
+	FallbackURL string
+	Health      LinkHealth
+	// DisabledAt is set when an admin has disabled the link.
+	DisabledAt time.Time
+	CreatedAt  time.Time
+}
+
+type User struct {
+	ID    int64
+	Email string
+	// PasswordHash is empty for users that only sign in through OIDC.
+	PasswordHash string
+	Role         string
+	CreatedAt    time.Time
+}
 
 type Repo struct {
 	DB *sql.DB
 }
 
-func (r *Repo) Insert(ctx context.Context, url, alias string) (result string, err error) {
+func (r *Repo) Insert(ctx context.Context, link *Link) (result string, err error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
@@ -27,24 +108,57 @@ func (r *Repo) Insert(ctx context.Context, url, alias string) (result string, er
 			err = fmt.Errorf("rollback tx: %w", rbErr)
 		}
 	}()
+	var id int64
 	var existingAlias string
+	var created bool
 	stmt := `WITH res AS (
-		INSERT INTO urls (original_url, alias) VALUES ($1, $2)
-		ON CONFLICT (original_url)
+		INSERT INTO urls (owner, original_url, canonical_url, alias, redirect_status, cache_control, passthrough, query_conflict, rules, variants, ios_url, android_url,
+			active_from, active_until, before_active, expired_url, max_clicks, one_time,
+			preview_title, preview_description, preview_image, fallback_url, template, plain)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::jsonb, $10::jsonb, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)
+		ON CONFLICT (owner, canonical_url) WHERE plain
 		DO NOTHING
-		RETURNING alias
+		RETURNING id, alias
 	)
-	SELECT alias FROM res
+	SELECT id, alias, TRUE FROM res
 	UNION ALL
-	SELECT alias FROM urls WHERE original_url = $1;`
+	SELECT id, alias, FALSE FROM urls WHERE owner = $1 AND canonical_url = $3 AND plain AND $24;`
+
+	rules, err := encodeJSONList(link.Rules)
+	if err != nil {
+		return "", err
+	}
+	variants, err := encodeJSONList(link.Variants)
+	if err != nil {
+		return "", err
+	}
 
-	err = tx.QueryRowContext(ctx, stmt, url, alias).Scan(&existingAlias)
+	alias := link.Alias
+	err = tx.QueryRowContext(ctx, stmt, link.Owner, link.OriginalURL, link.CanonicalURL, link.Alias,
+		cmp.Or(link.RedirectStatus, DefaultRedirectStatus), link.CacheControl,
+		link.Passthrough, cmp.Or(link.QueryConflict, QueryOverride), rules, variants,
+		link.IOSURL, link.AndroidURL, nullTime(link.ActiveFrom), nullTime(link.ActiveUntil),
+		cmp.Or(link.BeforeActive, BeforeActiveNotFound), link.ExpiredURL,
+		sql.NullInt64{Int64: int64(link.MaxClicks), Valid: link.MaxClicks > 0}, link.OneTime,
+		link.Preview.Title, link.Preview.Description, link.Preview.Image, link.FallbackURL, link.Template, link.Plain()).Scan(&id, &existingAlias, &created)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if isUniqueViolation(err, "urls_alias_key") {
+			return "", ErrDuplicateAlias
+		}
+		if isCheckViolation(err, "urls_active_window_check") {
+			return "", ErrInvalidActiveWindow
+		}
+		if isCheckViolation(err, "urls_one_time_check") {
+			return "", ErrInvalidOneTime
+		}
 		return "", fmt.Errorf("query url: %w", err)
 	}
 	if existingAlias != "" {
 		alias = existingAlias
 	}
+	if created {
+		link.ID = id
+	}
 
 	if err := tx.Commit(); err != nil {
 		return "", fmt.Errorf("commit tx: %w", err)
@@ -52,19 +166,1130 @@ func (r *Repo) Insert(ctx context.Context, url, alias string) (result string, er
 	return alias, nil
 }
 
-func (r *Repo) GetOriginalURL(ctx context.Context, alias string) (string, error) {
+// GetLink returns an enabled link and counts the lookup as a click, unless
+// the link is outside its activation window or is a one-time link, whose
+// click ConfirmLink counts. Links that have used up their clicks return
+// ErrClickLimitReached.
+func (r *Repo) GetLink(ctx context.Context, alias string) (*Link, error) {
+	return r.countClick(ctx, alias, false)
+}
+
+// PeekLink returns an enabled link without counting a click, whether or not
+// it has clicks left.
+func (r *Repo) PeekLink(ctx context.Context, alias string) (*Link, error) {
+	return r.getLink(ctx, `alias = $1 AND disabled_at IS NULL`, alias)
+}
+
+// ConfirmLink is GetLink for a visitor that confirmed the interstitial page
+// of a one-time link.
+func (r *Repo) ConfirmLink(ctx context.Context, alias string) (*Link, error) {
+	return r.countClick(ctx, alias, true)
+}
+
+func (r *Repo) countClick(ctx context.Context, alias string, confirmed bool) (*Link, error) {
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	var originalURL string
-	stmt := `SELECT original_url FROM urls WHERE alias = $1;`
+	// The click limit is checked by the update itself, which concurrent
+	// redirects of the same link wait for, so it cannot be exceeded.
+	stmt := `UPDATE urls SET clicks = clicks +
+		CASE WHEN (NOT one_time OR $2)
+			AND (active_from IS NULL OR active_from <= NOW()) AND (active_until IS NULL OR active_until > NOW())
+		THEN 1 ELSE 0 END
+	WHERE alias = $1 AND disabled_at IS NULL AND (max_clicks IS NULL OR clicks < max_clicks)
+	RETURNING ` + linkColumns + `;`
+	link, err := scanLink(r.DB.QueryRowContext(ctx, stmt, alias, confirmed))
+	if err == nil {
+		return link, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("query link: %w", err)
+	}
 
-	err := r.DB.QueryRowContext(ctx, stmt, alias).Scan(&originalURL)
+	var exhausted bool
+	err = r.DB.QueryRowContext(ctx, `SELECT TRUE FROM urls WHERE alias = $1 AND disabled_at IS NULL AND clicks >= max_clicks;`, alias).Scan(&exhausted)
+	switch {
+	case err == nil:
+		return nil, ErrClickLimitReached
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrRecordNotFound
+	}
+	return nil, fmt.Errorf("query link: %w", err)
+}
+
+// UpdateLink applies the non-nil fields of update to a link of owner.
+// Anonymous links cannot be updated.
+func (r *Repo) UpdateLink(ctx context.Context, owner, alias string, update LinkUpdate) (*Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// Updated links are no longer what shortening their URL again should
+	// hand out.
+	stmt := `UPDATE urls SET
+		redirect_status = COALESCE($3, redirect_status),
+		cache_control = COALESCE($4, cache_control),
+		passthrough = COALESCE($5, passthrough),
+		query_conflict = COALESCE($6, query_conflict),
+		rules = COALESCE($7::jsonb, rules),
+		variants = COALESCE($8::jsonb, variants),
+		ios_url = COALESCE($9, ios_url),
+		android_url = COALESCE($10, android_url),
+		active_from = CASE WHEN $11::boolean THEN $12::timestamptz ELSE active_from END,
+		active_until = CASE WHEN $13::boolean THEN $14::timestamptz ELSE active_until END,
+		before_active = COALESCE($15, before_active),
+		expired_url = COALESCE($16, expired_url),
+		max_clicks = CASE WHEN $17::boolean THEN $18::integer ELSE max_clicks END,
+		one_time = COALESCE($19, one_time),
+		preview_title = COALESCE($20, preview_title),
+		preview_description = COALESCE($21, preview_description),
+		preview_image = COALESCE($22, preview_image),
+		fallback_url = COALESCE($23, fallback_url),
+		plain = FALSE
+	WHERE owner = $1 AND alias = $2 AND owner <> ''
+	RETURNING ` + linkColumns + `;`
+	var rules, variants, previewTitle, previewDescription, previewImage *string
+	if p := update.Preview; p != nil {
+		previewTitle, previewDescription, previewImage = &p.Title, &p.Description, &p.Image
+	}
+	if update.Rules != nil {
+		encoded, err := encodeJSONList(*update.Rules)
+		if err != nil {
+			return nil, err
+		}
+		rules = &encoded
+	}
+	if update.Variants != nil {
+		encoded, err := encodeJSONList(*update.Variants)
+		if err != nil {
+			return nil, err
+		}
+		variants = &encoded
+	}
+	link, err := scanLink(r.DB.QueryRowContext(ctx, stmt, owner, alias, update.RedirectStatus, update.CacheControl,
+		update.Passthrough, update.QueryConflict, rules, variants, update.IOSURL, update.AndroidURL,
+		update.ActiveFrom != nil, optionalTime(update.ActiveFrom), update.ActiveUntil != nil, optionalTime(update.ActiveUntil),
+		update.BeforeActive, update.ExpiredURL, update.MaxClicks != nil, optionalClicks(update.MaxClicks), update.OneTime,
+		previewTitle, previewDescription, previewImage, update.FallbackURL))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", ErrRecordNotFound
+			return nil, ErrRecordNotFound
+		}
+		if isCheckViolation(err, "urls_active_window_check") {
+			return nil, ErrInvalidActiveWindow
+		}
+		if isCheckViolation(err, "urls_one_time_check") {
+			return nil, ErrInvalidOneTime
+		}
+		if isUniqueViolation(err, "urls_owner_canonical_url_key") {
+			return nil, ErrDuplicateURL
+		}
+		return nil, fmt.Errorf("update link: %w", err)
+	}
+	return link, nil
+}
+
+func (r *Repo) NextAliasID(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int64
+	if err := r.DB.QueryRowContext(ctx, `SELECT nextval('alias_seq');`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("next alias id: %w", err)
+	}
+	return id, nil
+}
+
+// idempotencyPurgeBatch is the number of expired keys deleted by each
+// reservation, so that the table does not grow with keys nobody retries.
+const idempotencyPurgeBatch = 100
+
+func (r *Repo) ReserveIdempotencyKey(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (*IdempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `DELETE FROM idempotency_keys WHERE ctid IN (
+		SELECT ctid FROM idempotency_keys WHERE expires_at < NOW() LIMIT $1 FOR UPDATE SKIP LOCKED
+	);`
+	if _, err := r.DB.ExecContext(ctx, stmt, idempotencyPurgeBatch); err != nil {
+		return nil, fmt.Errorf("purge idempotency keys: %w", err)
+	}
+
+	stmt = `INSERT INTO idempotency_keys (scope, key, request_hash, expires_at)
+	VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+	ON CONFLICT (scope, key) DO UPDATE SET
+		request_hash = EXCLUDED.request_hash,
+		status_code = NULL,
+		content_type = '',
+		body = NULL,
+		created_at = NOW(),
+		expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at < NOW()
+		OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < NOW() - INTERVAL '1 minute')
+	RETURNING key;`
+
+	var reserved string
+	err := r.DB.QueryRowContext(ctx, stmt, scope, key, requestHash, ttl.Seconds()).Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("reserve idempotency key: %w", err)
+	}
+
+	var record IdempotencyRecord
+	var statusCode sql.NullInt64
+	stmt = `SELECT request_hash, status_code, content_type, body FROM idempotency_keys WHERE scope = $1 AND key = $2;`
+	err = r.DB.QueryRowContext(ctx, stmt, scope, key).Scan(&record.RequestHash, &statusCode, &record.ContentType, &record.Body)
+	if err != nil {
+		return nil, fmt.Errorf("query idempotency key: %w", err)
+	}
+	record.StatusCode = int(statusCode.Int64)
+	return &record, nil
+}
+
+func (r *Repo) CompleteIdempotencyKey(ctx context.Context, scope, key string, record IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5 WHERE scope = $1 AND key = $2;`
+	if _, err := r.DB.ExecContext(ctx, stmt, scope, key, record.StatusCode, record.ContentType, record.Body); err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status_code IS NULL;`
+	if _, err := r.DB.ExecContext(ctx, stmt, scope, key); err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
+func isCheckViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23514" && pgErr.ConstraintName == constraint
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func optionalTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return nullTime(*t)
+}
+
+// optionalClicks stores a missing or 0 click limit as NULL.
+func optionalClicks(n *int) sql.NullInt64 {
+	if n == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*n), Valid: *n > 0}
+}
+
+func (r *Repo) ListLinks(ctx context.Context, owner string, limit int) ([]Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + linkColumns + ` FROM urls WHERE owner = $1
+	ORDER BY created_at DESC, id DESC
+	LIMIT $2;`
+	return r.queryLinks(ctx, stmt, owner, limit)
+}
+
+const linkColumns = `id, owner, original_url, canonical_url, alias, clicks, redirect_status, cache_control, passthrough, query_conflict, template, rules, variants,
+	COALESCE((SELECT jsonb_object_agg(variant, clicks) FROM variant_clicks WHERE url_id = urls.id), '{}'),
+	ios_url, android_url, active_from, active_until, before_active, expired_url,
+	COALESCE(max_clicks, 0), one_time, preview_title, preview_description, preview_image,
+	meta_title, meta_description, meta_favicon, meta_canonical_url, meta_fetched_at,
+	fallback_url, COALESCE(health_status, 0), health_failures, health_checked_at, broken_since, disabled_at, created_at`
+
+func scanLink(row rowScanner) (*Link, error) {
+	var link Link
+	var rules, variants, variantClicks []byte
+	var activeFrom, activeUntil, metaFetchedAt, healthCheckedAt, brokenSince, disabledAt sql.NullTime
+	err := row.Scan(&link.ID, &link.Owner, &link.OriginalURL, &link.CanonicalURL, &link.Alias, &link.Clicks,
+		&link.RedirectStatus, &link.CacheControl, &link.Passthrough, &link.QueryConflict, &link.Template, &rules, &variants, &variantClicks,
+		&link.IOSURL, &link.AndroidURL, &activeFrom, &activeUntil, &link.BeforeActive, &link.ExpiredURL,
+		&link.MaxClicks, &link.OneTime, &link.Preview.Title, &link.Preview.Description, &link.Preview.Image,
+		&link.Metadata.Title, &link.Metadata.Description, &link.Metadata.Favicon, &link.Metadata.CanonicalURL, &metaFetchedAt,
+		&link.FallbackURL, &link.Health.Status, &link.Health.Failures, &healthCheckedAt, &brokenSince,
+		&disabledAt, &link.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(rules, &link.Rules); err != nil {
+		return nil, fmt.Errorf("decode rules: %w", err)
+	}
+	if err := json.Unmarshal(variants, &link.Variants); err != nil {
+		return nil, fmt.Errorf("decode variants: %w", err)
+	}
+	if err := json.Unmarshal(variantClicks, &link.VariantClicks); err != nil {
+		return nil, fmt.Errorf("decode variant clicks: %w", err)
+	}
+	link.ActiveFrom = activeFrom.Time
+	link.ActiveUntil = activeUntil.Time
+	link.Metadata.FetchedAt = metaFetchedAt.Time
+	link.Health.CheckedAt = healthCheckedAt.Time
+	link.Health.BrokenSince = brokenSince.Time
+	link.DisabledAt = disabledAt.Time
+	return &link, nil
+}
+
+// encodeJSONList returns list as a JSON array, which is empty rather than
+// null when list is.
+func encodeJSONList[T any](list []T) (string, error) {
+	if len(list) == 0 {
+		return "[]", nil
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return "", fmt.Errorf("encode %T: %w", list, err)
+	}
+	return string(b), nil
+}
+
+// CountVariantClick records a visit to a variant of a link.
+func (r *Repo) CountVariantClick(ctx context.Context, linkID int64, variant string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO variant_clicks (url_id, variant, clicks) VALUES ($1, $2, 1)
+	ON CONFLICT (url_id, variant) DO UPDATE SET clicks = variant_clicks.clicks + 1;`
+	if _, err := r.DB.ExecContext(ctx, stmt, linkID, variant); err != nil {
+		return fmt.Errorf("count variant click: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) RefundClick(ctx context.Context, linkID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE urls SET clicks = clicks - 1 WHERE id = $1 AND clicks > 0;`
+	res, err := r.DB.ExecContext(ctx, stmt, linkID)
+	if err != nil {
+		return fmt.Errorf("refund click: %w", err)
+	}
+	return requireAffected(res)
+}
+
+// SetLinkMetadata stores the metadata fetched from the destination of a link.
+func (r *Repo) SetLinkMetadata(ctx context.Context, alias string, meta LinkMetadata) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE urls SET meta_title = $2, meta_description = $3, meta_favicon = $4, meta_canonical_url = $5, meta_fetched_at = $6
+	WHERE alias = $1;`
+	res, err := r.DB.ExecContext(ctx, stmt, alias, meta.Title, meta.Description, meta.Favicon, meta.CanonicalURL, nullTime(meta.FetchedAt))
+	if err != nil {
+		return fmt.Errorf("set link metadata: %w", err)
+	}
+	return requireAffected(res)
+}
+
+// ClaimLinksToCheck returns up to limit links whose destination the
+// LinkMonitor has not checked for at least interval, and marks them as
+// checked now so that other instances skip them.
+func (r *Repo) ClaimLinksToCheck(ctx context.Context, interval time.Duration, limit int) ([]Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// One-time and used up links are not checked, as visiting them is not
+	// expected any more.
+	stmt := `UPDATE urls SET health_checked_at = NOW()
+	WHERE id IN (
+		SELECT id FROM urls
+		WHERE disabled_at IS NULL AND NOT one_time
+			AND (active_until IS NULL OR active_until > NOW())
+			AND (max_clicks IS NULL OR clicks < max_clicks)
+			AND (health_checked_at IS NULL OR health_checked_at < NOW() - make_interval(secs => $1))
+		ORDER BY health_checked_at NULLS FIRST, id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + linkColumns + `;`
+	return r.queryLinks(ctx, stmt, interval.Seconds(), limit)
+}
+
+// RecordLinkCheck stores the result of a check of the destination of a link
+// and returns its health. The link is flagged as broken once threshold
+// checks in a row have failed, and no longer is after a check succeeds.
+// Inconclusive checks leave the failures as they are.
+func (r *Repo) RecordLinkCheck(ctx context.Context, linkID int64, check LinkCheck, threshold int) (result *LinkHealth, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			err = fmt.Errorf("rollback tx: %w", rbErr)
+		}
+	}()
+
+	var health LinkHealth
+	var brokenSince sql.NullTime
+	stmt := `UPDATE urls SET health_status = $2, health_checked_at = $3,
+		health_failures = CASE WHEN $4 THEN health_failures + 1 WHEN $6 THEN health_failures ELSE 0 END,
+		broken_since = CASE
+			WHEN $4 AND health_failures + 1 >= $5 THEN COALESCE(broken_since, $3)
+			WHEN $4 OR $6 THEN broken_since
+			ELSE NULL
+		END
+	WHERE id = $1
+	RETURNING health_status, health_failures, health_checked_at, broken_since;`
+	err = tx.QueryRowContext(ctx, stmt, linkID, check.Status, check.CheckedAt, check.Failed, threshold, check.Inconclusive).
+		Scan(&health.Status, &health.Failures, &health.CheckedAt, &brokenSince)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("update link health: %w", err)
+	}
+	health.BrokenSince = brokenSince.Time
+
+	stmt = `INSERT INTO link_checks (url_id, status, error, checked_at) VALUES ($1, $2, $3, $4);`
+	if _, err := tx.ExecContext(ctx, stmt, linkID, check.Status, check.Error, check.CheckedAt); err != nil {
+		return nil, fmt.Errorf("insert link check: %w", err)
+	}
+	stmt = `DELETE FROM link_checks WHERE url_id = $1 AND id NOT IN (
+		SELECT id FROM link_checks WHERE url_id = $1 ORDER BY checked_at DESC, id DESC LIMIT $2
+	);`
+	if _, err := tx.ExecContext(ctx, stmt, linkID, MaxLinkChecks); err != nil {
+		return nil, fmt.Errorf("trim link checks: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return &health, nil
+}
+
+// ListBrokenLinks returns the links of owner flagged as broken, the longest
+// broken first.
+func (r *Repo) ListBrokenLinks(ctx context.Context, owner string, limit int) ([]Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + linkColumns + ` FROM urls WHERE owner = $1 AND owner <> '' AND broken_since IS NOT NULL
+	ORDER BY broken_since, id LIMIT $2;`
+	return r.queryLinks(ctx, stmt, owner, limit)
+}
+
+// ListLinkChecks returns the latest checks of the destination of a link of
+// owner, newest first.
+func (r *Repo) ListLinkChecks(ctx context.Context, owner, alias string) ([]LinkCheck, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int64
+	err := r.DB.QueryRowContext(ctx, `SELECT id FROM urls WHERE owner = $1 AND alias = $2 AND owner <> '';`, owner, alias).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("query link: %w", err)
+	}
+
+	rows, err := r.DB.QueryContext(ctx, `SELECT status, error, checked_at FROM link_checks
+	WHERE url_id = $1 ORDER BY checked_at DESC, id DESC LIMIT $2;`, id, MaxLinkChecks)
+	if err != nil {
+		return nil, fmt.Errorf("query link checks: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	checks := []LinkCheck{}
+	for rows.Next() {
+		var check LinkCheck
+		if err := rows.Scan(&check.Status, &check.Error, &check.CheckedAt); err != nil {
+			return nil, fmt.Errorf("scan link check: %w", err)
+		}
+		checks = append(checks, check)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate link checks: %w", err)
+	}
+	return checks, nil
+}
+
+func (r *Repo) queryLinks(ctx context.Context, stmt string, args ...any) ([]Link, error) {
+	rows, err := r.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query links: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var links []Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan link: %w", err)
+		}
+		links = append(links, *link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate links: %w", err)
+	}
+	return links, nil
+}
+
+func (r *Repo) CreateUser(ctx context.Context, email, passwordHash string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	user := &User{Email: email, PasswordHash: passwordHash}
+	stmt := `INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id, role, created_at;`
+	err := r.DB.QueryRowContext(ctx, stmt, email, passwordHash).Scan(&user.ID, &user.Role, &user.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return nil, ErrDuplicateEmail
+		}
+		return nil, fmt.Errorf("insert user: %w", err)
+	}
+	return user, nil
+}
+
+func (r *Repo) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var user User
+	stmt := `SELECT id, email, COALESCE(password_hash, ''), role, created_at FROM users WHERE email = $1;`
+	err := r.DB.QueryRowContext(ctx, stmt, email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("query user: %w", err)
+	}
+	return &user, nil
+}
+
+// OwnerExists reports whether owner is anonymous or names an existing user
+// or workspace.
+func (r *Repo) OwnerExists(ctx context.Context, owner string) (bool, error) {
+	kind, id, err := parseOwner(owner)
+	if err != nil || kind == "" {
+		return kind == "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	table := "users"
+	if kind == "workspace" {
+		table = "workspaces"
+	}
+	var exists bool
+	if err := r.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+table+` WHERE id = $1);`, id).Scan(&exists); err != nil {
+		return false, fmt.Errorf("query owner: %w", err)
+	}
+	return exists, nil
+}
+
+func (r *Repo) SetUserRole(ctx context.Context, email, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	res, err := r.DB.ExecContext(ctx, `UPDATE users SET role = $2 WHERE email = $1;`, email, role)
+	if err != nil {
+		return fmt.Errorf("update user role: %w", err)
+	}
+	return requireAffected(res)
+}
+
+// UpsertOIDCUser returns the user linked to the OIDC identity, creating it on
+// first sign-in. The role is refreshed on every sign-in. An existing account
+// with the same email is never linked, since local accounts do not prove they
+// own their email address, and ErrDuplicateEmail is returned instead.
+func (r *Repo) UpsertOIDCUser(ctx context.Context, identity *OIDCIdentity) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var user User
+	stmt := `INSERT INTO users (email, oidc_issuer, oidc_subject, role) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (oidc_issuer, oidc_subject) DO UPDATE SET email = EXCLUDED.email, role = EXCLUDED.role
+	RETURNING id, email, COALESCE(password_hash, ''), role, created_at;`
+	err := r.DB.QueryRowContext(ctx, stmt, identity.Email, identity.Issuer, identity.Subject, identity.Role).
+		Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err, "users_email_key") {
+			return nil, ErrDuplicateEmail
+		}
+		return nil, fmt.Errorf("upsert oidc user: %w", err)
+	}
+	return &user, nil
+}
+
+func (r *Repo) CreateSession(ctx context.Context, tokenHash string, userID int64, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO sessions (token_hash, user_id, expires_at) VALUES ($1, $2, $3);`
+	if _, err := r.DB.ExecContext(ctx, stmt, tokenHash, userID, expiresAt); err != nil {
+		return fmt.Errorf("insert session: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) GetSessionUser(ctx context.Context, tokenHash string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var user User
+	stmt := `SELECT u.id, u.email, COALESCE(u.password_hash, ''), u.role, u.created_at
+	FROM sessions s JOIN users u ON u.id = s.user_id
+	WHERE s.token_hash = $1 AND s.expires_at > NOW();`
+	err := r.DB.QueryRowContext(ctx, stmt, tokenHash).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("query session: %w", err)
+	}
+	return &user, nil
+}
+
+func (r *Repo) DeleteSession(ctx context.Context, tokenHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if _, err := r.DB.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash = $1;`, tokenHash); err != nil {
+		return fmt.Errorf("delete session: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) CreateWorkspace(ctx context.Context, name string, adminID int64) (result *Workspace, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			err = fmt.Errorf("rollback tx: %w", rbErr)
+		}
+	}()
+
+	workspace := &Workspace{Name: name}
+	stmt := `INSERT INTO workspaces (name) VALUES ($1) RETURNING id, created_at;`
+	if err := tx.QueryRowContext(ctx, stmt, name).Scan(&workspace.ID, &workspace.CreatedAt); err != nil {
+		return nil, fmt.Errorf("insert workspace: %w", err)
+	}
+	stmt = `INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3);`
+	if _, err := tx.ExecContext(ctx, stmt, workspace.ID, adminID, WorkspaceAdmin); err != nil {
+		return nil, fmt.Errorf("insert workspace admin: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return workspace, nil
+}
+
+func (r *Repo) ListMemberships(ctx context.Context, userID int64) ([]Membership, error) {
+	return r.queryMemberships(ctx, `WHERE m.user_id = $1 ORDER BY w.name, w.id`, userID)
+}
+
+func (r *Repo) ListMembers(ctx context.Context, workspaceID int64) ([]Membership, error) {
+	return r.queryMemberships(ctx, `WHERE m.workspace_id = $1 ORDER BY u.email`, workspaceID)
+}
+
+func (r *Repo) GetMembership(ctx context.Context, workspaceID, userID int64) (*Membership, error) {
+	memberships, err := r.queryMemberships(ctx, `WHERE m.workspace_id = $1 AND m.user_id = $2`, workspaceID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(memberships) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &memberships[0], nil
+}
+
+func (r *Repo) queryMemberships(ctx context.Context, where string, args ...any) ([]Membership, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT w.id, w.name, w.created_at, m.user_id, u.email, m.role
+	FROM workspace_members m
+	JOIN workspaces w ON w.id = m.workspace_id
+	JOIN users u ON u.id = m.user_id ` + where + `;`
+
+	rows, err := r.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query memberships: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var memberships []Membership
+	for rows.Next() {
+		var m Membership
+		if err := rows.Scan(&m.Workspace.ID, &m.Workspace.Name, &m.Workspace.CreatedAt, &m.UserID, &m.Email, &m.Role); err != nil {
+			return nil, fmt.Errorf("scan membership: %w", err)
+		}
+		memberships = append(memberships, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate memberships: %w", err)
+	}
+	return memberships, nil
+}
+
+// RemoveMember removes the user from the workspace unless they are its last
+// admin. The member rows are locked so that two admins cannot remove each
+// other concurrently.
+func (r *Repo) RemoveMember(ctx context.Context, workspaceID, userID int64) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			err = fmt.Errorf("rollback tx: %w", rbErr)
+		}
+	}()
+
+	rows, err := tx.QueryContext(ctx, `SELECT user_id, role FROM workspace_members WHERE workspace_id = $1 FOR UPDATE;`, workspaceID)
+	if err != nil {
+		return fmt.Errorf("query members: %w", err)
+	}
+	var admins int
+	var role string
+	for rows.Next() {
+		var id int64
+		var memberRole string
+		if err := rows.Scan(&id, &memberRole); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("scan member: %w", err)
+		}
+		if memberRole == WorkspaceAdmin {
+			admins++
+		}
+		if id == userID {
+			role = memberRole
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("close members: %w", err)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate members: %w", err)
+	}
+
+	switch {
+	case role == "":
+		return ErrRecordNotFound
+	case role == WorkspaceAdmin && admins == 1:
+		return ErrLastAdmin
+	}
+
+	stmt := `DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2;`
+	if _, err := tx.ExecContext(ctx, stmt, workspaceID, userID); err != nil {
+		return fmt.Errorf("delete member: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) CreateInvitation(ctx context.Context, invitation *Invitation) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO workspace_invitations (token_hash, workspace_id, email, role, invited_by, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6);`
+	_, err := r.DB.ExecContext(ctx, stmt, invitation.TokenHash, invitation.Workspace.ID, invitation.Email,
+		invitation.Role, invitation.InvitedBy, invitation.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("insert invitation: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) GetInvitation(ctx context.Context, tokenHash string) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return scanInvitation(r.DB.QueryRowContext(ctx, invitationQuery, tokenHash))
+}
+
+const invitationQuery = `SELECT i.token_hash, w.id, w.name, w.created_at, i.email, i.role, COALESCE(i.invited_by, 0), i.expires_at
+FROM workspace_invitations i JOIN workspaces w ON w.id = i.workspace_id
+WHERE i.token_hash = $1 AND i.expires_at > NOW()`
+
+func scanInvitation(row *sql.Row) (*Invitation, error) {
+	var inv Invitation
+	err := row.Scan(&inv.TokenHash, &inv.Workspace.ID, &inv.Workspace.Name, &inv.Workspace.CreatedAt,
+		&inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("query invitation: %w", err)
+	}
+	return &inv, nil
+}
+
+// AcceptInvitation adds the user to the workspace with the invited role and
+// consumes the invitation. Users who already are members keep their role.
+func (r *Repo) AcceptInvitation(ctx context.Context, tokenHash string, user *User) (result *Membership, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			err = fmt.Errorf("rollback tx: %w", rbErr)
+		}
+	}()
+
+	inv, err := scanInvitation(tx.QueryRowContext(ctx, invitationQuery+` FOR UPDATE OF i;`, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	if inv.Email != user.Email {
+		return nil, ErrInvitationMismatch
+	}
+
+	membership := &Membership{Workspace: inv.Workspace, UserID: user.ID, Email: user.Email}
+	stmt := `INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+	ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = workspace_members.role
+	RETURNING role;`
+	if err := tx.QueryRowContext(ctx, stmt, inv.Workspace.ID, user.ID, inv.Role).Scan(&membership.Role); err != nil {
+		return nil, fmt.Errorf("insert member: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspace_invitations WHERE token_hash = $1;`, tokenHash); err != nil {
+		return nil, fmt.Errorf("delete invitation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit tx: %w", err)
+	}
+	return membership, nil
+}
+
+func (r *Repo) CreateAPIToken(ctx context.Context, token *APIToken, secretHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO api_tokens (user_id, workspace_id, name, kind, secret_hash, scopes, expires_at)
+	VALUES ($1, NULLIF($2, 0), $3, $4, NULLIF($5, ''), $6, $7)
+	RETURNING id, created_at;`
+	var expiresAt sql.NullTime
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: token.ExpiresAt, Valid: true}
+	}
+	err := r.DB.QueryRowContext(ctx, stmt, token.UserID, token.WorkspaceID, token.Name, token.Kind, secretHash,
+		strings.Join(token.Scopes, " "), expiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert api token: %w", err)
+	}
+	return nil
+}
+
+const apiTokenColumns = `id, user_id, COALESCE(workspace_id, 0), name, kind, scopes, expires_at, created_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	var expiresAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.WorkspaceID, &token.Name, &token.Kind, &scopes, &expiresAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	token.ExpiresAt = expiresAt.Time
+	return &token, nil
+}
+
+func (r *Repo) GetAPITokenBySecret(ctx context.Context, secretHash string) (*APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + apiTokenColumns + ` FROM api_tokens
+	WHERE secret_hash = $1 AND (expires_at IS NULL OR expires_at > NOW());`
+	token, err := scanAPIToken(r.DB.QueryRowContext(ctx, stmt, secretHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("query api token: %w", err)
+	}
+	return token, nil
+}
+
+func (r *Repo) ListAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + apiTokenColumns + ` FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC, id DESC;`
+	rows, err := r.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan api token: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate api tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// RevokeAPIToken deletes the token. Signed tokens stay valid without a
+// database lookup, so their ID is also put on the denylist until they expire.
+func (r *Repo) RevokeAPIToken(ctx context.Context, userID, tokenID int64) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			err = fmt.Errorf("rollback tx: %w", rbErr)
+		}
+	}()
+
+	var kind string
+	var expiresAt sql.NullTime
+	stmt := `DELETE FROM api_tokens WHERE id = $1 AND user_id = $2 RETURNING kind, expires_at;`
+	if err := tx.QueryRowContext(ctx, stmt, tokenID, userID).Scan(&kind, &expiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	if kind == TokenKindJWT {
+		stmt = `INSERT INTO token_denylist (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING;`
+		if _, err := tx.ExecContext(ctx, stmt, strconv.FormatInt(tokenID, 10), expiresAt.Time); err != nil {
+			return fmt.Errorf("insert denylist entry: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var revoked bool
+	stmt := `SELECT EXISTS (SELECT 1 FROM token_denylist WHERE jti = $1);`
+	if err := r.DB.QueryRowContext(ctx, stmt, jti).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("query denylist: %w", err)
+	}
+	return revoked, nil
+}
+
+// SearchLinks finds links by exact alias or by a substring of the
+// destination. An empty query returns the most recent links.
+func (r *Repo) SearchLinks(ctx context.Context, query string, limit int) ([]Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + linkColumns + ` FROM urls
+	WHERE $1 = '' OR alias = $1 OR original_url ILIKE '%' || $2 || '%'
+	ORDER BY created_at DESC, id DESC
+	LIMIT $3;`
+	return r.queryLinks(ctx, stmt, query, escapeLike(query), limit)
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (r *Repo) GetLinkByID(ctx context.Context, id int64) (*Link, error) {
+	return r.getLink(ctx, `id = $1`, id)
+}
+
+// GetLinkByAlias returns a link whether or not it is disabled, without
+// counting a click.
+func (r *Repo) GetLinkByAlias(ctx context.Context, alias string) (*Link, error) {
+	return r.getLink(ctx, `alias = $1`, alias)
+}
+
+func (r *Repo) GetOwnedLink(ctx context.Context, owner, alias string) (*Link, error) {
+	return r.getLink(ctx, `owner = $1 AND alias = $2 AND owner <> ''`, owner, alias)
+}
+
+func (r *Repo) getLink(ctx context.Context, where string, args ...any) (*Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	link, err := scanLink(r.DB.QueryRowContext(ctx, `SELECT `+linkColumns+` FROM urls WHERE `+where+`;`, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, fmt.Errorf("query link: %w", err)
+	}
+	return link, nil
+}
+
+func (r *Repo) SetLinkDisabled(ctx context.Context, id int64, disabled bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE urls SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, NOW()) END WHERE id = $1;`
+	res, err := r.DB.ExecContext(ctx, stmt, id, disabled)
+	if err != nil {
+		return fmt.Errorf("update link: %w", err)
+	}
+	return requireAffected(res)
+}
+
+func (r *Repo) DeleteLink(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM urls WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete link: %w", err)
+	}
+	return requireAffected(res)
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *Repo) CreateAbuseReport(ctx context.Context, alias, reason, reporterIP string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO abuse_reports (url_id, reason, reporter_ip)
+	SELECT id, $2, $3 FROM urls WHERE alias = $1;`
+	res, err := r.DB.ExecContext(ctx, stmt, alias, reason, reporterIP)
+	if err != nil {
+		return fmt.Errorf("insert abuse report: %w", err)
+	}
+	return requireAffected(res)
+}
+
+// ListAbuseReports returns the most recent reports, for one link when linkID
+// is not zero.
+func (r *Repo) ListAbuseReports(ctx context.Context, linkID int64, limit int) ([]AbuseReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT a.id, a.url_id, u.alias, a.reason, a.reporter_ip, a.created_at
+	FROM abuse_reports a JOIN urls u ON u.id = a.url_id
+	WHERE $1 = 0 OR a.url_id = $1
+	ORDER BY a.created_at DESC, a.id DESC
+	LIMIT $2;`
+	rows, err := r.DB.QueryContext(ctx, stmt, linkID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query abuse reports: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var reports []AbuseReport
+	for rows.Next() {
+		var report AbuseReport
+		if err := rows.Scan(&report.ID, &report.LinkID, &report.Alias, &report.Reason, &report.ReporterIP, &report.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan abuse report: %w", err)
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate abuse reports: %w", err)
+	}
+	return reports, nil
+}
+
+// EachLink calls fn for every link, oldest first. Unlike the other methods it
+// has no timeout of its own because it may walk the whole table.
+func (r *Repo) EachLink(ctx context.Context, fn func(Link) error) error {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+linkColumns+` FROM urls ORDER BY id;`)
+	if err != nil {
+		return fmt.Errorf("query links: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return fmt.Errorf("scan link: %w", err)
+		}
+		if err := fn(*link); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate links: %w", err)
+	}
+	return nil
+}
+
+// expiringTables lists the tables whose rows are useless once expires_at has
+// passed.
+var expiringTables = []string{"sessions", "idempotency_keys", "workspace_invitations", "api_tokens", "token_denylist"}
+
+// PurgeExpired deletes expired rows and returns how many were removed from
+// each table.
+func (r *Repo) PurgeExpired(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	purged := make(map[string]int64, len(expiringTables))
+	for _, table := range expiringTables {
+		res, err := r.DB.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at < NOW();`)
+		if err != nil {
+			return nil, fmt.Errorf("purge %s: %w", table, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("rows affected: %w", err)
 		}
-		return "", fmt.Errorf("query original url: %w", err)
+		purged[table] = n
 	}
-	return originalURL, nil
+	return purged, nil
 }
@@ -11,7 +11,6 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/vancanhuit/url-shortener-web/assets"
 	"github.com/vancanhuit/url-shortener-web/templates"
-	"golang.org/x/time/rate"
 )
 
 func (app *Application) Router() http.Handler {
@@ -62,30 +61,51 @@ func (app *Application) Router() http.Handler {
 	}))
 	e.Use(middleware.Recover())
 	e.Use(middleware.BodyLimit("1M"))
-	e.Use(middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
-		Skipper: middleware.DefaultSkipper,
-		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
-			Rate:      rate.Limit(100),
-			Burst:     200,
-			ExpiresIn: 1 * time.Minute,
-		}),
-		IdentifierExtractor: func(c echo.Context) (string, error) {
-			ip := c.RealIP()
-			return ip, nil
-		},
-		DenyHandler: func(c echo.Context, identifier string, err error) error {
-			return echo.NewHTTPError(http.StatusTooManyRequests, "too many requests")
-		},
-		ErrorHandler: func(c echo.Context, err error) error {
-			return echo.NewHTTPError(http.StatusForbidden, "forbidden")
-		},
-	}))
 
 	e.StaticFS("/static", echo.MustSubFS(assets.FS, "."))
+	e.GET("/readyz", app.Readyz)
+	e.GET("/.well-known/apple-app-site-association", app.AppleAppSiteAssociation)
+	e.GET("/.well-known/assetlinks.json", app.AssetLinks)
+
+	e.POST("/api/shorten", app.Shorten, app.RateLimit("shorten"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeLinksWrite), app.Idempotent())
+	e.GET("/api/links", app.ListLinksAPI, app.RateLimit("default"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeLinksRead))
+	e.GET("/api/links/broken", app.ListBrokenLinksAPI, app.RateLimit("default"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeLinksRead))
+	e.GET("/api/links/:alias/checks", app.LinkChecksAPI, app.RateLimit("default"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeLinksRead))
+	e.GET("/api/links/:alias/stats", app.LinkStatsAPI, app.RateLimit("default"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeStatsRead))
+	e.GET("/api/links/:alias/metadata", app.LinkMetadataAPI, app.RateLimit("default"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeLinksRead))
+	e.PATCH("/api/links/:alias", app.UpdateLinkAPI, app.RateLimit("shorten"), app.LoadSession, app.Authenticate, app.RequireScope(ScopeLinksWrite))
+	e.GET("/r/:alias", app.Redirect, app.RateLimit("redirect"))
+	e.GET("/r/:alias/*", app.Redirect, app.RateLimit("redirect"))
+	e.POST("/r/:alias", app.ConfirmRedirect, app.RateLimit("redirect"))
+	e.POST("/r/:alias/*", app.ConfirmRedirect, app.RateLimit("redirect"))
+	e.POST("/api/links/:alias/report", app.ReportAbuse, app.RateLimit("auth"))
+
+	csrf := app.CSRF()
+	e.GET("/", app.Index, app.RateLimit("default"), csrf, app.LoadSession)
+	e.GET("/login", app.LoginForm, app.RateLimit("default"), csrf, app.LoadSession)
+	e.POST("/login", app.Login, app.RateLimit("auth"), csrf)
+	e.GET("/register", app.RegisterForm, app.RateLimit("default"), csrf, app.LoadSession)
+	e.POST("/register", app.Register, app.RateLimit("auth"), csrf)
+	e.POST("/logout", app.Logout, app.RateLimit("default"), csrf)
+	e.GET("/auth/oidc/login", app.OIDCLogin, app.RateLimit("auth"))
+	e.GET("/auth/oidc/callback", app.OIDCCallback, app.RateLimit("auth"), csrf)
 
-	e.POST("/api/shorten", app.Shorten)
-	e.GET("/r/:alias", app.Redirect)
-	e.GET("/", app.Index)
+	e.GET("/workspaces", app.ListWorkspaces, app.RateLimit("default"), csrf, app.LoadSession, app.RequireLogin)
+	e.POST("/workspaces", app.CreateWorkspace, app.RateLimit("default"), csrf, app.LoadSession, app.RequireLogin)
+	e.GET("/workspaces/:workspace", app.ShowWorkspace, app.RateLimit("default"), csrf, app.LoadSession, app.Authorize(PermViewWorkspace))
+	e.POST("/workspaces/:workspace/invitations", app.InviteMember, app.RateLimit("default"), csrf, app.LoadSession, app.Authorize(PermManageMembers))
+	e.POST("/workspaces/:workspace/members/:user/remove", app.RemoveMember, app.RateLimit("default"), csrf, app.LoadSession, app.Authorize(PermManageMembers))
+	e.POST("/api/workspaces/:workspace/shorten", app.Shorten, app.RateLimit("shorten"), app.LoadSession, app.Authorize(PermCreateLinks), app.Idempotent())
+	e.GET("/tokens", app.ListTokens, app.RateLimit("default"), csrf, app.LoadSession, app.RequireLogin)
+	e.POST("/tokens", app.CreateToken, app.RateLimit("default"), csrf, app.LoadSession, app.RequireLogin)
+	e.POST("/tokens/:id/revoke", app.RevokeToken, app.RateLimit("default"), csrf, app.LoadSession, app.RequireLogin)
+	e.GET("/admin", app.AdminIndex, app.RateLimit("default"), csrf, app.LoadSession, app.RequireAdmin)
+	e.GET("/admin/links/:id", app.AdminLink, app.RateLimit("default"), csrf, app.LoadSession, app.RequireAdmin)
+	e.POST("/admin/links/:id/disable", app.AdminDisableLink, app.RateLimit("default"), csrf, app.LoadSession, app.RequireAdmin)
+	e.POST("/admin/links/:id/enable", app.AdminEnableLink, app.RateLimit("default"), csrf, app.LoadSession, app.RequireAdmin)
+	e.POST("/admin/links/:id/delete", app.AdminDeleteLink, app.RateLimit("default"), csrf, app.LoadSession, app.RequireAdmin)
+	e.GET("/invitations/:token", app.ShowInvitation, app.RateLimit("default"), csrf, app.LoadSession, app.RequireLogin)
+	e.POST("/invitations/:token", app.AcceptInvitation, app.RateLimit("auth"), csrf, app.LoadSession, app.RequireLogin)
 
 	return e
 }
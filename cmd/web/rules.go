@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Device types a rule can match on.
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+)
+
+var devices = []string{DeviceDesktop, DeviceMobile, DeviceTablet}
+
+// MaxRules is the largest number of rules a link can have.
+const MaxRules = 20
+
+// Rule sends the visitors it matches to URL instead of the link's
+// destination. A visitor matches when every condition that is set holds:
+// the device is one of Devices, the preferred language is one of Languages,
+// the country is one of Countries and the time is in [StartsAt, EndsAt).
+type Rule struct {
+	Devices []string `json:"devices,omitempty"`
+	// Languages are language tags such as "fr" or "pt-BR". A tag also matches
+	// its more specific tags, so "fr" matches "fr-CA".
+	Languages []string `json:"languages,omitempty"`
+	// Countries are ISO 3166 alpha-2 codes such as "DE".
+	Countries []string  `json:"countries,omitempty"`
+	StartsAt  time.Time `json:"starts_at,omitzero"`
+	EndsAt    time.Time `json:"ends_at,omitzero"`
+	URL       string    `json:"url"`
+}
+
+// Visitor is what rules know about the client following a short URL.
+type Visitor struct {
+	Device string
+	// Language is the preferred language of the client, lower case.
+	Language string
+	// Country is empty when it is not known.
+	Country string
+	Time    time.Time
+	// ID identifies the visitor for variant assignment, such as their IP
+	// address, and Variant is the variant they were sent to before.
+	ID      string
+	Variant string
+}
+
+// Matches reports whether v meets all the conditions of the rule.
+func (r *Rule) Matches(v Visitor) bool {
+	if len(r.Devices) > 0 && !slices.Contains(r.Devices, v.Device) {
+		return false
+	}
+	if len(r.Languages) > 0 && !slices.ContainsFunc(r.Languages, func(tag string) bool {
+		tag = strings.ToLower(tag)
+		return v.Language == tag || strings.HasPrefix(v.Language, tag+"-")
+	}) {
+		return false
+	}
+	if len(r.Countries) > 0 && !slices.ContainsFunc(r.Countries, func(code string) bool {
+		return strings.EqualFold(code, v.Country)
+	}) {
+		return false
+	}
+	if !r.StartsAt.IsZero() && v.Time.Before(r.StartsAt) {
+		return false
+	}
+	if !r.EndsAt.IsZero() && !v.Time.Before(r.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// Route returns the link to send v to: a copy of l with the destination of
+// the first rule that matches or, when none does, of the variant v is
+// assigned to. Links without either are returned as is. The variant is nil
+// unless one was picked. Templating and passthrough apply to these
+// destinations as they do to the link's own.
+func (l *Link) Route(v Visitor) (*Link, *Variant) {
+	for _, rule := range l.Rules {
+		if rule.Matches(v) {
+			routed := *l
+			routed.OriginalURL = rule.URL
+			return &routed, nil
+		}
+	}
+	if len(l.Variants) > 0 {
+		variant := l.pickVariant(v)
+		routed := *l
+		routed.OriginalURL = variant.URL
+		return &routed, variant
+	}
+	return l, nil
+}
+
+var (
+	languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	countryCodePattern = regexp.MustCompile(`^[A-Za-z]{2}$`)
+)
+
+// ErrInvalidRule is returned for rules that could never be evaluated.
+var ErrInvalidRule = errors.New("invalid rule")
+
+func validateRules(rules []Rule) error {
+	if len(rules) > MaxRules {
+		return fmt.Errorf("%w: a link can have at most %d rules", ErrInvalidRule, MaxRules)
+	}
+	for i, rule := range rules {
+		if !validDestination(rule.URL) || len(rule.URL) > 500 {
+			return fmt.Errorf("%w %d: url %s", ErrInvalidRule, i+1, ErrInvalidURL)
+		}
+		if len(rule.Devices) == 0 && len(rule.Languages) == 0 && len(rule.Countries) == 0 &&
+			rule.StartsAt.IsZero() && rule.EndsAt.IsZero() {
+			return fmt.Errorf("%w %d: at least one condition is required", ErrInvalidRule, i+1)
+		}
+		for _, device := range rule.Devices {
+			if !slices.Contains(devices, device) {
+				return fmt.Errorf("%w %d: device must be one of: %s", ErrInvalidRule, i+1, strings.Join(devices, ", "))
+			}
+		}
+		for _, tag := range rule.Languages {
+			if !languageTagPattern.MatchString(tag) {
+				return fmt.Errorf("%w %d: %q is not a language tag", ErrInvalidRule, i+1, tag)
+			}
+		}
+		for _, code := range rule.Countries {
+			if !countryCodePattern.MatchString(code) {
+				return fmt.Errorf("%w %d: %q is not a country code", ErrInvalidRule, i+1, code)
+			}
+		}
+		if !rule.StartsAt.IsZero() && !rule.EndsAt.IsZero() && !rule.EndsAt.After(rule.StartsAt) {
+			return fmt.Errorf("%w %d: ends_at must be after starts_at", ErrInvalidRule, i+1)
+		}
+	}
+	return nil
+}
+
+// DeviceType guesses the kind of device from a User-Agent header. Clients
+// that do not identify as a phone or a tablet count as desktops.
+func DeviceType(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "Tablet"):
+		return DeviceTablet
+	case strings.Contains(userAgent, "Android") && !strings.Contains(userAgent, "Mobile"):
+		// Android phones say Mobile, Android tablets do not.
+		return DeviceTablet
+	case strings.Contains(userAgent, "Mobi") || strings.Contains(userAgent, "iPhone") ||
+		strings.Contains(userAgent, "iPod") || strings.Contains(userAgent, "Windows Phone"):
+		return DeviceMobile
+	}
+	return DeviceDesktop
+}
+
+// PreferredLanguage returns the language tag with the highest weight in an
+// Accept-Language header, lower case, or "" when there is none.
+func PreferredLanguage(acceptLanguage string) string {
+	var best string
+	bestWeight := 0.0
+	for part := range strings.SplitSeq(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if weight, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		// Earlier tags win ties, as their order is the client's preference.
+		if tag != "" && tag != "*" && weight > bestWeight {
+			best, bestWeight = tag, weight
+		}
+	}
+	return strings.ToLower(best)
+}
+
+// visitor describes the client of a request to the short URL of alias.
+func (app *Application) visitor(c echo.Context, alias string) Visitor {
+	r := c.Request()
+	v := Visitor{
+		Device:   DeviceType(r.UserAgent()),
+		Language: PreferredLanguage(r.Header.Get("Accept-Language")),
+		Time:     time.Now(),
+		ID:       c.RealIP(),
+	}
+	if addr, err := netip.ParseAddr(v.ID); err == nil && app.GeoIP != nil {
+		v.Country = app.GeoIP.Country(addr)
+	}
+	if cookie, err := c.Cookie(variantCookieName(alias)); err == nil {
+		v.Variant = cookie.Value
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceType(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36":                DeviceDesktop,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148": DeviceMobile,
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Mobile Safari/537.36":          DeviceMobile,
+		"Mozilla/5.0 (iPad; CPU OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148":          DeviceTablet,
+		"Mozilla/5.0 (Linux; Android 14; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36":                 DeviceTablet,
+		"curl/8.8.0": DeviceDesktop,
+		"":           DeviceDesktop,
+	}
+	for userAgent, want := range tests {
+		require.Equal(t, want, DeviceType(userAgent), userAgent)
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := map[string]string{
+		"":                          "",
+		"fr-CH, fr;q=0.9, en;q=0.8": "fr-ch",
+		"en;q=0.5, de":              "de",
+		"*, es;q=0.1":               "es",
+		"pt-BR;q=0.8, en;q=0.8":     "pt-br",
+		"en;q=0, de;q=0.1":          "de",
+		"en;q=x":                    "",
+	}
+	for header, want := range tests {
+		require.Equal(t, want, PreferredLanguage(header), header)
+	}
+}
+
+func TestLinkRoute(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	link := &Link{
+		OriginalURL: "https://example.com/",
+		Rules: []Rule{
+			{Countries: []string{"de", "AT"}, Devices: []string{DeviceMobile}, URL: "https://m.example.de/"},
+			{Countries: []string{"DE", "AT"}, URL: "https://example.de/"},
+			{Languages: []string{"fr"}, URL: "https://example.fr/"},
+			{StartsAt: now, EndsAt: now.Add(time.Hour), URL: "https://example.com/sale"},
+		},
+	}
+	tests := []struct {
+		name    string
+		visitor Visitor
+		want    string
+	}{
+		{"fallback", Visitor{Device: DeviceDesktop, Language: "en", Time: now.Add(-time.Minute)}, "https://example.com/"},
+		{"country and device", Visitor{Device: DeviceMobile, Country: "AT", Time: now}, "https://m.example.de/"},
+		{"country", Visitor{Device: DeviceDesktop, Country: "DE", Language: "fr", Time: now}, "https://example.de/"},
+		{"language prefix", Visitor{Device: DeviceDesktop, Language: "fr-ca", Time: now}, "https://example.fr/"},
+		{"language is not a prefix", Visitor{Device: DeviceDesktop, Language: "fro", Time: now.Add(-time.Minute)}, "https://example.com/"},
+		{"window start", Visitor{Device: DeviceDesktop, Time: now}, "https://example.com/sale"},
+		{"window end", Visitor{Device: DeviceDesktop, Time: now.Add(time.Hour)}, "https://example.com/"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			routed, _ := link.Route(tc.visitor)
+			require.Equal(t, tc.want, routed.OriginalURL)
+		})
+	}
+	require.Equal(t, "https://example.com/", link.OriginalURL)
+}
+
+func TestValidateRules(t *testing.T) {
+	now := time.Now()
+	require.NoError(t, validateRules(nil))
+	require.NoError(t, validateRules([]Rule{
+		{Devices: []string{DeviceTablet}, Languages: []string{"pt-BR"}, Countries: []string{"br"}, URL: "https://example.com/{1}"},
+		{StartsAt: now, URL: "https://example.com/"},
+	}))
+
+	invalid := []Rule{
+		{URL: "https://example.com/"},
+		{Devices: []string{"watch"}, URL: "https://example.com/"},
+		{Languages: []string{"english language"}, URL: "https://example.com/"},
+		{Countries: []string{"DEU"}, URL: "https://example.com/"},
+		{StartsAt: now, EndsAt: now, URL: "https://example.com/"},
+		{Countries: []string{"DE"}, URL: "ftp://example.com/"},
+		{Countries: []string{"DE"}},
+	}
+	for _, rule := range invalid {
+		require.ErrorIs(t, validateRules([]Rule{rule}), ErrInvalidRule, "%+v", rule)
+	}
+	require.ErrorIs(t, validateRules(make([]Rule, MaxRules+1)), ErrInvalidRule)
+}
@@ -1,11 +1,176 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
 )
 
 func GenerateAlias(url string) string {
-	hash := sha256.Sum256([]byte(url))
-	return base64.URLEncoding.EncodeToString(hash[:])[:11]
+	return hashAlias(url, 11)
+}
+
+func hashAlias(key string, length int) string {
+	hash := sha256.Sum256([]byte(key))
+	return base64.URLEncoding.EncodeToString(hash[:])[:length]
+}
+
+type AliasGenerator interface {
+	// Generate returns an alias for a new link. key identifies the link being
+	// created; only deterministic strategies use it.
+	Generate(ctx context.Context, key string) (string, error)
+}
+
+// NewAliasGenerator returns the generator for the named strategy. length is
+// the alias length for the hash and random strategies, the minimum length
+// for the sequence strategy and the number of words for the words strategy.
+func NewAliasGenerator(strategy string, length int, salt string, seq Sequence) (AliasGenerator, error) {
+	switch strategy {
+	case "hash":
+		if length < 1 || length > 43 {
+			return nil, fmt.Errorf("hash alias length must be between 1 and 43")
+		}
+		return &HashAliasGenerator{Length: length}, nil
+	case "random":
+		if length < 4 || length > 64 {
+			return nil, fmt.Errorf("random alias length must be between 4 and 64")
+		}
+		return &RandomAliasGenerator{Length: length}, nil
+	case "sequence":
+		if length < 1 || length > 64 {
+			return nil, fmt.Errorf("sequence alias minimum length must be between 1 and 64")
+		}
+		return NewSequenceAliasGenerator(seq, salt, length), nil
+	case "words":
+		if length < 2 || length > 8 {
+			return nil, fmt.Errorf("word alias length must be between 2 and 8 words")
+		}
+		return &WordAliasGenerator{Count: length}, nil
+	default:
+		return nil, fmt.Errorf("unknown alias strategy %q", strategy)
+	}
+}
+
+// HashAliasGenerator derives the alias from the base64url encoded SHA-256 of
+// the key, so that the same key always gets the same alias.
+type HashAliasGenerator struct {
+	Length int
+}
+
+func (g *HashAliasGenerator) Generate(_ context.Context, key string) (string, error) {
+	return hashAlias(key, g.Length), nil
+}
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// RandomAliasGenerator returns cryptographically random base62 aliases.
+type RandomAliasGenerator struct {
+	Length int
+}
+
+func (g *RandomAliasGenerator) Generate(_ context.Context, _ string) (string, error) {
+	b := make([]byte, g.Length)
+	n := big.NewInt(int64(len(base62Alphabet)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return "", fmt.Errorf("read random: %w", err)
+		}
+		b[i] = base62Alphabet[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+type Sequence interface {
+	NextAliasID(ctx context.Context) (int64, error)
+}
+
+var ErrSequenceExhausted = errors.New("alias sequence exhausted")
+
+const (
+	sequenceBits = 40
+	sequenceMask = 1<<sequenceBits - 1
+	// sequenceDigits is the number of base62 digits needed for 2^40 - 1.
+	sequenceDigits = 7
+	// sequenceMultiplier is odd, so multiplying by it modulo 2^40 is a
+	// bijection that spreads consecutive IDs over the whole range.
+	sequenceMultiplier = 0x9E3779B97F
+)
+
+// SequenceAliasGenerator encodes IDs from a database sequence in the spirit
+// of sqids: the ID is scrambled with a reversible permutation and written in
+// base62 with an alphabet shuffled by the salt, so that aliases are short,
+// unique and do not reveal how many links exist.
+type SequenceAliasGenerator struct {
+	Seq       Sequence
+	MinLength int
+	alphabet  string
+	xorMask   uint64
+}
+
+func NewSequenceAliasGenerator(seq Sequence, salt string, minLength int) *SequenceAliasGenerator {
+	seed := sha256.Sum256([]byte(salt))
+	return &SequenceAliasGenerator{
+		Seq:       seq,
+		MinLength: minLength,
+		alphabet:  shuffleAlphabet(base62Alphabet, seed[:]),
+		xorMask:   binary.BigEndian.Uint64(seed[:8]) & sequenceMask,
+	}
+}
+
+func (g *SequenceAliasGenerator) Generate(ctx context.Context, _ string) (string, error) {
+	id, err := g.Seq.NextAliasID(ctx)
+	if err != nil {
+		return "", fmt.Errorf("next alias id: %w", err)
+	}
+	return g.Encode(uint64(id))
+}
+
+func (g *SequenceAliasGenerator) Encode(id uint64) (string, error) {
+	if id > sequenceMask {
+		return "", ErrSequenceExhausted
+	}
+	n := (id*sequenceMultiplier)&sequenceMask ^ g.xorMask
+
+	base := uint64(len(g.alphabet))
+	var b []byte
+	for n > 0 || len(b) < g.MinLength {
+		b = append(b, g.alphabet[n%base])
+		n /= base
+	}
+	return string(b), nil
+}
+
+func shuffleAlphabet(alphabet string, seed []byte) string {
+	b := []byte(alphabet)
+	for i := len(b) - 1; i > 0; i-- {
+		j := int(seed[i%len(seed)]) % (i + 1)
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// WordAliasGenerator returns pronounceable aliases made of Count random
+// words, such as "bold-swan-lamp".
+type WordAliasGenerator struct {
+	Count int
+}
+
+func (g *WordAliasGenerator) Generate(_ context.Context, _ string) (string, error) {
+	words := make([]string, g.Count)
+	n := big.NewInt(int64(len(aliasWords)))
+	for i := range words {
+		idx, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return "", fmt.Errorf("read random: %w", err)
+		}
+		words[i] = aliasWords[idx.Int64()]
+	}
+	return strings.Join(words, "-"), nil
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -60,3 +63,89 @@ func TestIsValidAlias(t *testing.T) {
 		})
 	}
 }
+
+type counterSequence struct {
+	next int64
+}
+
+func (s *counterSequence) NextAliasID(_ context.Context) (int64, error) {
+	s.next++
+	return s.next, nil
+}
+
+func TestAliasGenerators(t *testing.T) {
+	tests := []struct {
+		strategy string
+		length   int
+	}{
+		{"hash", 11},
+		{"random", 8},
+		{"sequence", 6},
+		{"words", 3},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.strategy, func(t *testing.T) {
+			g, err := NewAliasGenerator(tc.strategy, tc.length, "salt", &counterSequence{})
+			require.NoError(t, err)
+
+			seen := map[string]bool{}
+			for i := range 50 {
+				alias, err := g.Generate(context.Background(), fmt.Sprintf("https://example.com/%d", i))
+				require.NoError(t, err)
+				require.True(t, plausibleAlias(alias), alias)
+				require.False(t, seen[alias], alias)
+				seen[alias] = true
+			}
+		})
+	}
+}
+
+func TestAliasGeneratorInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		strategy string
+		length   int
+	}{
+		{"hash", 44}, {"random", 2}, {"sequence", 0}, {"words", 1}, {"unknown", 8},
+	} {
+		_, err := NewAliasGenerator(tc.strategy, tc.length, "", nil)
+		require.Error(t, err, tc.strategy)
+	}
+}
+
+func TestHashAliasGeneratorMatchesGenerateAlias(t *testing.T) {
+	g := &HashAliasGenerator{Length: 11}
+	alias, err := g.Generate(context.Background(), "https://example.com")
+	require.NoError(t, err)
+	require.Equal(t, GenerateAlias("https://example.com"), alias)
+}
+
+func TestSequenceAliasGenerator(t *testing.T) {
+	g := NewSequenceAliasGenerator(&counterSequence{}, "salt", 6)
+
+	a, err := g.Encode(1)
+	require.NoError(t, err)
+	b, err := g.Encode(2)
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+	require.GreaterOrEqual(t, len(a), 6)
+
+	// A different salt yields different aliases for the same ID.
+	other, err := NewSequenceAliasGenerator(&counterSequence{}, "pepper", 6).Encode(1)
+	require.NoError(t, err)
+	require.NotEqual(t, a, other)
+
+	_, err = g.Encode(1 << 40)
+	require.ErrorIs(t, err, ErrSequenceExhausted)
+}
+
+func TestWordAliasGenerator(t *testing.T) {
+	g := &WordAliasGenerator{Count: 3}
+	alias, err := g.Generate(context.Background(), "")
+	require.NoError(t, err)
+	words := strings.Split(alias, "-")
+	require.Len(t, words, 3)
+	for _, w := range words {
+		require.Contains(t, aliasWordSet, w)
+	}
+}
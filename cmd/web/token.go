@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ScopeLinksWrite = "links:write"
+	ScopeLinksRead  = "links:read"
+	ScopeStatsRead  = "stats:read"
+)
+
+var tokenScopes = []string{ScopeLinksWrite, ScopeLinksRead, ScopeStatsRead}
+
+// scopePermissions is the workspace permission a workspace token's owner must
+// still hold for the scope to be honoured.
+var scopePermissions = map[string]Permission{
+	ScopeLinksWrite: PermCreateLinks,
+	ScopeLinksRead:  PermViewWorkspace,
+	ScopeStatsRead:  PermViewWorkspace,
+}
+
+const (
+	TokenKindKey = "key"
+	TokenKindJWT = "jwt"
+)
+
+// apiKeyPrefix marks opaque API keys so that they are easy to recognise, for
+// example by secret scanners.
+const apiKeyPrefix = "usk_"
+
+// APIToken describes an issued API credential. Opaque keys are looked up by
+// the hash of their secret; signed tokens are self-contained and only the
+// denylist is consulted when they are presented.
+type APIToken struct {
+	ID     int64
+	UserID int64
+	// WorkspaceID is zero for tokens acting on the user's own links.
+	WorkspaceID int64
+	Name        string
+	Kind        string
+	Scopes      []string
+	// ExpiresAt is zero for keys that never expire.
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (t *APIToken) Owner() string {
+	if t.WorkspaceID != 0 {
+		return workspaceOwner(t.WorkspaceID)
+	}
+	return userOwner(t.UserID)
+}
+
+type TokenStore interface {
+	CreateAPIToken(ctx context.Context, token *APIToken, secretHash string) error
+	GetAPITokenBySecret(ctx context.Context, secretHash string) (*APIToken, error)
+	ListAPITokens(ctx context.Context, userID int64) ([]APIToken, error)
+	// RevokeAPIToken deletes the token and denylists it if it is signed.
+	RevokeAPIToken(ctx context.Context, userID, tokenID int64) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// TokenSigner signs API tokens with HS256. Every key has an ID that is put in
+// the "kid" header; tokens are signed with the active key and verified with
+// whichever key they name, so keys can be rotated by adding a new active key
+// and removing the old one once its tokens have expired.
+type TokenSigner struct {
+	keys   map[string][]byte
+	active string
+}
+
+// NewTokenSigner parses keys given as kid:secret pairs separated by commas,
+// with base64 encoded secrets of at least 32 bytes. The first key is active.
+func NewTokenSigner(spec string) (*TokenSigner, error) {
+	s := &TokenSigner{keys: map[string][]byte{}}
+	for pair := range strings.SplitSeq(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kid, encoded, ok := strings.Cut(pair, ":")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("invalid token key %q: want kid:secret", pair)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode token key %q: %w", kid, err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("token key %q must be at least 32 bytes", kid)
+		}
+		if _, ok := s.keys[kid]; ok {
+			return nil, fmt.Errorf("duplicate token key %q", kid)
+		}
+		s.keys[kid] = secret
+		if s.active == "" {
+			s.active = kid
+		}
+	}
+	if s.active == "" {
+		return nil, fmt.Errorf("no token keys")
+	}
+	return s, nil
+}
+
+type tokenClaims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	Workspace int64  `json:"ws,omitempty"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	Expiry    int64  `json:"exp"`
+}
+
+func (s *TokenSigner) Sign(token *APIToken) (string, error) {
+	signingInput, err := encodeJWT(jwtHeader{Alg: "HS256", Kid: s.active, Typ: "JWT"}, tokenClaims{
+		ID:        strconv.FormatInt(token.ID, 10),
+		Subject:   userOwner(token.UserID),
+		Workspace: token.WorkspaceID,
+		Scope:     strings.Join(token.Scopes, " "),
+		IssuedAt:  token.CreatedAt.Unix(),
+		Expiry:    token.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signature := signHS256(s.keys[s.active], signingInput)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (s *TokenSigner) Verify(raw string) (*APIToken, error) {
+	header, payload, signingInput, signature, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	key, ok := s.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, header.Kid)
+	}
+	if err := verifyHS256(key, signingInput, signature); err != nil {
+		return nil, err
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: parse claims: %v", ErrInvalidToken, err)
+	}
+	id, err := strconv.ParseInt(claims.ID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid jti", ErrInvalidToken)
+	}
+	userID, err := strconv.ParseInt(strings.TrimPrefix(claims.Subject, "user:"), 10, 64)
+	if err != nil || !strings.HasPrefix(claims.Subject, "user:") {
+		return nil, fmt.Errorf("%w: invalid subject", ErrInvalidToken)
+	}
+	expiresAt := time.Unix(claims.Expiry, 0)
+	if !time.Now().Before(expiresAt) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	return &APIToken{
+		ID:          id,
+		UserID:      userID,
+		WorkspaceID: claims.Workspace,
+		Kind:        TokenKindJWT,
+		Scopes:      strings.Fields(claims.Scope),
+		ExpiresAt:   expiresAt,
+		CreatedAt:   time.Unix(claims.IssuedAt, 0),
+	}, nil
+}
+
+func currentToken(c echo.Context) *APIToken {
+	token, _ := c.Get("token").(*APIToken)
+	return token
+}
+
+// presentedToken returns the credential sent as a bearer token or, for
+// older clients, in the X-API-Key header.
+func presentedToken(c echo.Context) string {
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return c.Request().Header.Get("X-API-Key")
+}
+
+// Authenticate resolves the presented API token, if any. Requests without a
+// token continue unauthenticated; requests with an invalid one are rejected.
+// Links created with a token belong to the token's user or workspace.
+func (app *Application) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		raw := presentedToken(c)
+		if raw == "" || app.Tokens == nil {
+			return next(c)
+		}
+
+		token, err := app.verifyAPIToken(c.Request().Context(), raw)
+		if err != nil {
+			if errors.Is(err, ErrInvalidToken) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired token")
+			}
+			return err
+		}
+
+		if token.WorkspaceID != 0 {
+			membership, err := app.Workspaces.GetMembership(c.Request().Context(), token.WorkspaceID, token.UserID)
+			if err != nil {
+				if errors.Is(err, ErrRecordNotFound) {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+					return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired token")
+				}
+				return err
+			}
+			c.Set("membership", membership)
+		}
+
+		app.verifiedTokens.add(tokenKeyHash(raw), time.Now())
+		c.Set("token", token)
+		c.Set("owner", token.Owner())
+		return next(c)
+	}
+}
+
+func (app *Application) verifyAPIToken(ctx context.Context, raw string) (*APIToken, error) {
+	if strings.HasPrefix(raw, apiKeyPrefix) {
+		token, err := app.Tokens.GetAPITokenBySecret(ctx, hashToken(raw))
+		if errors.Is(err, ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: unknown key", ErrInvalidToken)
+		}
+		return token, err
+	}
+
+	if app.TokenSigner == nil {
+		return nil, fmt.Errorf("%w: signed tokens are disabled", ErrInvalidToken)
+	}
+	token, err := app.TokenSigner.Verify(raw)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := app.Tokens.IsTokenRevoked(ctx, strconv.FormatInt(token.ID, 10))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("%w: revoked", ErrInvalidToken)
+	}
+	return token, nil
+}
+
+// RequireScope rejects token-authenticated requests whose token lacks scope,
+// or whose owner no longer holds the matching workspace permission. Browser
+// sessions and anonymous requests are not affected.
+func (app *Application) RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := currentToken(c)
+			if token == nil {
+				return next(c)
+			}
+			if !slices.Contains(token.Scopes, scope) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("token lacks the %s scope", scope))
+			}
+			if m := currentMembership(c); m != nil && !Can(m.Role, scopePermissions[scope]) {
+				return echo.NewHTTPError(http.StatusForbidden, "you are not allowed to do this in this workspace")
+			}
+			return next(c)
+		}
+	}
+}
+
+func (app *Application) ListTokens(c echo.Context) error {
+	return app.renderTokens(c, http.StatusOK, nil)
+}
+
+func (app *Application) renderTokens(c echo.Context, status int, data map[string]any) error {
+	ctx := c.Request().Context()
+	user := currentUser(c)
+
+	tokens, err := app.Tokens.ListAPITokens(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	memberships, err := app.Workspaces.ListMemberships(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	page := map[string]any{
+		"tokens":      tokens,
+		"memberships": memberships,
+		"scopes":      tokenScopes,
+		"signed":      app.TokenSigner != nil,
+	}
+	for k, v := range data {
+		page[k] = v
+	}
+	return c.Render(status, "tokens.html", app.pageData(c, page))
+}
+
+func (app *Application) CreateToken(c echo.Context) error {
+	var form struct {
+		Name          string   `form:"name" validate:"required,max=100"`
+		Kind          string   `form:"kind" validate:"required,oneof=key jwt"`
+		Scopes        []string `form:"scope" validate:"required,dive,oneof=links:write links:read stats:read"`
+		Workspace     int64    `form:"workspace"`
+		ExpiresInDays int      `form:"expires_in_days" validate:"min=0,max=365"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	form.Name = strings.TrimSpace(form.Name)
+
+	invalid := func(msg string) error {
+		return app.renderTokens(c, http.StatusUnprocessableEntity, map[string]any{"error": msg})
+	}
+	if err := c.Validate(form); err != nil {
+		return invalid(err.Error())
+	}
+	if form.Kind == TokenKindJWT && app.TokenSigner == nil {
+		return invalid("signed tokens are not enabled on this server")
+	}
+	if form.Kind == TokenKindJWT && form.ExpiresInDays == 0 {
+		return invalid("signed tokens must expire")
+	}
+
+	ctx := c.Request().Context()
+	user := currentUser(c)
+	if form.Workspace != 0 {
+		if _, err := app.Workspaces.GetMembership(ctx, form.Workspace, user.ID); err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return invalid("you are not a member of this workspace")
+			}
+			return err
+		}
+	}
+
+	token := &APIToken{
+		UserID:      user.ID,
+		WorkspaceID: form.Workspace,
+		Name:        form.Name,
+		Kind:        form.Kind,
+		Scopes:      slices.Compact(slices.Sorted(slices.Values(form.Scopes))),
+	}
+	if form.ExpiresInDays > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(form.ExpiresInDays) * 24 * time.Hour).Truncate(time.Second)
+	}
+
+	var secret, secretHash string
+	if token.Kind == TokenKindKey {
+		var err error
+		if secret, secretHash, err = newAPIKeySecret(); err != nil {
+			return err
+		}
+	}
+	if err := app.Tokens.CreateAPIToken(ctx, token, secretHash); err != nil {
+		return err
+	}
+	if token.Kind == TokenKindJWT {
+		var err error
+		if secret, err = app.TokenSigner.Sign(token); err != nil {
+			return err
+		}
+	}
+
+	// The secret is only ever shown once.
+	return app.renderTokens(c, http.StatusCreated, map[string]any{"secret": secret})
+}
+
+// newAPIKeySecret returns a new opaque API key and the hash it is stored by.
+func newAPIKeySecret() (secret, secretHash string, err error) {
+	random, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	secret = apiKeyPrefix + random
+	return secret, hashToken(secret), nil
+}
+
+func (app *Application) RevokeToken(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+	if err := app.Tokens.RevokeAPIToken(c.Request().Context(), currentUser(c).ID, id); err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+		}
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/tokens")
+}
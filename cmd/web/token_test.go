@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memoryTokenStore struct {
+	mu       sync.Mutex
+	tokens   []*APIToken
+	secrets  map[string]int64
+	denylist map[string]bool
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{secrets: map[string]int64{}, denylist: map[string]bool{}}
+}
+
+func (s *memoryTokenStore) CreateAPIToken(_ context.Context, token *APIToken, secretHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token.ID = int64(len(s.tokens) + 1)
+	token.CreatedAt = time.Now()
+	stored := *token
+	s.tokens = append(s.tokens, &stored)
+	if secretHash != "" {
+		s.secrets[secretHash] = token.ID
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) GetAPITokenBySecret(_ context.Context, secretHash string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.secrets[secretHash]
+	if !ok || s.tokens[id-1] == nil {
+		return nil, ErrRecordNotFound
+	}
+	token := *s.tokens[id-1]
+	if !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return &token, nil
+}
+
+func (s *memoryTokenStore) ListAPITokens(_ context.Context, userID int64) ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []APIToken
+	for _, t := range s.tokens {
+		if t != nil && t.UserID == userID {
+			tokens = append(tokens, *t)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *memoryTokenStore) RevokeAPIToken(_ context.Context, userID, tokenID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tokenID < 1 || tokenID > int64(len(s.tokens)) || s.tokens[tokenID-1] == nil || s.tokens[tokenID-1].UserID != userID {
+		return ErrRecordNotFound
+	}
+	if s.tokens[tokenID-1].Kind == TokenKindJWT {
+		s.denylist[strconv.FormatInt(tokenID, 10)] = true
+	}
+	s.tokens[tokenID-1] = nil
+	return nil
+}
+
+func (s *memoryTokenStore) IsTokenRevoked(_ context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.denylist[jti], nil
+}
+
+func testTokenKey(kid string) string {
+	return kid + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(kid, 32)))
+}
+
+func TestTokenSigner(t *testing.T) {
+	oldSigner, err := NewTokenSigner(testTokenKey("k1"))
+	require.NoError(t, err)
+
+	token := &APIToken{
+		ID:          7,
+		UserID:      3,
+		WorkspaceID: 2,
+		Scopes:      []string{ScopeLinksRead, ScopeLinksWrite},
+		CreatedAt:   time.Now().Truncate(time.Second),
+		ExpiresAt:   time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+	raw, err := oldSigner.Sign(token)
+	require.NoError(t, err)
+
+	got, err := oldSigner.Verify(raw)
+	require.NoError(t, err)
+	require.Equal(t, token.ID, got.ID)
+	require.Equal(t, token.UserID, got.UserID)
+	require.Equal(t, token.WorkspaceID, got.WorkspaceID)
+	require.Equal(t, token.Scopes, got.Scopes)
+	require.Equal(t, TokenKindJWT, got.Kind)
+	require.True(t, token.ExpiresAt.Equal(got.ExpiresAt))
+
+	// After rotation new tokens use k2 while k1 tokens keep working until
+	// k1 is removed.
+	rotated, err := NewTokenSigner(testTokenKey("k2") + "," + testTokenKey("k1"))
+	require.NoError(t, err)
+	_, err = rotated.Verify(raw)
+	require.NoError(t, err)
+	newRaw, err := rotated.Sign(token)
+	require.NoError(t, err)
+	_, err = oldSigner.Verify(newRaw)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	retired, err := NewTokenSigner(testTokenKey("k2"))
+	require.NoError(t, err)
+	_, err = retired.Verify(raw)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = retired.Verify(newRaw)
+	require.NoError(t, err)
+
+	parts := strings.Split(raw, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"jti":"7","sub":"user:1","scope":"links:write","exp":9999999999}`)) + "." + parts[2]
+	_, err = oldSigner.Verify(tampered)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + "."
+	_, err = oldSigner.Verify(unsigned)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	token.ExpiresAt = time.Now().Add(-time.Minute)
+	expired, err := oldSigner.Sign(token)
+	require.NoError(t, err)
+	_, err = oldSigner.Verify(expired)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestNewTokenSignerErrors(t *testing.T) {
+	short := "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))
+	for _, spec := range []string{"", "k1", ":c2VjcmV0", "k1:not base64", short, testTokenKey("k1") + "," + testTokenKey("k1")} {
+		_, err := NewTokenSigner(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+var tokenSecretPattern = regexp.MustCompile(`id="token-secret"[^>]*>([^<]+)<`)
+
+func (s *workspaceTestServer) createToken(t *testing.T, client *http.Client, values url.Values) string {
+	t.Helper()
+	resp := submitForm(t, client, s.URL, "/tokens", "/tokens", values)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	m := tokenSecretPattern.FindSubmatch(body)
+	require.NotNil(t, m)
+	return string(m[1])
+}
+
+func (s *workspaceTestServer) api(t *testing.T, method, path, token string) int {
+	t.Helper()
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(`{"url": "https://example.com/ci"}`)
+	}
+	req, err := http.NewRequest(method, s.URL+path, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := newClient().Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	s := newWorkspaceTestServer(t)
+	alice := s.register(t, "alice@example.com")
+
+	key := s.createToken(t, alice, url.Values{
+		"name":            {"CI"},
+		"kind":            {TokenKindKey},
+		"scope":           {ScopeLinksWrite},
+		"expires_in_days": {"0"},
+	})
+	require.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	require.Equal(t, http.StatusCreated, s.api(t, http.MethodPost, "/api/shorten", key))
+	require.Equal(t, "user:1", s.links[0].Owner)
+	require.Equal(t, http.StatusForbidden, s.api(t, http.MethodGet, "/api/links", key))
+
+	jwt := s.createToken(t, alice, url.Values{
+		"name":            {"Dashboard"},
+		"kind":            {TokenKindJWT},
+		"scope":           {ScopeLinksRead, ScopeStatsRead},
+		"expires_in_days": {"30"},
+	})
+	require.Equal(t, 2, strings.Count(jwt, "."))
+	require.Equal(t, http.StatusOK, s.api(t, http.MethodGet, "/api/links", jwt))
+	require.Equal(t, http.StatusForbidden, s.api(t, http.MethodPost, "/api/shorten", jwt))
+
+	stats := "/api/links/" + s.links[0].Alias + "/stats"
+	require.Equal(t, http.StatusOK, s.api(t, http.MethodGet, stats, jwt))
+	require.Equal(t, http.StatusNotFound, s.api(t, http.MethodGet, "/api/links/missing/stats", jwt))
+	require.Equal(t, http.StatusForbidden, s.api(t, http.MethodGet, stats, key))
+	reader := s.createToken(t, alice, url.Values{"name": {"reader"}, "kind": {TokenKindKey}, "scope": {ScopeLinksRead}})
+	require.Equal(t, http.StatusOK, s.api(t, http.MethodGet, "/api/links", reader))
+	require.Equal(t, http.StatusForbidden, s.api(t, http.MethodGet, stats, reader))
+
+	require.Equal(t, http.StatusUnauthorized, s.api(t, http.MethodGet, "/api/links", "usk_unknown"))
+	require.Equal(t, http.StatusUnauthorized, s.api(t, http.MethodGet, "/api/links", "not.a.token"))
+	require.Equal(t, http.StatusUnauthorized, s.api(t, http.MethodGet, "/api/links", ""))
+
+	resp := submitForm(t, alice, s.URL, "/tokens", "/tokens/2/revoke", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, http.StatusUnauthorized, s.api(t, http.MethodGet, "/api/links", jwt))
+
+	resp = submitForm(t, alice, s.URL, "/tokens", "/tokens/1/revoke", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, http.StatusUnauthorized, s.api(t, http.MethodPost, "/api/shorten", key))
+
+	// Tokens of other users cannot be revoked.
+	s.createToken(t, alice, url.Values{"name": {"mine"}, "kind": {TokenKindKey}, "scope": {ScopeLinksRead}})
+	bob := s.register(t, "bob@example.com")
+	resp = submitForm(t, bob, s.URL, "/tokens", "/tokens/3/revoke", url.Values{})
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAPITokenValidation(t *testing.T) {
+	s := newWorkspaceTestServer(t)
+	alice := s.register(t, "alice@example.com")
+
+	for _, values := range []url.Values{
+		{"name": {"no scopes"}, "kind": {TokenKindKey}},
+		{"name": {"bad scope"}, "kind": {TokenKindKey}, "scope": {"links:delete"}},
+		{"name": {"forever"}, "kind": {TokenKindJWT}, "scope": {ScopeLinksRead}, "expires_in_days": {"0"}},
+		{"name": {"foreign"}, "kind": {TokenKindKey}, "scope": {ScopeLinksRead}, "workspace": {"1"}},
+	} {
+		resp := submitForm(t, alice, s.URL, "/tokens", "/tokens", values)
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, values.Get("name"))
+	}
+}
+
+func TestWorkspaceTokenFollowsMemberRole(t *testing.T) {
+	s := newWorkspaceTestServer(t)
+	admin := s.register(t, "admin@example.com")
+	viewer := s.register(t, "viewer@example.com")
+
+	resp := submitForm(t, admin, s.URL, "/workspaces", "/workspaces", url.Values{"name": {"Growth"}})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	path := s.invite(t, admin, "viewer@example.com", WorkspaceViewer)
+	resp = submitForm(t, viewer, s.URL, path, path, url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	adminKey := s.createToken(t, admin, url.Values{"name": {"ci"}, "kind": {TokenKindKey}, "scope": {ScopeLinksWrite}, "workspace": {"1"}})
+	require.Equal(t, http.StatusCreated, s.api(t, http.MethodPost, "/api/shorten", adminKey))
+	require.Equal(t, "workspace:1", s.links[0].Owner)
+
+	// The scope does not grant more than the role of the token owner.
+	viewerKey := s.createToken(t, viewer, url.Values{"name": {"ci"}, "kind": {TokenKindKey}, "scope": {ScopeLinksWrite, ScopeLinksRead}, "workspace": {"1"}})
+	require.Equal(t, http.StatusForbidden, s.api(t, http.MethodPost, "/api/shorten", viewerKey))
+	require.Equal(t, http.StatusOK, s.api(t, http.MethodGet, "/api/links", viewerKey))
+
+	// Removing the member invalidates their workspace tokens.
+	resp = submitForm(t, admin, s.URL, "/workspaces/1", "/workspaces/1/members/2/remove", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, http.StatusUnauthorized, s.api(t, http.MethodGet, "/api/links", viewerKey))
+}
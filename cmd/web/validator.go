@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -18,15 +19,24 @@ func (cv *CustomValidator) Validate(i any) error {
 		}
 
 		e := err.(validator.ValidationErrors)[0]
-		if e.Tag() == "required" && e.Field() == "URL" {
-			return fmt.Errorf("missing url")
+		if e.Tag() == "required" {
+			return fmt.Errorf("missing %s", strings.ToLower(e.Field()))
 		}
 		if e.Tag() == "http_url" {
 			return fmt.Errorf("must be a valid HTTP(S) URL")
 		}
+		if e.Tag() == "email" {
+			return fmt.Errorf("must be a valid email address")
+		}
+		if e.Tag() == "min" {
+			return fmt.Errorf("must be at least %s characters long", e.Param())
+		}
 		if e.Tag() == "max" {
 			return fmt.Errorf("must be at most %s characters long", e.Param())
 		}
+		if e.Tag() == "oneof" {
+			return fmt.Errorf("must be one of: %s", strings.ReplaceAll(e.Param(), " ", ", "))
+		}
 
 		return fmt.Errorf("validation failed for '%s': %s", e.Field(), e.Tag())
 	}
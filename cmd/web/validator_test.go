@@ -64,15 +64,54 @@ func TestValidatorTooLong(t *testing.T) {
 	require.Contains(t, err.Error(), "must be at most 500 characters long")
 }
 
+func TestValidatorInvalidEmail(t *testing.T) {
+	cv := newTestValidator()
+	input := struct {
+		Email    string `validate:"required,email"`
+		Password string `validate:"required,min=8"`
+	}{
+		Email:    "not-an-email",
+		Password: "long enough",
+	}
+
+	err := cv.Validate(input)
+	require.Error(t, err)
+	require.Equal(t, "must be a valid email address", err.Error())
+
+	input.Email = "user@example.com"
+	input.Password = "short"
+	err = cv.Validate(input)
+	require.Error(t, err)
+	require.Equal(t, "must be at least 8 characters long", err.Error())
+
+	input.Password = ""
+	err = cv.Validate(input)
+	require.Error(t, err)
+	require.Equal(t, "missing password", err.Error())
+}
+
 func TestValidatorFallbackError(t *testing.T) {
 	cv := newTestValidator()
 	input := struct {
-		Email string `validate:"required,email"`
+		Code string `validate:"required,alphanum"`
 	}{
-		Email: "not-an-email",
+		Code: "not alphanumeric",
 	}
 
 	err := cv.Validate(input)
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "validation failed for")
 }
+
+func TestValidatorOneOf(t *testing.T) {
+	cv := newTestValidator()
+	input := struct {
+		Role string `validate:"required,oneof=admin editor viewer"`
+	}{
+		Role: "owner",
+	}
+
+	err := cv.Validate(input)
+	require.Error(t, err)
+	require.Equal(t, "must be one of: admin, editor, viewer", err.Error())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Variant is one of the destinations a split link shares its visitors
+// between, in proportion to Weight.
+type Variant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// MaxVariants is the largest number of variants a link can have.
+const MaxVariants = 10
+
+// variantCookieTTL is how long a visitor keeps being sent to the same
+// variant.
+const variantCookieTTL = 30 * 24 * time.Hour
+
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ErrInvalidVariant is returned for variants that cannot be served.
+var ErrInvalidVariant = errors.New("invalid variant")
+
+func validateVariants(variants []Variant) error {
+	if len(variants) == 1 {
+		return fmt.Errorf("%w: a split needs at least two variants", ErrInvalidVariant)
+	}
+	if len(variants) > MaxVariants {
+		return fmt.Errorf("%w: a link can have at most %d variants", ErrInvalidVariant, MaxVariants)
+	}
+	names := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if !variantNamePattern.MatchString(v.Name) {
+			return fmt.Errorf("%w: name %q must be 1 to 32 letters, digits, dashes or underscores", ErrInvalidVariant, v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("%w: duplicate name %q", ErrInvalidVariant, v.Name)
+		}
+		names[v.Name] = true
+		if !validDestination(v.URL) || len(v.URL) > 500 {
+			return fmt.Errorf("%w %s: url %s", ErrInvalidVariant, v.Name, ErrInvalidURL)
+		}
+		if v.Weight < 1 || v.Weight > 1000 {
+			return fmt.Errorf("%w %s: weight must be between 1 and 1000", ErrInvalidVariant, v.Name)
+		}
+	}
+	return nil
+}
+
+// pickVariant returns the variant for the visitor. A visitor that was
+// assigned a variant that still exists keeps it; others are assigned one by
+// hashing their ID, so that they get the same one as long as the ID stays
+// the same.
+func (l *Link) pickVariant(v Visitor) *Variant {
+	total := 0
+	for i := range l.Variants {
+		if l.Variants[i].Name == v.Variant {
+			return &l.Variants[i]
+		}
+		total += l.Variants[i].Weight
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(l.Alias + " " + v.ID))
+	n := int(h.Sum64() % uint64(total))
+	for i := range l.Variants {
+		if n < l.Variants[i].Weight {
+			return &l.Variants[i]
+		}
+		n -= l.Variants[i].Weight
+	}
+	return &l.Variants[len(l.Variants)-1]
+}
+
+func variantCookieName(alias string) string {
+	return "variant_" + alias
+}
+
+// setVariantCookie remembers the variant a visitor was sent to, so that they
+// keep getting it when their IP address changes.
+func (app *Application) setVariantCookie(c echo.Context, alias, variant string) {
+	c.SetCookie(&http.Cookie{
+		Name:     variantCookieName(alias),
+		Value:    variant,
+		Path:     "/r/" + alias,
+		MaxAge:   int(variantCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   app.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
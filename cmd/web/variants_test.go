@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateVariants(t *testing.T) {
+	valid := []Variant{
+		{Name: "a", URL: "https://example.com/a", Weight: 1},
+		{Name: "b", URL: "https://example.com/b", Weight: 3},
+	}
+	require.NoError(t, validateVariants(nil))
+	require.NoError(t, validateVariants(valid))
+
+	invalid := [][]Variant{
+		valid[:1],
+		{valid[0], valid[0]},
+		{valid[0], {Name: "b c", URL: "https://example.com/b", Weight: 1}},
+		{valid[0], {Name: "b", URL: "mailto:b@example.com", Weight: 1}},
+		{valid[0], {Name: "b", URL: "https://example.com/b", Weight: 0}},
+		make([]Variant, MaxVariants+1),
+	}
+	for _, variants := range invalid {
+		require.ErrorIs(t, validateVariants(variants), ErrInvalidVariant, "%+v", variants)
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	link := &Link{
+		Alias: "abcdefghijk",
+		Variants: []Variant{
+			{Name: "a", URL: "https://example.com/a", Weight: 1},
+			{Name: "b", URL: "https://example.com/b", Weight: 3},
+		},
+	}
+
+	counts := map[string]int{}
+	for i := range 4000 {
+		v := Visitor{ID: fmt.Sprintf("198.51.%d.%d", i/256, i%256)}
+		picked := link.pickVariant(v)
+		require.Same(t, picked, link.pickVariant(v), "assignment must be sticky")
+		counts[picked.Name]++
+	}
+	require.InDelta(t, 1000, counts["a"], 150)
+	require.InDelta(t, 3000, counts["b"], 150)
+
+	// A previous assignment wins over the hash, unless the variant is gone.
+	require.Equal(t, "a", link.pickVariant(Visitor{ID: "192.0.2.1", Variant: "a"}).Name)
+	require.Equal(t, "b", link.pickVariant(Visitor{ID: "192.0.2.1", Variant: "b"}).Name)
+	require.NotEqual(t, "c", link.pickVariant(Visitor{ID: "192.0.2.1", Variant: "c"}).Name)
+
+	routed, variant := link.Route(Visitor{Variant: "b"})
+	require.Equal(t, "https://example.com/b", routed.OriginalURL)
+	require.Equal(t, "b", variant.Name)
+
+	link.Rules = []Rule{{Devices: []string{DeviceMobile}, URL: "https://m.example.com/"}}
+	routed, variant = link.Route(Visitor{Device: DeviceMobile, Variant: "b"})
+	require.Equal(t, "https://m.example.com/", routed.OriginalURL)
+	require.Nil(t, variant)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	WorkspaceAdmin  = "admin"
+	WorkspaceEditor = "editor"
+	WorkspaceViewer = "viewer"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+var (
+	ErrLastAdmin          = errors.New("workspace must keep at least one admin")
+	ErrInvitationMismatch = errors.New("invitation was sent to another email address")
+)
+
+type Workspace struct {
+	ID        int64
+	Name      string
+	CreatedAt time.Time
+}
+
+type Membership struct {
+	Workspace Workspace
+	UserID    int64
+	Email     string
+	Role      string
+}
+
+type Invitation struct {
+	TokenHash string
+	Workspace Workspace
+	Email     string
+	Role      string
+	InvitedBy int64
+	ExpiresAt time.Time
+}
+
+type WorkspaceStore interface {
+	CreateWorkspace(ctx context.Context, name string, adminID int64) (*Workspace, error)
+	ListMemberships(ctx context.Context, userID int64) ([]Membership, error)
+	GetMembership(ctx context.Context, workspaceID, userID int64) (*Membership, error)
+	ListMembers(ctx context.Context, workspaceID int64) ([]Membership, error)
+	RemoveMember(ctx context.Context, workspaceID, userID int64) error
+	CreateInvitation(ctx context.Context, invitation *Invitation) error
+	GetInvitation(ctx context.Context, tokenHash string) (*Invitation, error)
+	AcceptInvitation(ctx context.Context, tokenHash string, user *User) (*Membership, error)
+}
+
+type Permission string
+
+const (
+	PermViewWorkspace Permission = "workspace:view"
+	PermCreateLinks   Permission = "links:create"
+	PermManageMembers Permission = "members:manage"
+)
+
+// workspacePolicy lists the workspace roles that are granted each permission.
+// It is the single source of truth for workspace authorization.
+var workspacePolicy = map[Permission][]string{
+	PermViewWorkspace: {WorkspaceAdmin, WorkspaceEditor, WorkspaceViewer},
+	PermCreateLinks:   {WorkspaceAdmin, WorkspaceEditor},
+	PermManageMembers: {WorkspaceAdmin},
+}
+
+func Can(role string, perm Permission) bool {
+	return slices.Contains(workspacePolicy[perm], role)
+}
+
+func workspaceOwner(id int64) string {
+	return fmt.Sprintf("workspace:%d", id)
+}
+
+// parseOwner splits an owner such as "user:42" or "workspace:7" into its kind
+// and ID. The anonymous owner "" has neither.
+func parseOwner(owner string) (kind string, id int64, err error) {
+	if owner == "" {
+		return "", 0, nil
+	}
+	kind, rawID, _ := strings.Cut(owner, ":")
+	id, err = strconv.ParseInt(rawID, 10, 64)
+	if (kind != "user" && kind != "workspace") || err != nil || id < 1 || strconv.FormatInt(id, 10) != rawID {
+		return "", 0, fmt.Errorf("invalid owner %q", owner)
+	}
+	return kind, id, nil
+}
+
+func currentMembership(c echo.Context) *Membership {
+	m, _ := c.Get("membership").(*Membership)
+	return m
+}
+
+// RequireLogin sends anonymous browsers to the login page.
+func (app *Application) RequireLogin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if currentUser(c) == nil {
+			return loginRequired(c)
+		}
+		return next(c)
+	}
+}
+
+func loginRequired(c echo.Context) error {
+	if c.Request().Method == http.MethodGet {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return echo.NewHTTPError(http.StatusUnauthorized, "authentication required")
+}
+
+// Authorize loads the workspace named by the :workspace route parameter and
+// rejects the request unless the role of the current user in it grants perm.
+// Handlers behind it do not check access again; links they create belong to
+// the workspace.
+func (app *Application) Authorize(perm Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := currentUser(c)
+			if user == nil {
+				return loginRequired(c)
+			}
+			notFound := echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+
+			id, err := strconv.ParseInt(c.Param("workspace"), 10, 64)
+			if err != nil {
+				return notFound
+			}
+			// Non-members get the same response for existing and missing
+			// workspaces.
+			membership, err := app.Workspaces.GetMembership(c.Request().Context(), id, user.ID)
+			if err != nil {
+				if errors.Is(err, ErrRecordNotFound) {
+					return notFound
+				}
+				return err
+			}
+			if !Can(membership.Role, perm) {
+				return echo.NewHTTPError(http.StatusForbidden, "you are not allowed to do this in this workspace")
+			}
+
+			c.Set("membership", membership)
+			c.Set("owner", workspaceOwner(id))
+			return next(c)
+		}
+	}
+}
+
+func (app *Application) ListWorkspaces(c echo.Context) error {
+	memberships, err := app.Workspaces.ListMemberships(c.Request().Context(), currentUser(c).ID)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "workspaces.html", app.pageData(c, map[string]any{
+		"memberships": memberships,
+	}))
+}
+
+func (app *Application) CreateWorkspace(c echo.Context) error {
+	var form struct {
+		Name string `form:"name" validate:"required,max=100"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	form.Name = strings.TrimSpace(form.Name)
+
+	if err := c.Validate(form); err != nil {
+		memberships, listErr := app.Workspaces.ListMemberships(c.Request().Context(), currentUser(c).ID)
+		if listErr != nil {
+			return listErr
+		}
+		return c.Render(http.StatusUnprocessableEntity, "workspaces.html", app.pageData(c, map[string]any{
+			"memberships": memberships,
+			"error":       err.Error(),
+		}))
+	}
+
+	workspace, err := app.Workspaces.CreateWorkspace(c.Request().Context(), form.Name, currentUser(c).ID)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/workspaces/%d", workspace.ID))
+}
+
+func (app *Application) ShowWorkspace(c echo.Context) error {
+	return app.renderWorkspace(c, http.StatusOK, nil)
+}
+
+func (app *Application) renderWorkspace(c echo.Context, status int, data map[string]any) error {
+	ctx := c.Request().Context()
+	membership := currentMembership(c)
+
+	links, err := app.Repo.ListLinks(ctx, workspaceOwner(membership.Workspace.ID), 50)
+	if err != nil {
+		return err
+	}
+	members, err := app.Workspaces.ListMembers(ctx, membership.Workspace.ID)
+	if err != nil {
+		return err
+	}
+
+	page := map[string]any{
+		"workspace":   membership.Workspace,
+		"role":        membership.Role,
+		"links":       links,
+		"members":     members,
+		"baseURL":     app.BaseURL,
+		"canCreate":   Can(membership.Role, PermCreateLinks),
+		"canManage":   Can(membership.Role, PermManageMembers),
+		"inviteRoles": []string{WorkspaceViewer, WorkspaceEditor, WorkspaceAdmin},
+	}
+	for k, v := range data {
+		page[k] = v
+	}
+	return c.Render(status, "workspace.html", app.pageData(c, page))
+}
+
+func (app *Application) InviteMember(c echo.Context) error {
+	var form struct {
+		Email string `form:"email" validate:"required,email,max=254"`
+		Role  string `form:"role" validate:"required,oneof=admin editor viewer"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return err
+	}
+	form.Email = strings.ToLower(strings.TrimSpace(form.Email))
+
+	if err := c.Validate(form); err != nil {
+		return app.renderWorkspace(c, http.StatusUnprocessableEntity, map[string]any{"error": err.Error()})
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	membership := currentMembership(c)
+	err = app.Workspaces.CreateInvitation(c.Request().Context(), &Invitation{
+		TokenHash: hashToken(token),
+		Workspace: membership.Workspace,
+		Email:     form.Email,
+		Role:      form.Role,
+		InvitedBy: membership.UserID,
+		ExpiresAt: time.Now().Add(invitationTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nothing sends emails yet, so the admin shares the link themselves.
+	return app.renderWorkspace(c, http.StatusCreated, map[string]any{
+		"invitedEmail": form.Email,
+		"inviteURL":    app.BaseURL + "/invitations/" + token,
+	})
+}
+
+func (app *Application) RemoveMember(c echo.Context) error {
+	membership := currentMembership(c)
+	userID, err := strconv.ParseInt(c.Param("user"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+	}
+
+	err = app.Workspaces.RemoveMember(c.Request().Context(), membership.Workspace.ID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "requested resource could not be found")
+		case errors.Is(err, ErrLastAdmin):
+			return app.renderWorkspace(c, http.StatusConflict, map[string]any{"error": err.Error()})
+		}
+		return err
+	}
+
+	if userID == membership.UserID {
+		return c.Redirect(http.StatusSeeOther, "/workspaces")
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/workspaces/%d", membership.Workspace.ID))
+}
+
+func (app *Application) ShowInvitation(c echo.Context) error {
+	invitation, err := app.Workspaces.GetInvitation(c.Request().Context(), hashToken(c.Param("token")))
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return c.Render(http.StatusNotFound, "invitation.html", app.pageData(c, map[string]any{
+				"error": "this invitation is invalid or has expired",
+			}))
+		}
+		return err
+	}
+	return c.Render(http.StatusOK, "invitation.html", app.pageData(c, map[string]any{
+		"invitation": invitation,
+		"token":      c.Param("token"),
+	}))
+}
+
+func (app *Application) AcceptInvitation(c echo.Context) error {
+	membership, err := app.Workspaces.AcceptInvitation(c.Request().Context(), hashToken(c.Param("token")), currentUser(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return c.Render(http.StatusNotFound, "invitation.html", app.pageData(c, map[string]any{
+				"error": "this invitation is invalid or has expired",
+			}))
+		case errors.Is(err, ErrInvitationMismatch):
+			return c.Render(http.StatusForbidden, "invitation.html", app.pageData(c, map[string]any{
+				"error": "this invitation was sent to another email address",
+			}))
+		}
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/workspaces/%d", membership.Workspace.ID))
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memoryWorkspaceStore struct {
+	mu          sync.Mutex
+	users       *memoryUserStore
+	workspaces  []Workspace
+	members     map[int64]map[int64]string
+	invitations map[string]*Invitation
+}
+
+func newMemoryWorkspaceStore(users *memoryUserStore) *memoryWorkspaceStore {
+	return &memoryWorkspaceStore{
+		users:       users,
+		members:     map[int64]map[int64]string{},
+		invitations: map[string]*Invitation{},
+	}
+}
+
+func (s *memoryWorkspaceStore) CreateWorkspace(_ context.Context, name string, adminID int64) (*Workspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := Workspace{ID: int64(len(s.workspaces) + 1), Name: name, CreatedAt: time.Now()}
+	s.workspaces = append(s.workspaces, w)
+	s.members[w.ID] = map[int64]string{adminID: WorkspaceAdmin}
+	return &w, nil
+}
+
+func (s *memoryWorkspaceStore) membership(workspaceID, userID int64) *Membership {
+	role, ok := s.members[workspaceID][userID]
+	if !ok {
+		return nil
+	}
+	return &Membership{
+		Workspace: s.workspaces[workspaceID-1],
+		UserID:    userID,
+		Email:     s.users.users[userID-1].Email,
+		Role:      role,
+	}
+}
+
+func (s *memoryWorkspaceStore) ListMemberships(_ context.Context, userID int64) ([]Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var memberships []Membership
+	for _, w := range s.workspaces {
+		if m := s.membership(w.ID, userID); m != nil {
+			memberships = append(memberships, *m)
+		}
+	}
+	return memberships, nil
+}
+
+func (s *memoryWorkspaceStore) GetMembership(_ context.Context, workspaceID, userID int64) (*Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.membership(workspaceID, userID); m != nil {
+		return m, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryWorkspaceStore) ListMembers(_ context.Context, workspaceID int64) ([]Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var members []Membership
+	for userID := range s.members[workspaceID] {
+		members = append(members, *s.membership(workspaceID, userID))
+	}
+	return members, nil
+}
+
+func (s *memoryWorkspaceStore) RemoveMember(_ context.Context, workspaceID, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	role, ok := s.members[workspaceID][userID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	admins := 0
+	for _, r := range s.members[workspaceID] {
+		if r == WorkspaceAdmin {
+			admins++
+		}
+	}
+	if role == WorkspaceAdmin && admins == 1 {
+		return ErrLastAdmin
+	}
+	delete(s.members[workspaceID], userID)
+	return nil
+}
+
+func (s *memoryWorkspaceStore) CreateInvitation(_ context.Context, invitation *Invitation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invitations[invitation.TokenHash] = invitation
+	return nil
+}
+
+func (s *memoryWorkspaceStore) GetInvitation(_ context.Context, tokenHash string) (*Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invitations[tokenHash]
+	if !ok || inv.ExpiresAt.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return inv, nil
+}
+
+func (s *memoryWorkspaceStore) AcceptInvitation(ctx context.Context, tokenHash string, user *User) (*Membership, error) {
+	inv, err := s.GetInvitation(ctx, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Email != user.Email {
+		return nil, ErrInvitationMismatch
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.members[inv.Workspace.ID][user.ID]; !ok {
+		s.members[inv.Workspace.ID][user.ID] = inv.Role
+	}
+	delete(s.invitations, tokenHash)
+	return s.membership(inv.Workspace.ID, user.ID), nil
+}
+
+func TestWorkspacePolicy(t *testing.T) {
+	tests := []struct {
+		role string
+		perm Permission
+		want bool
+	}{
+		{WorkspaceAdmin, PermViewWorkspace, true},
+		{WorkspaceAdmin, PermCreateLinks, true},
+		{WorkspaceAdmin, PermManageMembers, true},
+		{WorkspaceEditor, PermViewWorkspace, true},
+		{WorkspaceEditor, PermCreateLinks, true},
+		{WorkspaceEditor, PermManageMembers, false},
+		{WorkspaceViewer, PermViewWorkspace, true},
+		{WorkspaceViewer, PermCreateLinks, false},
+		{WorkspaceViewer, PermManageMembers, false},
+		{"", PermViewWorkspace, false},
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.want, Can(tc.role, tc.perm), "%s %s", tc.role, tc.perm)
+	}
+}
+
+var inviteURLPattern = regexp.MustCompile(`id="invite-url"[^>]*>([^<]+)<`)
+
+type workspaceTestServer struct {
+	*httptest.Server
+	users      *memoryUserStore
+	workspaces *memoryWorkspaceStore
+
+	mu    sync.Mutex
+	links []Link
+}
+
+func newWorkspaceTestServer(t *testing.T) *workspaceTestServer {
+	t.Helper()
+	users := newMemoryUserStore()
+	s := &workspaceTestServer{users: users, workspaces: newMemoryWorkspaceStore(users)}
+	signer, err := NewTokenSigner(testTokenKey("k1"))
+	require.NoError(t, err)
+	app := &Application{
+		Logger:      slog.New(slog.DiscardHandler),
+		Users:       users,
+		Workspaces:  s.workspaces,
+		Tokens:      newMemoryTokenStore(),
+		TokenSigner: signer,
+		Repo: &mockRepo{
+			insertFn: func(_ context.Context, link *Link) (string, error) {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.links = append(s.links, *link)
+				return link.Alias, nil
+			},
+			listLinksFn: func(_ context.Context, owner string, _ int) ([]Link, error) {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				var links []Link
+				for _, l := range s.links {
+					if l.Owner == owner {
+						links = append(links, l)
+					}
+				}
+				return links, nil
+			},
+			ownedLinkFn: func(_ context.Context, owner, alias string) (*Link, error) {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				for _, l := range s.links {
+					if l.Owner == owner && l.Alias == alias {
+						return &l, nil
+					}
+				}
+				return nil, ErrRecordNotFound
+			},
+		},
+	}
+	s.Server = httptest.NewTLSServer(app.Router())
+	app.BaseURL = s.URL
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *workspaceTestServer) register(t *testing.T, email string) *http.Client {
+	t.Helper()
+	client := newBrowser(t)
+	resp := submitForm(t, client, s.URL, "/register", "/register", url.Values{
+		"email":    {email},
+		"password": {"long enough"},
+	})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	return client
+}
+
+func (s *workspaceTestServer) invite(t *testing.T, admin *http.Client, email, role string) string {
+	t.Helper()
+	resp := submitForm(t, admin, s.URL, "/workspaces/1", "/workspaces/1/invitations", url.Values{
+		"email": {email},
+		"role":  {role},
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	m := inviteURLPattern.FindSubmatch(body)
+	require.NotNil(t, m)
+	return strings.TrimPrefix(string(m[1]), s.URL)
+}
+
+func (s *workspaceTestServer) shorten(t *testing.T, client *http.Client, workspace string) int {
+	t.Helper()
+	resp, err := client.Post(s.URL+"/api/workspaces/"+workspace+"/shorten", "application/json",
+		strings.NewReader(`{"url": "https://example.com/team"}`))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode
+}
+
+func TestWorkspaceRoles(t *testing.T) {
+	s := newWorkspaceTestServer(t)
+	admin := s.register(t, "admin@example.com")
+	editor := s.register(t, "editor@example.com")
+	viewer := s.register(t, "viewer@example.com")
+	outsider := s.register(t, "outsider@example.com")
+
+	resp := submitForm(t, admin, s.URL, "/workspaces", "/workspaces", url.Values{"name": {"Growth"}})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/workspaces/1", resp.Header.Get("Location"))
+
+	for client, role := range map[*http.Client]string{editor: WorkspaceEditor, viewer: WorkspaceViewer} {
+		email := map[string]string{WorkspaceEditor: "editor@example.com", WorkspaceViewer: "viewer@example.com"}[role]
+		path := s.invite(t, admin, email, role)
+		resp := submitForm(t, client, s.URL, path, path, url.Values{})
+		require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	}
+
+	require.Equal(t, http.StatusCreated, s.shorten(t, admin, "1"))
+	require.Equal(t, http.StatusCreated, s.shorten(t, editor, "1"))
+	require.Equal(t, http.StatusForbidden, s.shorten(t, viewer, "1"))
+	require.Equal(t, http.StatusNotFound, s.shorten(t, outsider, "1"))
+	require.Equal(t, http.StatusNotFound, s.shorten(t, admin, "2"))
+	require.Equal(t, http.StatusUnauthorized, s.shorten(t, newBrowser(t), "1"))
+	for _, l := range s.links {
+		require.Equal(t, "workspace:1", l.Owner)
+	}
+
+	status, body := getPage(t, viewer, s.URL+"/workspaces/1")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "https://example.com/team")
+	require.NotContains(t, body, "/invitations\"")
+
+	status, _ = getPage(t, outsider, s.URL+"/workspaces/1")
+	require.Equal(t, http.StatusNotFound, status)
+
+	resp = submitForm(t, editor, s.URL, "/workspaces/1", "/workspaces/1/invitations", url.Values{
+		"email": {"outsider@example.com"},
+		"role":  {WorkspaceAdmin},
+	})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = submitForm(t, admin, s.URL, "/workspaces/1", "/workspaces/1/members/3/remove", url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	status, _ = getPage(t, viewer, s.URL+"/workspaces/1")
+	require.Equal(t, http.StatusNotFound, status)
+
+	resp = submitForm(t, admin, s.URL, "/workspaces/1", "/workspaces/1/members/1/remove", url.Values{})
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestWorkspaceInvitationIsBoundToEmail(t *testing.T) {
+	s := newWorkspaceTestServer(t)
+	admin := s.register(t, "admin@example.com")
+	other := s.register(t, "other@example.com")
+
+	resp := submitForm(t, admin, s.URL, "/workspaces", "/workspaces", url.Values{"name": {"Growth"}})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	path := s.invite(t, admin, "invitee@example.com", WorkspaceEditor)
+
+	resp = submitForm(t, other, s.URL, path, path, url.Values{})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	status, _ := getPage(t, other, s.URL+"/invitations/unknown")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = getPage(t, newBrowser(t), s.URL+path)
+	require.Equal(t, http.StatusSeeOther, status)
+
+	invitee := s.register(t, "invitee@example.com")
+	resp = submitForm(t, invitee, s.URL, path, path, url.Values{})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	// Invitations can only be used once.
+	status, _ = getPage(t, invitee, s.URL+path)
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestParseOwner(t *testing.T) {
+	for owner, want := range map[string]struct {
+		kind string
+		id   int64
+	}{
+		"":            {"", 0},
+		"user:42":     {"user", 42},
+		"workspace:7": {"workspace", 7},
+	} {
+		kind, id, err := parseOwner(owner)
+		require.NoError(t, err, owner)
+		require.Equal(t, want.kind, kind, owner)
+		require.Equal(t, want.id, id, owner)
+	}
+
+	for _, owner := range []string{"user", "user:", "user:0", "user:-1", "user:042", "team:1", "workspace:x"} {
+		_, _, err := parseOwner(owner)
+		require.Error(t, err, owner)
+	}
+}
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Existing rows are not canonicalized: their canonical URL is their original
+-- URL, so they only deduplicate new links whose canonical form is exactly that
+-- URL. Shortening an equivalent URL spelled differently creates a new link.
+ALTER TABLE urls ADD COLUMN canonical_url TEXT;
+UPDATE urls SET canonical_url = original_url;
+ALTER TABLE urls ALTER COLUMN canonical_url SET NOT NULL;
+ALTER TABLE urls DROP CONSTRAINT urls_original_url_key;
+ALTER TABLE urls ADD CONSTRAINT urls_canonical_url_key UNIQUE (canonical_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP CONSTRAINT urls_canonical_url_key;
+ALTER TABLE urls DROP COLUMN canonical_url;
+ALTER TABLE urls ADD CONSTRAINT urls_original_url_key UNIQUE (original_url);
+-- +goose StatementEnd
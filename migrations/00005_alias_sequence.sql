@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE SEQUENCE alias_seq;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP SEQUENCE alias_seq;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Links created before owners existed stay in the anonymous namespace ('').
+ALTER TABLE urls ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls DROP CONSTRAINT urls_canonical_url_key;
+ALTER TABLE urls ADD CONSTRAINT urls_owner_canonical_url_key UNIQUE (owner, canonical_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM urls WHERE owner <> '';
+ALTER TABLE urls DROP CONSTRAINT urls_owner_canonical_url_key;
+ALTER TABLE urls ADD CONSTRAINT urls_canonical_url_key UNIQUE (canonical_url);
+ALTER TABLE urls DROP COLUMN owner;
+-- +goose StatementEnd
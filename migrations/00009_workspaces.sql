@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE workspaces (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE workspace_members (
+	workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	role TEXT NOT NULL CHECK (role IN ('admin', 'editor', 'viewer')),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (workspace_id, user_id)
+);
+CREATE INDEX workspace_members_user_id_idx ON workspace_members (user_id);
+
+CREATE TABLE workspace_invitations (
+	token_hash TEXT PRIMARY KEY,
+	workspace_id BIGINT NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	role TEXT NOT NULL CHECK (role IN ('admin', 'editor', 'viewer')),
+	invited_by BIGINT REFERENCES users (id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX workspace_invitations_workspace_id_idx ON workspace_invitations (workspace_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE workspace_invitations;
+DROP TABLE workspace_members;
+DROP TABLE workspaces;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE api_tokens (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	workspace_id BIGINT REFERENCES workspaces (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	kind TEXT NOT NULL CHECK (kind IN ('key', 'jwt')),
+	secret_hash TEXT UNIQUE,
+	scopes TEXT NOT NULL,
+	expires_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX api_tokens_user_id_idx ON api_tokens (user_id);
+
+CREATE TABLE token_denylist (
+	jti TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL,
+	revoked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX token_denylist_expires_at_idx ON token_denylist (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE token_denylist;
+DROP TABLE api_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN clicks BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN disabled_at TIMESTAMPTZ;
+
+CREATE TABLE abuse_reports (
+	id BIGSERIAL PRIMARY KEY,
+	url_id INTEGER NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+	reason TEXT NOT NULL,
+	reporter_ip TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX abuse_reports_url_id_idx ON abuse_reports (url_id);
+CREATE INDEX abuse_reports_created_at_idx ON abuse_reports (created_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE abuse_reports;
+ALTER TABLE urls DROP COLUMN disabled_at;
+ALTER TABLE urls DROP COLUMN clicks;
+-- +goose StatementEnd
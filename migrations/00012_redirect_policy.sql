@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN redirect_status SMALLINT NOT NULL DEFAULT 303
+	CHECK (redirect_status IN (301, 302, 303, 307, 308));
+ALTER TABLE urls ADD COLUMN cache_control TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN cache_control;
+ALTER TABLE urls DROP COLUMN redirect_status;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN passthrough BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE urls ADD COLUMN query_conflict TEXT NOT NULL DEFAULT 'override'
+	CHECK (query_conflict IN ('override', 'keep', 'append'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN query_conflict;
+ALTER TABLE urls DROP COLUMN passthrough;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN variants JSONB NOT NULL DEFAULT '[]';
+
+CREATE TABLE variant_clicks (
+	url_id INTEGER NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+	variant TEXT NOT NULL,
+	clicks BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (url_id, variant)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE variant_clicks;
+ALTER TABLE urls DROP COLUMN variants;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN ios_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN android_url TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN android_url;
+ALTER TABLE urls DROP COLUMN ios_url;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN active_from TIMESTAMPTZ;
+ALTER TABLE urls ADD COLUMN active_until TIMESTAMPTZ;
+ALTER TABLE urls ADD CONSTRAINT urls_active_window_check
+	CHECK (active_from IS NULL OR active_until IS NULL OR active_until > active_from);
+ALTER TABLE urls ADD COLUMN before_active TEXT NOT NULL DEFAULT 'not_found'
+	CHECK (before_active IN ('not_found', 'coming_soon'));
+ALTER TABLE urls ADD COLUMN expired_url TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN expired_url;
+ALTER TABLE urls DROP COLUMN before_active;
+ALTER TABLE urls DROP CONSTRAINT urls_active_window_check;
+ALTER TABLE urls DROP COLUMN active_until;
+ALTER TABLE urls DROP COLUMN active_from;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN max_clicks INTEGER CHECK (max_clicks > 0);
+ALTER TABLE urls ADD COLUMN one_time BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE urls ADD CONSTRAINT urls_one_time_check CHECK (NOT one_time OR max_clicks = 1);
+-- Click-limited links are handed out one per recipient, so they are never
+-- deduplicated.
+ALTER TABLE urls DROP CONSTRAINT urls_owner_canonical_url_key;
+CREATE UNIQUE INDEX urls_owner_canonical_url_key ON urls (owner, canonical_url) WHERE max_clicks IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM urls WHERE max_clicks IS NOT NULL;
+DROP INDEX urls_owner_canonical_url_key;
+ALTER TABLE urls ADD CONSTRAINT urls_owner_canonical_url_key UNIQUE (owner, canonical_url);
+ALTER TABLE urls DROP CONSTRAINT urls_one_time_check;
+ALTER TABLE urls DROP COLUMN one_time;
+ALTER TABLE urls DROP COLUMN max_clicks;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN preview_title TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN preview_description TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN preview_image TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN preview_image;
+ALTER TABLE urls DROP COLUMN preview_description;
+ALTER TABLE urls DROP COLUMN preview_title;
+-- +goose StatementEnd
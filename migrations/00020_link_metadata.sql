@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN meta_title TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN meta_description TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN meta_favicon TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN meta_canonical_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN meta_fetched_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN meta_fetched_at;
+ALTER TABLE urls DROP COLUMN meta_canonical_url;
+ALTER TABLE urls DROP COLUMN meta_favicon;
+ALTER TABLE urls DROP COLUMN meta_description;
+ALTER TABLE urls DROP COLUMN meta_title;
+-- +goose StatementEnd
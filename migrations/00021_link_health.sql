@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN fallback_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN health_status INTEGER;
+ALTER TABLE urls ADD COLUMN health_failures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN health_checked_at TIMESTAMPTZ;
+ALTER TABLE urls ADD COLUMN broken_since TIMESTAMPTZ;
+CREATE INDEX urls_health_checked_at_idx ON urls (health_checked_at NULLS FIRST);
+CREATE INDEX urls_broken_idx ON urls (owner, broken_since) WHERE broken_since IS NOT NULL;
+
+CREATE TABLE link_checks (
+	id BIGSERIAL PRIMARY KEY,
+	url_id INTEGER NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+	status INTEGER NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	checked_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX link_checks_url_id_idx ON link_checks (url_id, checked_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE link_checks;
+DROP INDEX urls_broken_idx;
+DROP INDEX urls_health_checked_at_idx;
+ALTER TABLE urls DROP COLUMN broken_since;
+ALTER TABLE urls DROP COLUMN health_checked_at;
+ALTER TABLE urls DROP COLUMN health_failures;
+ALTER TABLE urls DROP COLUMN health_status;
+ALTER TABLE urls DROP COLUMN fallback_url;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE urls ADD COLUMN template BOOLEAN NOT NULL DEFAULT FALSE;
+-- Links were templated whenever their destination had placeholders; keep
+-- those links working.
+UPDATE urls SET template = TRUE WHERE original_url ~ '\{([1-9][0-9]*|[A-Za-z_][A-Za-z0-9_]*)\}';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE urls DROP COLUMN template;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Only plain links, which have no settings beyond their destination, are
+-- reused when the same URL is shortened again; the settings of any other link
+-- would be handed to callers that did not ask for them.
+ALTER TABLE urls ADD COLUMN plain BOOLEAN NOT NULL DEFAULT TRUE;
+UPDATE urls SET plain = FALSE
+WHERE redirect_status <> 303 OR cache_control <> '' OR passthrough OR query_conflict <> 'override'
+	OR template OR rules <> '[]' OR variants <> '[]' OR ios_url <> '' OR android_url <> ''
+	OR active_from IS NOT NULL OR active_until IS NOT NULL OR before_active <> 'not_found' OR expired_url <> ''
+	OR max_clicks IS NOT NULL OR one_time
+	OR preview_title <> '' OR preview_description <> '' OR preview_image <> '' OR fallback_url <> '';
+DROP INDEX urls_owner_canonical_url_key;
+CREATE UNIQUE INDEX urls_owner_canonical_url_key ON urls (owner, canonical_url) WHERE plain;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM urls u WHERE NOT u.plain AND u.max_clicks IS NULL AND EXISTS (
+	SELECT 1 FROM urls o WHERE o.owner = u.owner AND o.canonical_url = u.canonical_url
+		AND o.max_clicks IS NULL AND o.id <> u.id AND (o.plain OR o.id < u.id)
+);
+DROP INDEX urls_owner_canonical_url_key;
+CREATE UNIQUE INDEX urls_owner_canonical_url_key ON urls (owner, canonical_url) WHERE max_clicks IS NULL;
+ALTER TABLE urls DROP COLUMN plain;
+-- +goose StatementEnd